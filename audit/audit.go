@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the admin audit trail.
+//
+// Every mutating command the broker runs is appended to the audit log as one
+// JSON line, with who sent it, what it changed, and how it ended. The log is
+// only ever appended to, and each entry is synced to disk before the command
+// it records carries on.
+// -----------------------------------------------------------------------------
+
+// Results of an audited command.
+const (
+	ResultApplied      = "applied"
+	ResultUnchanged    = "unchanged"
+	ResultUnauthorized = "unauthorized"
+)
+
+// Entry is one audited command.
+//
+// Before and After are the state the command touched, such as the channel a
+// subscriber was added to, and are omitted where there is none.
+type Entry struct {
+	Time       time.Time       `json:"time"`
+	Principal  string          `json:"principal"`
+	Method     string          `json:"method,omitempty"`
+	RemoteAddr string          `json:"remote-addr"`
+	UID        string          `json:"uid"`
+	Object     string          `json:"object"`
+	Command    string          `json:"command"`
+	Route      string          `json:"route,omitempty"`
+	Channel    string          `json:"channel,omitempty"`
+	Address    string          `json:"address,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Result     string          `json:"result"`
+}
+
+var log struct {
+	mutex sync.Mutex
+	file  *os.File
+	path  string
+}
+
+// Path is the audit log file, globals.AuditLogFile or audit.jsonl in the log
+// directory.
+func Path() string {
+	if globals.AuditLogFile != "" {
+		return comm.ResolvePath(globals.AuditLogFile)
+	}
+	return filepath.Join(globals.LogDirectory, "audit.jsonl")
+}
+
+// Record appends the entry to the audit log.
+func Record(e *Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if err := openLog(); err != nil {
+		return err
+	}
+	if _, err := log.file.Write(line); err != nil {
+		return fmt.Errorf("could not write audit log: %w", err)
+	}
+	return log.file.Sync()
+}
+
+// openLog opens the audit log for appending, reopening it if the configured
+// path changed. Must hold the log mutex.
+func openLog() error {
+	path := Path()
+	if log.file != nil && log.path == path {
+		return nil
+	}
+	if log.file != nil {
+		_ = log.file.Close()
+		log.file = nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("could not create audit log dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %w", err)
+	}
+	log.file, log.path = f, path
+	return nil
+}
+
+// -------Queries---------------------------------------------------------------
+
+// Filter selects audit entries. Zero fields match everything.
+type Filter struct {
+	Principal string
+	Object    string
+	Route     string
+	Result    string
+	Since     time.Time
+	Until     time.Time
+
+	// Limit keeps only the newest entries. 0 keeps every match.
+	Limit int
+}
+
+func (f *Filter) match(e *Entry) bool {
+	switch {
+	case f.Principal != "" && e.Principal != f.Principal:
+		return false
+	case f.Object != "" && e.Object != f.Object:
+		return false
+	case f.Route != "" && e.Route != f.Route:
+		return false
+	case f.Result != "" && e.Result != f.Result:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Query returns the entries matching the filter, oldest first.
+func Query(f Filter) ([]Entry, error) {
+	file, err := os.Open(Path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), globals.BytesInMegabyte)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A torn final line from a crash mid-write; skip it.
+			continue
+		}
+		if !f.match(&e) {
+			continue
+		}
+		entries = append(entries, e)
+		if f.Limit > 0 && len(entries) > f.Limit {
+			entries = entries[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read audit log: %w", err)
+	}
+	return entries, nil
+}
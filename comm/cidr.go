@@ -0,0 +1,58 @@
+package comm
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the address helpers for the client listener's allow and deny
+// lists.
+// -----------------------------------------------------------------------------
+
+// ParsePrefixes parses a list of CIDRs. Bare IPs are taken as single address
+// prefixes.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// PrefixesContain reports whether any of the prefixes contains addr.
+func PrefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP returns the connection's remote IP. ok is false for connections
+// that are not over IP.
+func RemoteIP(conn net.Conn) (addr netip.Addr, ok bool) {
+	tcp, isTCP := conn.RemoteAddr().(*net.TCPAddr)
+	if !isTCP {
+		return netip.Addr{}, false
+	}
+	addr, ok = netip.AddrFromSlice(tcp.IP)
+	return addr.Unmap(), ok
+}
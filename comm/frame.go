@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"mycelia/errgo"
 	"mycelia/globals"
@@ -22,12 +23,29 @@ const lenU32 = 4
 // ReadFrameU32 reads the frame's byte stream until the message header's worth
 // of bytes have been consumed, then return a buffer of those bytes or error.
 func ReadFrameU32(conn net.Conn) ([]byte, error) {
+	return ReadFrameU32Deadline(conn, 0, 0)
+}
+
+// ReadFrameU32Deadline is ReadFrameU32 with read deadlines: the next frame's
+// header must arrive within idle, and its body within timeout of the header.
+// A zero duration disables that deadline.
+func ReadFrameU32Deadline(
+	conn net.Conn, idle, timeout time.Duration,
+) ([]byte, error) {
+	if err := conn.SetReadDeadline(deadline(idle)); err != nil {
+		return nil, err
+	}
+
 	var hdr [lenU32]byte
 	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
 		return nil, err
 	}
 	n := binary.BigEndian.Uint32(hdr[:])
 
+	if err := conn.SetReadDeadline(deadline(timeout)); err != nil {
+		return nil, err
+	}
+
 	if n == 0 {
 		return nil, nil
 	}
@@ -57,3 +75,11 @@ func ReadFrameU32(conn net.Conn) ([]byte, error) {
 	BufPool.Put(p) // return buffer for reuse
 	return out, nil
 }
+
+// deadline is d from now, or no deadline for zero.
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
@@ -0,0 +1,145 @@
+package comm
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+
+	"mycelia/globals"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the helpers for opening the broker's client listeners.
+//
+// TLS listeners serve the certificate configured by globals.TLSCertFile and
+// globals.TLSKeyFile. Unix socket listeners remove a stale socket file left at
+// their path before binding, and chmod the new one to the listener's mode.
+// -----------------------------------------------------------------------------
+
+// defaultSocketMode is the permissions of unix sockets without a mode.
+const defaultSocketMode = 0o660
+
+// DefaultListenerSpec is the listener on globals.Address and globals.Port,
+// over TLS when a certificate is configured.
+func DefaultListenerSpec() globals.Listener {
+	protocol := globals.ListenTCP
+	if TLSEnabled() {
+		protocol = globals.ListenTLS
+	}
+	return globals.Listener{
+		Name:     globals.DefaultListener,
+		Protocol: protocol,
+		Address:  net.JoinHostPort(globals.Address, strconv.Itoa(globals.Port)),
+	}
+}
+
+// ValidateListener checks the listener's protocol, address, mode, and auth
+// policy.
+func ValidateListener(l globals.Listener) error {
+	return ValidateListenerTLS(l, TLSEnabled())
+}
+
+// ValidateListenerTLS is ValidateListener for when whether tls-cert and
+// tls-key are set is not yet in the globals, as while a config file is read.
+func ValidateListenerTLS(l globals.Listener, tlsEnabled bool) error {
+	if l.Name == "" {
+		return errors.New("listener without a name")
+	}
+	if l.Name == globals.DefaultListener {
+		return fmt.Errorf(
+			"listener name %q is reserved for address and port", l.Name,
+		)
+	}
+	if l.Address == "" {
+		return fmt.Errorf("listener %s has no address", l.Name)
+	}
+
+	switch l.Protocol {
+	case globals.ListenTCP, globals.ListenTLS:
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Name, err)
+		}
+		if l.Protocol == globals.ListenTLS && !tlsEnabled {
+			return fmt.Errorf("listener %s needs tls-cert and tls-key", l.Name)
+		}
+	case globals.ListenUnix:
+		if _, err := socketMode(l.Mode); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Name, err)
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown protocol %q", l.Name, l.Protocol)
+	}
+	if l.Mode != "" && l.Protocol != globals.ListenUnix {
+		return fmt.Errorf("listener %s: mode is only for unix sockets", l.Name)
+	}
+
+	switch l.Auth {
+	case globals.ListenAuthDefault, globals.ListenAuthRequired,
+		globals.ListenAuthOptional, globals.ListenAuthTrusted:
+	default:
+		return fmt.Errorf("listener %s: unknown auth policy %q", l.Name, l.Auth)
+	}
+	return nil
+}
+
+// Listen opens the listener described by l.
+func Listen(l globals.Listener) (net.Listener, error) {
+	switch l.Protocol {
+	case globals.ListenTLS:
+		cfg, err := ServerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		return tls.Listen("tcp", l.Address, cfg)
+	case globals.ListenUnix:
+		return listenUnix(l)
+	default:
+		return net.Listen("tcp", l.Address)
+	}
+}
+
+func listenUnix(l globals.Listener) (net.Listener, error) {
+	mode, err := socketMode(l.Mode)
+	if err != nil {
+		return nil, err
+	}
+	path := ResolvePath(l.Address)
+
+	// A socket file outlives a broker that did not shut down cleanly.
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, fmt.Errorf("could not set socket mode: %w", err)
+	}
+	return ln, nil
+}
+
+// socketMode parses an octal file mode, defaulting to defaultSocketMode.
+func socketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return defaultSocketMode, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q", mode)
+	}
+	return os.FileMode(m), nil
+}
@@ -0,0 +1,221 @@
+package comm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mycelia/globals"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the TLS helpers for the client listener and for dialing
+// subscribers and transformers.
+//
+// TLS is enabled when globals.TLSCertFile and globals.TLSKeyFile are set. When
+// globals.TLSClientCAFile is also set, clients must present a certificate
+// signed by one of the bundle's CAs, and the certificate's identity is what
+// authorization checks see for the connection.
+// -----------------------------------------------------------------------------
+
+// TLSVersions maps the accepted min version names onto crypto/tls values.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSEnabled reports whether the client listener should speak TLS.
+func TLSEnabled() bool {
+	return globals.TLSCertFile != "" || globals.TLSKeyFile != ""
+}
+
+// ServerTLSConfig builds the client listener's TLS config from the globals.
+// Files are read on every call so a listener update picks up renewed
+// certificates.
+func ServerTLSConfig() (*tls.Config, error) {
+	if globals.TLSCertFile == "" || globals.TLSKeyFile == "" {
+		return nil, errors.New("tls-cert and tls-key must both be set")
+	}
+
+	minVersion, ok := TLSVersions[globals.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", globals.TLSMinVersion)
+	}
+
+	cert, err := tls.LoadX509KeyPair(
+		ResolvePath(globals.TLSCertFile), ResolvePath(globals.TLSKeyFile),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS key pair: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+
+	if globals.TLSClientCAFile != "" {
+		pool, err := LoadCertPool(globals.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(ResolvePath(file))
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// ResolvePath makes relative paths relative to the exe's directory, where
+// Mycelia_Config.json lives.
+func ResolvePath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(globals.ExeDir, file)
+}
+
+// PeerIdentity returns the identity of the verified client certificate on the
+// connection: its subject common name, else its first URI or DNS SAN.
+// Returns "" for plain connections and clients without a verified certificate.
+//
+// The TLS handshake must have completed.
+func PeerIdentity(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tc.ConnectionState()
+	if !state.HandshakeComplete || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// -------Dialing---------------------------------------------------------------
+
+// TLSScheme prefixes subscriber and transformer addresses that are dialed over
+// TLS, e.g. "tls://10.0.0.5:9000?ca=certs/ca.pem&sni=orders.internal".
+//
+// Query options:
+//
+//	ca    PEM CA bundle the server certificate must chain to, replacing the
+//	      system roots.
+//	cert  PEM client certificate presented for mutual TLS.
+//	key   PEM private key for cert.
+//	sni   Server name sent and verified instead of the address's host.
+const TLSScheme = "tls://"
+
+// DialTLS is the TLS settings for an outbound address.
+type DialTLS struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server-name"`
+}
+
+// Address returns the tls:// form of hostport carrying the settings.
+func (d DialTLS) Address(hostport string) string {
+	q := url.Values{}
+	if d.CA != "" {
+		q.Set("ca", d.CA)
+	}
+	if d.Cert != "" {
+		q.Set("cert", d.Cert)
+	}
+	if d.Key != "" {
+		q.Set("key", d.Key)
+	}
+	if d.ServerName != "" {
+		q.Set("sni", d.ServerName)
+	}
+
+	addr := TLSScheme + hostport
+	if len(q) > 0 {
+		addr += "?" + q.Encode()
+	}
+	return addr
+}
+
+// ParseDialAddress splits an outbound address into the host:port to dial and,
+// for tls:// addresses, the client TLS config to handshake with.
+// Plain addresses are returned as-is with a nil config.
+func ParseDialAddress(address string) (string, *tls.Config, error) {
+	if !strings.HasPrefix(address, TLSScheme) {
+		return address, nil, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid TLS address %q: %w", address, err)
+	}
+	if u.Host == "" {
+		return "", nil, fmt.Errorf("TLS address %q has no host", address)
+	}
+	q := u.Query()
+
+	cfg := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if sni := q.Get("sni"); sni != "" {
+		cfg.ServerName = sni
+	}
+
+	if ca := q.Get("ca"); ca != "" {
+		pool, err := LoadCertPool(ca)
+		if err != nil {
+			return "", nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	cert, key := q.Get("cert"), q.Get("key")
+	if (cert == "") != (key == "") {
+		return "", nil, fmt.Errorf(
+			"TLS address %q needs both cert and key for a client certificate",
+			address,
+		)
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(ResolvePath(cert), ResolvePath(key))
+		if err != nil {
+			return "", nil, fmt.Errorf("could not load client key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+
+	return u.Host, cfg, nil
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"sync"
+
+	"mycelia/globals"
+	"mycelia/routing"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// subscription is a route + channel a gateway connection subscribed to.
+type subscription struct {
+	route   string
+	channel string
+}
+
+// binding is the broker side of a persistent gateway connection. It owns the
+// connection's responder and conduit address and remembers its subscriptions
+// so they can be removed when the connection closes.
+type binding struct {
+	broker  *routing.Broker
+	rc      *responseConn
+	resp    *rhizome.ConnResponder
+	address string
+
+	mutex sync.Mutex
+	subs  map[subscription]bool
+}
+
+// newBinding registers the conduit that the connection's deliveries are
+// pushed through.
+func newBinding(
+	b *routing.Broker, network, remote string, c routing.Conduit,
+) *binding {
+	rc := newResponseConn(network, remote)
+	return &binding{
+		broker:  b,
+		rc:      rc,
+		resp:    rhizome.NewConnResponder(rc),
+		address: routing.RegisterConduit(c),
+		subs:    map[subscription]bool{},
+	}
+}
+
+// publish hands a delivery to the broker, for the channel alone if one is
+// given, or else for the route. For AckPlcyOnsent the returned channel yields
+// the delivery's ack, or AckTimeout, once it is known; otherwise it is nil.
+func (bd *binding) publish(
+	route, channel, key string, payload []byte, ackPlcy uint8,
+) (string, <-chan uint8) {
+	cmd := globals.CmdSend
+	if channel != "" {
+		cmd = globals.CmdSendChannel
+	}
+	obj := newObject(
+		globals.ObjDelivery, cmd, ackPlcy,
+		route, channel, key, "",
+		payload, bd.resp,
+	)
+
+	if ackPlcy != globals.AckPlcyOnsent {
+		_ = bd.broker.HandleObject(obj)
+		return obj.UID, nil
+	}
+
+	ch := bd.rc.expect(obj.UID)
+	_ = bd.broker.HandleObject(obj)
+
+	out := make(chan uint8, 1)
+	go func() {
+		out <- bd.rc.wait(obj.UID, ch, defaultAckTimeout)
+	}()
+	return obj.UID, out
+}
+
+// subscribe adds, or with globals.CmdRemove removes, the connection as a
+// subscriber of route + channel. Returns the broker's nack, or AckUnknown on
+// success.
+func (bd *binding) subscribe(route, channel string, cmd uint8) (string, uint8, error) {
+	obj := newObject(
+		globals.ObjSubscriber, cmd, globals.AckPlcyNoreply,
+		route, channel, bd.address, "",
+		nil, bd.resp,
+	)
+
+	ack, err := runCommand(bd.broker, bd.rc, obj)
+	if err != nil || ack != globals.AckUnknown {
+		return obj.UID, ack, err
+	}
+
+	sub := subscription{route: route, channel: channel}
+	bd.mutex.Lock()
+	if cmd == globals.CmdAdd {
+		bd.subs[sub] = true
+	} else {
+		delete(bd.subs, sub)
+	}
+	bd.mutex.Unlock()
+
+	return obj.UID, ack, nil
+}
+
+// authenticate authenticates the connection with the broker using token.
+// Returns true on success.
+func (bd *binding) authenticate(token string) bool {
+	return authenticate(bd.broker, bd.rc, bd.resp, token) == globals.AckAuthenticated
+}
+
+// subscriptions returns a copy of the connection's current subscriptions.
+func (bd *binding) subscriptions() []subscription {
+	bd.mutex.Lock()
+	defer bd.mutex.Unlock()
+
+	subs := make([]subscription, 0, len(bd.subs))
+	for sub := range bd.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// close removes every subscription the connection made and unregisters it.
+func (bd *binding) close() {
+	routing.UnregisterConduit(bd.address)
+
+	for _, sub := range bd.subscriptions() {
+		_, _, _ = bd.subscribe(sub.route, sub.channel, globals.CmdRemove)
+	}
+
+	bd.broker.EndSession(bd.resp)
+	_ = bd.rc.Close()
+}
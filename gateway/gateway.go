@@ -0,0 +1,395 @@
+package gateway
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
+
+	"github.com/google/uuid"
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the protocol gateways, optional listeners that let clients which
+// cannot speak the u32-framed rhizome protocol talk to the broker.
+//
+// Gateways translate their protocol into the same rhizome.Object the server
+// decodes off the wire and hand it to Broker.HandleObject. The broker's
+// responses are captured by a responseConn and translated back.
+//
+// Gateways are stopped before the broker is closed, so the sessions they end
+// can still remove their subscriptions and nothing is handed to a closed
+// broker.
+// -----------------------------------------------------------------------------
+
+// Start launches every gateway enabled in globals.
+func Start(b *routing.Broker) {
+	if globals.HTTPPort != 0 {
+		startHTTP(b)
+	}
+	if globals.MQTTPort != 0 {
+		startMQTT(b)
+	}
+	if globals.RESPPort != 0 {
+		startRESP(b)
+	}
+	if globals.STOMPPort != 0 {
+		startSTOMP(b)
+	}
+}
+
+// serveTCP listens on the bind address and port, handing each connection to
+// handle on its own goroutine until shutdown.
+func serveTCP(name string, port int, handle func(net.Conn)) {
+	addr := net.JoinHostPort(globals.Address, strconv.Itoa(port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logging.LogSystemError(
+			fmt.Sprintf("Could not start %s gateway on %s: %s", name, addr, err),
+		)
+		return
+	}
+	if !running.listen(l) {
+		_ = l.Close()
+		return
+	}
+	logging.LogSystemAction(fmt.Sprintf("%s gateway listening on %s", name, addr))
+
+	go func() {
+		defer func() { _ = l.Close() }()
+		for !globals.PerformShutdown.Load() {
+			c, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				logging.LogSystemWarning(
+					fmt.Sprintf("%s gateway accept: %s", name, err),
+				)
+				continue
+			}
+			if !running.open(c) {
+				_ = c.Close()
+				return
+			}
+			go func() {
+				defer running.done(c)
+				handle(c)
+			}()
+		}
+	}()
+}
+
+// -------Stopping--------------------------------------------------------------
+
+// running is what the gateways have open.
+var running = &gateways{conns: map[io.Closer]struct{}{}}
+
+// gateways tracks the gateways' listeners, HTTP servers, and connections, and
+// the handlers serving those connections.
+type gateways struct {
+	mutex     sync.Mutex
+	stopped   bool
+	listeners []io.Closer
+	servers   []*http.Server
+	conns     map[io.Closer]struct{}
+	handlers  sync.WaitGroup
+}
+
+// listen registers a gateway listener. Returns false once the gateways are
+// stopped.
+func (g *gateways) listen(l io.Closer) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.stopped {
+		return false
+	}
+	g.listeners = append(g.listeners, l)
+	return true
+}
+
+// serve registers a gateway HTTP server. Returns false once the gateways are
+// stopped.
+func (g *gateways) serve(srv *http.Server) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.stopped {
+		return false
+	}
+	g.servers = append(g.servers, srv)
+	return true
+}
+
+// open registers a connection about to be handled. Returns false once the
+// gateways are stopped, in which case the connection is not to be handled.
+// Every connection open accepts must be passed to done when its handler
+// returns.
+func (g *gateways) open(c io.Closer) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.stopped {
+		return false
+	}
+	g.conns[c] = struct{}{}
+	g.handlers.Add(1)
+	return true
+}
+
+// done closes a connection whose handler has returned.
+func (g *gateways) done(c io.Closer) {
+	_ = c.Close()
+	g.mutex.Lock()
+	delete(g.conns, c)
+	g.mutex.Unlock()
+	g.handlers.Done()
+}
+
+// Stop stops every gateway accepting connections and requests, closes the
+// connections open on them, and waits until deadline for their handlers to
+// return. Must be called before the broker is closed, as handlers ending
+// their sessions still hand the broker objects.
+func Stop(deadline time.Time) {
+	g := running
+	g.mutex.Lock()
+	g.stopped = true
+	listeners, servers := g.listeners, g.servers
+	g.mutex.Unlock()
+
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logging.LogSystemWarning(
+				fmt.Sprintf("HTTP gateway did not shut down: %s", err),
+			)
+			_ = srv.Close()
+		}
+	}
+
+	g.mutex.Lock()
+	for c := range g.conns {
+		_ = c.Close()
+	}
+	g.mutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		g.handlers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		logging.LogSystemWarning(
+			"Gateway connections did not close before the shutdown deadline",
+		)
+	}
+}
+
+// disconnected reports whether a session ended because its client hung up or
+// its connection was closed on shutdown, rather than on an error.
+func disconnected(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+// defaultAckTimeout is how long gateways wait on a delivery's ack.
+const defaultAckTimeout = 5 * time.Second
+
+// newObject creates a rhizome object as if it had been decoded off the wire
+// from the given responder.
+func newObject(
+	objType, cmdType, ackPlcy uint8,
+	arg1, arg2, arg3, arg4 string,
+	payload []byte, resp *rhizome.ConnResponder,
+) *rhizome.Object {
+	obj := rhizome.NewObject(
+		objType, cmdType, ackPlcy,
+		uuid.New().String(),
+		arg1, arg2, arg3, arg4,
+		payload,
+	)
+	obj.Version = rhizome.ProtocolV1
+	obj.Responder = resp
+	return obj
+}
+
+// runCommand hands a topology command to the broker and returns its nack, or
+// globals.AckUnknown if the command was applied. The broker only answers these
+// commands on failure, and answers them before HandleObject returns.
+func runCommand(
+	b *routing.Broker, rc *responseConn, obj *rhizome.Object,
+) (uint8, error) {
+	ch := rc.expect(obj.UID)
+	err := b.HandleObject(obj)
+	if ack := rc.poll(obj.UID, ch); ack != globals.AckUnknown {
+		return ack, nil
+	}
+	return globals.AckUnknown, err
+}
+
+// authenticate authenticates the responder's connection with the broker,
+// returning globals.AckAuthenticated or globals.AckUnauthorized.
+func authenticate(
+	b *routing.Broker, rc *responseConn, resp *rhizome.ConnResponder,
+	token string,
+) uint8 {
+	obj := newObject(
+		globals.ObjAction, globals.CmdAuthenticate, globals.AckPlcyNoreply,
+		"", "", "", "",
+		[]byte(token), resp,
+	)
+	ack, _ := runCommand(b, rc, obj)
+	if ack != globals.AckAuthenticated {
+		return globals.AckUnauthorized
+	}
+	return ack
+}
+
+// -------Acks------------------------------------------------------------------
+
+var ackName = map[uint8]string{
+	globals.AckUnknown:              "unknown",
+	globals.AckSent:                 "sent",
+	globals.AckAuthenticated:        "authenticated",
+	globals.AckRebound:              "rebound",
+	globals.AckExported:             "exported",
+	globals.AckApplied:              "applied",
+	globals.AckTimeout:              "timeout",
+	globals.AckChannelNotFound:      "channel-not-found",
+	globals.AckChannelAlreadyExists: "channel-already-exists",
+	globals.AckRouteNotFound:        "route-not-found",
+	globals.AckUnauthorized:         "unauthorized",
+	globals.AckRebindFailed:         "rebind-failed",
+	globals.AckExportFailed:         "export-failed",
+	globals.AckApplyFailed:          "apply-failed",
+}
+
+// -------Response Capture------------------------------------------------------
+
+// gatewayAddr is the net.Addr of a gateway client.
+type gatewayAddr struct {
+	network string
+	addr    string
+}
+
+func (a gatewayAddr) Network() string { return a.network }
+func (a gatewayAddr) String() string  { return a.addr }
+
+// responseConn is the net.Conn the broker writes rhizome responses to for
+// objects that arrived through a gateway. Each response is decoded and handed
+// to whoever is waiting on its UID.
+type responseConn struct {
+	remote  net.Addr
+	mutex   sync.Mutex
+	waiters map[string]chan uint8
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newResponseConn(network, remote string) *responseConn {
+	return &responseConn{
+		remote:  gatewayAddr{network: network, addr: remote},
+		waiters: map[string]chan uint8{},
+		closed:  make(chan struct{}),
+	}
+}
+
+// expect registers interest in the ack for uid. Must be called before the
+// object is handed to the broker.
+func (rc *responseConn) expect(uid string) <-chan uint8 {
+	ch := make(chan uint8, 1)
+	rc.mutex.Lock()
+	rc.waiters[uid] = ch
+	rc.mutex.Unlock()
+	return ch
+}
+
+// forget drops interest in the ack for uid.
+func (rc *responseConn) forget(uid string) {
+	rc.mutex.Lock()
+	delete(rc.waiters, uid)
+	rc.mutex.Unlock()
+}
+
+// wait blocks until the ack for uid arrives or the timeout elapses, returning
+// globals.AckTimeout in the latter case.
+func (rc *responseConn) wait(uid string, ch <-chan uint8, d time.Duration) uint8 {
+	defer rc.forget(uid)
+	select {
+	case ack := <-ch:
+		return ack
+	case <-time.After(d):
+		return globals.AckTimeout
+	}
+}
+
+// poll returns the ack for uid if one was already written, or
+// globals.AckUnknown. Used for commands the broker only answers on failure.
+func (rc *responseConn) poll(uid string, ch <-chan uint8) uint8 {
+	defer rc.forget(uid)
+	select {
+	case ack := <-ch:
+		return ack
+	default:
+		return globals.AckUnknown
+	}
+}
+
+// Write decodes a v1 response: u16 len | u8 len uid | uid | u8 ack.
+func (rc *responseConn) Write(b []byte) (int, error) {
+	if len(b) < 4 {
+		return len(b), nil
+	}
+	body := b[2:]
+	if int(binary.BigEndian.Uint16(b)) != len(body) {
+		return len(b), nil
+	}
+	n := int(body[0])
+	if len(body) < n+2 {
+		return len(b), nil
+	}
+	uid := string(body[1 : 1+n])
+	ack := body[1+n]
+
+	rc.mutex.Lock()
+	ch, ok := rc.waiters[uid]
+	delete(rc.waiters, uid)
+	rc.mutex.Unlock()
+
+	if ok {
+		ch <- ack
+	}
+	return len(b), nil
+}
+
+// Read blocks until the conn is closed; the broker never reads responders.
+func (rc *responseConn) Read(_ []byte) (int, error) {
+	<-rc.closed
+	return 0, io.EOF
+}
+
+func (rc *responseConn) Close() error {
+	rc.once.Do(func() { close(rc.closed) })
+	return nil
+}
+
+func (rc *responseConn) LocalAddr() net.Addr                { return rc.remote }
+func (rc *responseConn) RemoteAddr() net.Addr               { return rc.remote }
+func (rc *responseConn) SetDeadline(_ time.Time) error      { return nil }
+func (rc *responseConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (rc *responseConn) SetWriteDeadline(_ time.Time) error { return nil }
@@ -0,0 +1,477 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mycelia/audit"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// The HTTP gateway.
+//
+//	POST   /routes/{route}                              publish a delivery
+//	GET    /broker                                      broker shape
+//	GET    /ws                                          websocket gateway
+//	POST   /admin/routes/{route}/channels/{channel}     add channel
+//	DELETE /admin/routes/{route}/channels/{channel}     remove channel
+//	POST   /admin/routes/{route}/channels/{channel}/transformers?address=
+//	DELETE /admin/routes/{route}/channels/{channel}/transformers?address=
+//	POST   /admin/routes/{route}/channels/{channel}/subscribers?address=
+//	DELETE /admin/routes/{route}/channels/{channel}/subscribers?address=
+//	GET    /admin/audit                                 query the audit log
+//	GET    /admin/config                                export the broker config
+//	POST   /admin/config?dry-run=&prune=                apply a config document
+//
+// Publishing accepts ack=onsent (default) or ack=none, key= for the partition
+// key, and timeout= for how long to wait on the ack.
+//
+// Audit queries accept principal=, object=, route=, and result= to match
+// entries on, since= and until= as RFC 3339 times or durations ago, and limit=
+// for the newest entries to return (default 100, 0 for all).
+//
+// Config applies take the document as the body and answer with the apply
+// report. dry-run=true only reports the changes, prune=true also removes what
+// the document does not list.
+//
+// Requests authenticate with an "Authorization: Bearer <token>" header.
+// -----------------------------------------------------------------------------
+
+// defaultAuditLimit is how many audit entries a query returns without limit=.
+const defaultAuditLimit = 100
+
+// maxConfigSize is the largest config document an apply accepts.
+const maxConfigSize = 16 * globals.BytesInMegabyte
+
+// ackResponse is the JSON body returned for publish and admin requests.
+type ackResponse struct {
+	UID    string `json:"uid"`
+	Ack    uint8  `json:"ack"`
+	Result string `json:"result"`
+}
+
+type httpGateway struct {
+	broker *routing.Broker
+}
+
+func startHTTP(b *routing.Broker) {
+	g := &httpGateway{broker: b}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /routes/{route}", g.publish)
+	mux.HandleFunc("GET /broker", g.shape)
+	mux.HandleFunc("GET /ws", g.websocket)
+
+	channelPath := "/admin/routes/{route}/channels/{channel}"
+	mux.HandleFunc("POST "+channelPath, g.channel(globals.CmdAdd))
+	mux.HandleFunc("DELETE "+channelPath, g.channel(globals.CmdRemove))
+	mux.HandleFunc(
+		"POST "+channelPath+"/transformers",
+		g.component(globals.ObjTransformer, globals.CmdAdd),
+	)
+	mux.HandleFunc(
+		"DELETE "+channelPath+"/transformers",
+		g.component(globals.ObjTransformer, globals.CmdRemove),
+	)
+	mux.HandleFunc(
+		"POST "+channelPath+"/subscribers",
+		g.component(globals.ObjSubscriber, globals.CmdAdd),
+	)
+	mux.HandleFunc(
+		"DELETE "+channelPath+"/subscribers",
+		g.component(globals.ObjSubscriber, globals.CmdRemove),
+	)
+	mux.HandleFunc("GET /admin/audit", g.audit)
+	mux.HandleFunc("GET /admin/config", g.export)
+	mux.HandleFunc("POST /admin/config", g.apply)
+
+	addr := net.JoinHostPort(globals.Address, strconv.Itoa(globals.HTTPPort))
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if !running.serve(srv) {
+		return
+	}
+
+	go func() {
+		logging.LogSystemAction(fmt.Sprintf("HTTP gateway listening on %s", addr))
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.LogSystemError(fmt.Sprintf("HTTP gateway stopped: %s", err))
+		}
+	}()
+}
+
+// publish sends the request body to the route as a delivery.
+func (g *httpGateway) publish(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	ackPlcy := globals.AckPlcyOnsent
+	switch q.Get("ack") {
+	case "", "onsent":
+	case "none":
+		ackPlcy = globals.AckPlcyNoreply
+	default:
+		httpError(w, http.StatusBadRequest, "ack must be onsent or none")
+		return
+	}
+
+	timeout := defaultAckTimeout
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid timeout")
+			return
+		}
+		timeout = d
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, globals.BytesInMegabyte))
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	rc, resp, ok := g.session(w, r)
+	if !ok {
+		return
+	}
+	defer g.endSession(rc, resp)
+
+	obj := newObject(
+		globals.ObjDelivery, globals.CmdSend, ackPlcy,
+		r.PathValue("route"), "", q.Get("key"), "",
+		body, resp,
+	)
+
+	if ackPlcy == globals.AckPlcyNoreply {
+		err := g.broker.HandleObject(obj)
+		if errors.Is(err, routing.ErrUnauthorized) {
+			ack := globals.AckUnauthorized
+			writeAck(w, ackStatus(ack), obj.UID, ack, ackName[ack])
+			return
+		}
+		writeAck(w, http.StatusAccepted, obj.UID, globals.AckUnknown, "accepted")
+		return
+	}
+
+	ch := rc.expect(obj.UID)
+	_ = g.broker.HandleObject(obj)
+	ack := rc.wait(obj.UID, ch, timeout)
+	writeAck(w, ackStatus(ack), obj.UID, ack, ackName[ack])
+}
+
+// shape writes the broker's current routes, channels, and components.
+// Once access control is configured the request must be authenticated as a
+// principal that may export the config.
+func (g *httpGateway) shape(w http.ResponseWriter, r *http.Request) {
+	rc, resp, ok := g.session(w, r)
+	if !ok {
+		return
+	}
+	defer g.endSession(rc, resp)
+
+	routes, err := g.broker.ShapeFor(resp)
+	if errors.Is(err, routing.ErrUnauthorized) {
+		if bearerToken(r) == "" {
+			httpError(w, http.StatusUnauthorized, "authentication required")
+		} else {
+			httpError(w, http.StatusForbidden, "unauthorized")
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"routes": routes})
+}
+
+// channel handles adding and removing channels.
+func (g *httpGateway) channel(cmd uint8) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		strategy := ""
+		if cmd == globals.CmdAdd {
+			name := r.URL.Query().Get("strategy")
+			if name == "" {
+				name = globals.DefaultStrategy.String()
+			}
+			value, ok := globals.StrategyValue[name]
+			if !ok {
+				httpError(w, http.StatusBadRequest, "unknown strategy "+name)
+				return
+			}
+			strategy = strconv.Itoa(int(value))
+		}
+
+		g.admin(w, r, globals.ObjChannel, cmd, strategy)
+	}
+}
+
+// component handles adding and removing transformers and subscribers.
+func (g *httpGateway) component(objType, cmd uint8) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			httpError(w, http.StatusBadRequest, "missing address")
+			return
+		}
+		g.admin(w, r, objType, cmd, address)
+	}
+}
+
+// admin runs a topology command. The broker only answers these on failure, so
+// no ack means the command was applied.
+func (g *httpGateway) admin(
+	w http.ResponseWriter, r *http.Request, objType, cmd uint8, arg3 string,
+) {
+	rc, resp, ok := g.session(w, r)
+	if !ok {
+		return
+	}
+	defer g.endSession(rc, resp)
+
+	obj := newObject(
+		objType, cmd, globals.AckPlcyNoreply,
+		r.PathValue("route"), r.PathValue("channel"), arg3, "",
+		nil, resp,
+	)
+
+	ack, err := runCommand(g.broker, rc, obj)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if ack == globals.AckUnknown {
+		writeAck(w, http.StatusOK, obj.UID, ack, "ok")
+		return
+	}
+	writeAck(w, ackStatus(ack), obj.UID, ack, ackName[ack])
+}
+
+// audit writes the audit log entries matching the request's filter.
+func (g *httpGateway) audit(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rc, resp, ok := g.session(w, r)
+	if !ok {
+		return
+	}
+	defer g.endSession(rc, resp)
+
+	entries, err := g.broker.QueryAudit(resp, f)
+	if errors.Is(err, routing.ErrUnauthorized) {
+		httpError(w, http.StatusForbidden, "unauthorized")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+// export writes the broker's live topology and runtime parameters as a
+// Mycelia_Config.json document.
+func (g *httpGateway) export(w http.ResponseWriter, r *http.Request) {
+	rc, resp, ok := g.session(w, r)
+	if !ok {
+		return
+	}
+	defer g.endSession(rc, resp)
+
+	data, err := g.broker.ExportConfig(resp)
+	if errors.Is(err, routing.ErrUnauthorized) {
+		httpError(w, http.StatusForbidden, "unauthorized")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// apply changes the broker to match the config document in the request body
+// and writes the apply report.
+func (g *httpGateway) apply(w http.ResponseWriter, r *http.Request) {
+	var opts routing.ApplyOptions
+	q := r.URL.Query()
+	for name, opt := range map[string]*bool{
+		"dry-run": &opts.DryRun,
+		"prune":   &opts.Prune,
+	} {
+		if v := q.Get(name); v != "" {
+			var err error
+			if *opt, err = strconv.ParseBool(v); err != nil {
+				httpError(w, http.StatusBadRequest, "invalid "+name)
+				return
+			}
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	rc, resp, ok := g.session(w, r)
+	if !ok {
+		return
+	}
+	defer g.endSession(rc, resp)
+
+	obj := newObject(
+		globals.ObjConfig, globals.CmdApply, globals.AckPlcyNoreply,
+		opts.String(), "", "", "",
+		body, resp,
+	)
+	report, err := g.broker.ApplyConfig(obj)
+
+	status := http.StatusOK
+	switch {
+	case err == nil:
+	case errors.Is(err, routing.ErrInvalidConfig):
+		status = http.StatusBadRequest
+	case errors.Is(err, routing.ErrUnauthorized):
+		status = http.StatusForbidden
+	case errors.Is(err, routing.ErrShuttingDown):
+		status = http.StatusServiceUnavailable
+	default:
+		status = http.StatusInternalServerError
+	}
+	if report == nil {
+		httpError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, status, report)
+}
+
+// auditFilter parses an audit query's filter from the request's query string.
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{
+		Principal: q.Get("principal"),
+		Object:    q.Get("object"),
+		Route:     q.Get("route"),
+		Result:    q.Get("result"),
+		Limit:     defaultAuditLimit,
+	}
+
+	var err error
+	if f.Since, err = queryTime(q.Get("since")); err != nil {
+		return f, fmt.Errorf("invalid since: %w", err)
+	}
+	if f.Until, err = queryTime(q.Get("until")); err != nil {
+		return f, fmt.Errorf("invalid until: %w", err)
+	}
+	if v := q.Get("limit"); v != "" {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit < 0 {
+			return f, errors.New("invalid limit")
+		}
+	}
+	return f, nil
+}
+
+// queryTime parses an RFC 3339 time, or a duration before now.
+func queryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// -------Sessions--------------------------------------------------------------
+
+// session opens the request's responder and authenticates it with the
+// request's bearer token, if it has one. Writes a 401 and returns false if the
+// token is rejected. The caller must end the session.
+func (g *httpGateway) session(
+	w http.ResponseWriter, r *http.Request,
+) (*responseConn, *rhizome.ConnResponder, bool) {
+	rc := newResponseConn("http", r.RemoteAddr)
+	resp := rhizome.NewConnResponder(rc)
+
+	token := bearerToken(r)
+	if token == "" {
+		return rc, resp, true
+	}
+	if authenticate(g.broker, rc, resp, token) != globals.AckAuthenticated {
+		g.endSession(rc, resp)
+		httpError(w, http.StatusUnauthorized, "invalid token")
+		return nil, nil, false
+	}
+	return rc, resp, true
+}
+
+func (g *httpGateway) endSession(rc *responseConn, resp *rhizome.ConnResponder) {
+	g.broker.EndSession(resp)
+	_ = rc.Close()
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// -------Utils-----------------------------------------------------------------
+
+// ackStatus maps a broker ack onto the closest HTTP status code.
+func ackStatus(ack uint8) int {
+	switch ack {
+	case globals.AckSent:
+		return http.StatusOK
+	case globals.AckTimeout:
+		return http.StatusGatewayTimeout
+	case globals.AckChannelNotFound, globals.AckRouteNotFound:
+		return http.StatusNotFound
+	case globals.AckChannelAlreadyExists:
+		return http.StatusConflict
+	case globals.AckUnauthorized:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeAck(w http.ResponseWriter, status int, uid string, ack uint8, result string) {
+	writeJSON(w, status, ackResponse{UID: uid, Ack: ack, Result: result})
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.LogSystemWarning(fmt.Sprintf("Could not write HTTP response: %s", err))
+	}
+}
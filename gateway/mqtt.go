@@ -0,0 +1,406 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// The MQTT 3.1.1 gateway.
+//
+// Topics map onto Mycelia as "route/channel". A PUBLISH to "route" becomes a
+// delivery on the route, and one to "route/channel" a delivery to that channel
+// alone; QoS 0 publishes use AckPlcyNoreply and QoS 1 publishes use
+// AckPlcyOnsent, with the PUBACK sent once the broker acks the delivery as
+// sent. A SUBSCRIBE to "route/channel"
+// binds the connection as a subscriber of that channel until it disconnects.
+//
+// The CONNECT password is the security token the connection authenticates
+// with; the username is ignored.
+//
+// Deliveries are pushed to subscribers at QoS 0. Wildcard filters, QoS 2,
+// retained messages, wills, and persistent sessions are not supported.
+// -----------------------------------------------------------------------------
+
+const (
+	mqttConnect     byte = 1
+	mqttConnack     byte = 2
+	mqttPublish     byte = 3
+	mqttPuback      byte = 4
+	mqttSubscribe   byte = 8
+	mqttSuback      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsuback    byte = 11
+	mqttPingreq     byte = 12
+	mqttPingresp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+const (
+	mqttConnAccepted      byte = 0x00
+	mqttConnBadProtocol   byte = 0x01
+	mqttConnBadIdentifier byte = 0x02
+	mqttConnBadAuth       byte = 0x04
+	mqttConnNotAuthorized byte = 0x05
+	mqttSubackFailure     byte = 0x80
+	mqttProtocolLevel311  byte = 4
+)
+
+const (
+	mqttConnectTimeout     = 10 * time.Second
+	mqttWriteTimeout       = 10 * time.Second
+	mqttMaxRemainingLength = globals.BytesInMegabyte + 64*globals.BytesInKilobyte
+)
+
+type mqttSession struct {
+	*binding
+	conn   net.Conn
+	reader *bufio.Reader
+	wmutex sync.Mutex
+
+	keepAlive time.Duration
+}
+
+func startMQTT(b *routing.Broker) {
+	serveTCP("MQTT", globals.MQTTPort, func(c net.Conn) {
+		s := &mqttSession{conn: c, reader: bufio.NewReader(c)}
+		s.binding = newBinding(b, "mqtt", c.RemoteAddr().String(), s)
+		defer s.close()
+
+		logging.LogSystemAction(
+			fmt.Sprintf("MQTT client connected: %s", c.RemoteAddr()),
+		)
+		if err := s.serve(); err != nil && !disconnected(err) {
+			logging.LogSystemWarning(
+				fmt.Sprintf("MQTT client %s: %s", c.RemoteAddr(), err),
+			)
+		}
+		logging.LogSystemAction(
+			fmt.Sprintf("MQTT client disconnected: %s", c.RemoteAddr()),
+		)
+	})
+}
+
+// serve handles the CONNECT handshake and then packets until the client
+// disconnects.
+func (s *mqttSession) serve() error {
+	_ = s.conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	header, body, err := s.readPacket()
+	if err != nil {
+		return err
+	}
+	if header>>4 != mqttConnect {
+		return errors.New("first packet was not CONNECT")
+	}
+	if err := s.connect(body); err != nil {
+		return err
+	}
+
+	for {
+		if s.keepAlive > 0 {
+			_ = s.conn.SetReadDeadline(time.Now().Add(s.keepAlive * 3 / 2))
+		} else {
+			_ = s.conn.SetReadDeadline(time.Time{})
+		}
+
+		header, body, err := s.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch header >> 4 {
+		case mqttPublish:
+			err = s.handlePublish(header, body)
+		case mqttPuback:
+			// Deliveries are sent at QoS 0, nothing to acknowledge.
+		case mqttSubscribe:
+			err = s.handleSubscribe(body)
+		case mqttUnsubscribe:
+			err = s.handleUnsubscribe(body)
+		case mqttPingreq:
+			err = s.writePacket(mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return nil
+		default:
+			err = fmt.Errorf("unsupported packet type %d", header>>4)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect validates the CONNECT packet and answers with a CONNACK.
+func (s *mqttSession) connect(body []byte) error {
+	r := &mqttReader{b: body}
+	protocol := r.string()
+	level := r.byte()
+	flags := r.byte()
+	keepAlive := r.u16()
+	clientID := r.string()
+	if flags&0x04 != 0 { // will
+		r.string()
+		r.bytes()
+	}
+	if flags&0x80 != 0 { // username
+		r.string()
+	}
+	var password []byte
+	if flags&0x40 != 0 { // password
+		password = r.bytes()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if protocol != "MQTT" || level != mqttProtocolLevel311 {
+		_ = s.writePacket(mqttConnack<<4, []byte{0, mqttConnBadProtocol})
+		return fmt.Errorf("unsupported protocol %s level %d", protocol, level)
+	}
+	if clientID == "" && flags&0x02 == 0 {
+		_ = s.writePacket(mqttConnack<<4, []byte{0, mqttConnBadIdentifier})
+		return errors.New("empty client id without clean session")
+	}
+
+	if len(password) > 0 && !s.authenticate(string(password)) {
+		_ = s.writePacket(mqttConnack<<4, []byte{0, mqttConnBadAuth})
+		return errors.New("authentication failed")
+	}
+	if len(password) == 0 && globals.RequireAuth {
+		_ = s.writePacket(mqttConnack<<4, []byte{0, mqttConnNotAuthorized})
+		return errors.New("authentication required")
+	}
+
+	s.keepAlive = time.Duration(keepAlive) * time.Second
+	return s.writePacket(mqttConnack<<4, []byte{0, mqttConnAccepted})
+}
+
+func (s *mqttSession) handlePublish(header byte, body []byte) error {
+	qos := (header >> 1) & 0x03
+	r := &mqttReader{b: body}
+	topic := r.string()
+	var id uint16
+	if qos > 0 {
+		id = r.u16()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	payload := r.rest()
+
+	route, channel, _ := strings.Cut(topic, "/")
+
+	switch qos {
+	case 0:
+		s.publish(route, channel, topic, payload, globals.AckPlcyNoreply)
+	case 1:
+		uid, acks := s.publish(route, channel, topic, payload, globals.AckPlcyOnsent)
+		go func() {
+			ack := <-acks
+			if ack != globals.AckSent {
+				logging.LogObjectWarning(
+					fmt.Sprintf("MQTT publish to %s not acknowledged: %s",
+						topic, ackName[ack]), uid,
+				)
+				return
+			}
+			pkt := binary.BigEndian.AppendUint16(nil, id)
+			if err := s.writePacket(mqttPuback<<4, pkt); err != nil {
+				logging.LogObjectWarning(
+					fmt.Sprintf("Could not write PUBACK: %s", err), uid,
+				)
+			}
+		}()
+	default:
+		return errors.New("QoS 2 is not supported")
+	}
+
+	return nil
+}
+
+func (s *mqttSession) handleSubscribe(body []byte) error {
+	r := &mqttReader{b: body}
+	id := r.u16()
+
+	resp := binary.BigEndian.AppendUint16(nil, id)
+	for r.err == nil && r.remaining() > 0 {
+		filter := r.string()
+		_ = r.byte() // requested QoS, always granted 0
+		if r.err != nil {
+			break
+		}
+
+		route, channel, ok := splitFilter(filter)
+		if !ok {
+			resp = append(resp, mqttSubackFailure)
+			continue
+		}
+		_, ack, err := s.subscribe(route, channel, globals.CmdAdd)
+		if err != nil || ack != globals.AckUnknown {
+			resp = append(resp, mqttSubackFailure)
+			continue
+		}
+		resp = append(resp, 0x00)
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	return s.writePacket(mqttSuback<<4, resp)
+}
+
+func (s *mqttSession) handleUnsubscribe(body []byte) error {
+	r := &mqttReader{b: body}
+	id := r.u16()
+
+	for r.err == nil && r.remaining() > 0 {
+		filter := r.string()
+		if route, channel, ok := splitFilter(filter); ok && r.err == nil {
+			_, _, _ = s.subscribe(route, channel, globals.CmdRemove)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	return s.writePacket(mqttUnsuback<<4, binary.BigEndian.AppendUint16(nil, id))
+}
+
+// splitFilter maps a topic filter onto a route + channel.
+func splitFilter(filter string) (string, string, bool) {
+	if strings.ContainsAny(filter, "+#") {
+		return "", "", false
+	}
+	route, channel, ok := strings.Cut(filter, "/")
+	if !ok || route == "" || channel == "" || strings.Contains(channel, "/") {
+		return "", "", false
+	}
+	return route, channel, true
+}
+
+// Push sends a delivery to the client as a QoS 0 PUBLISH on "route/channel".
+func (s *mqttSession) Push(route, channel string, obj *rhizome.Object) error {
+	topic := route + "/" + channel
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	body = append(body, topic...)
+	body = append(body, obj.Payload...)
+	return s.writePacket(mqttPublish<<4, body)
+}
+
+// -------Packet IO-------------------------------------------------------------
+
+func (s *mqttSession) readPacket() (byte, []byte, error) {
+	header, err := s.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := s.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7F) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		mult *= 128
+	}
+	if n > mqttMaxRemainingLength {
+		return 0, nil, fmt.Errorf("packet too large: %d bytes", n)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func (s *mqttSession) writePacket(header byte, body []byte) error {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	pkt = append(pkt, body...)
+
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	_, err := s.conn.Write(pkt)
+	return err
+}
+
+// mqttReader walks a packet body, recording the first short read.
+type mqttReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *mqttReader) remaining() int { return len(r.b) - r.off }
+
+func (r *mqttReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.remaining() < n {
+		r.err = errors.New("malformed packet")
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *mqttReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *mqttReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *mqttReader) bytes() []byte {
+	return r.take(int(r.u16()))
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *mqttReader) rest() []byte {
+	return r.take(r.remaining())
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/routing"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// recorder is a conduit that records the deliveries pushed to it.
+type recorder struct {
+	pushed chan string
+}
+
+func (r *recorder) Push(route, channel string, obj *rhizome.Object) error {
+	r.pushed <- channel + " " + string(obj.Payload)
+	return nil
+}
+
+// newTopology returns a broker with the channels on the route, in order, each
+// subscribed to by the returned recorder.
+func newTopology(t *testing.T, route string, channels ...string) (
+	*routing.Broker, *recorder,
+) {
+	t.Helper()
+	prevState := globals.StateFile
+	t.Cleanup(func() { globals.StateFile = prevState })
+	globals.StateFile = ""
+
+	b := routing.NewBroker(nil)
+	rec := &recorder{pushed: make(chan string, 16)}
+	address := routing.RegisterConduit(rec)
+	t.Cleanup(func() { routing.UnregisterConduit(address) })
+
+	strategy := strconv.Itoa(int(globals.SelStratPubSub))
+	for _, channel := range channels {
+		for _, obj := range []*rhizome.Object{
+			newObject(
+				globals.ObjChannel, globals.CmdAdd, globals.AckPlcyNoreply,
+				route, channel, strategy, "", nil, nil,
+			),
+			newObject(
+				globals.ObjSubscriber, globals.CmdAdd, globals.AckPlcyNoreply,
+				route, channel, address, "", nil, nil,
+			),
+		} {
+			if err := b.HandleObject(obj); err != nil {
+				t.Fatalf("HandleObject: %v", err)
+			}
+		}
+	}
+	return b, rec
+}
+
+// publishBody is the body of a QoS 0 PUBLISH packet.
+func publishBody(topic, payload string) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	body = append(body, topic...)
+	return append(body, payload...)
+}
+
+func TestMQTTPublishChannel(t *testing.T) {
+	b, rec := newTopology(t, "orders", "audit", "billing")
+	s := &mqttSession{}
+	s.binding = newBinding(b, "mqtt", "test", s)
+
+	// The delivery to the route passes through both channels, after the one
+	// to billing alone, so once billing has both, audit has had its share.
+	for _, p := range [][2]string{
+		{"orders/billing", "one"},
+		{"orders", "all"},
+	} {
+		err := s.handlePublish(mqttPublish<<4, publishBody(p[0], p[1]))
+		if err != nil {
+			t.Fatalf("handlePublish(%s): %v", p[0], err)
+		}
+	}
+
+	got := map[string]int{}
+	timeout := time.After(5 * time.Second)
+	for got["billing all"] == 0 {
+		select {
+		case d := <-rec.pushed:
+			got[d]++
+		case <-timeout:
+			t.Fatalf("timed out waiting for deliveries, got %v", got)
+		}
+	}
+
+	want := map[string]int{"billing one": 1, "audit all": 1, "billing all": 1}
+	if len(got) != len(want) {
+		t.Fatalf("deliveries = %v, want %v", got, want)
+	}
+	for d, n := range want {
+		if got[d] != n {
+			t.Errorf("deliveries = %v, want %v", got, want)
+			break
+		}
+	}
+}
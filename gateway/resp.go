@@ -0,0 +1,578 @@
+package gateway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// The Redis pub/sub gateway, speaking enough RESP2 for PUBLISH, SUBSCRIBE,
+// PSUBSCRIBE, UNSUBSCRIBE, PUNSUBSCRIBE, PING, and QUIT.
+//
+// Redis channel names map onto Mycelia as "route<delimiter>channel", where the
+// delimiter is globals.RESPDelimiter. PUBLISH sends a delivery to the channel
+// and replies at once, without waiting on the delivery, with the number of
+// subscribers the channel dispatches it to: all of them for pub-sub channels,
+// one for the others. Unlike Redis, that counts subscribers as the PUBLISH
+// arrives, not ones that went on to receive it. SUBSCRIBE binds the connection
+// as a subscriber of the channel, replying with an error if it cannot be, e.g.
+// the channel does not exist.
+//
+// PSUBSCRIBE patterns use Redis glob syntax, matched against the full
+// "route<delimiter>channel" name. The connection is bound to every channel a
+// pattern matches, both those that exist when it is sent and those created
+// afterwards.
+//
+// AUTH authenticates the connection with a security token as the password;
+// any username is ignored.
+// -----------------------------------------------------------------------------
+
+const (
+	respWriteTimeout = 10 * time.Second
+	respMaxArgs      = 1024
+	respMaxLine      = 64 * globals.BytesInKilobyte
+)
+
+type respSession struct {
+	*binding
+	conn   net.Conn
+	reader *bufio.Reader
+	wmutex sync.Mutex
+
+	// Guarded by the binding's mutex.
+	channels map[subscription]bool
+	patterns map[string]bool
+}
+
+func startRESP(b *routing.Broker) {
+	serveTCP("RESP", globals.RESPPort, func(c net.Conn) {
+		s := &respSession{
+			conn:     c,
+			reader:   bufio.NewReaderSize(c, respMaxLine),
+			channels: map[subscription]bool{},
+			patterns: map[string]bool{},
+		}
+		s.binding = newBinding(b, "resp", c.RemoteAddr().String(), s)
+		defer s.close()
+
+		if err := s.serve(); err != nil && !disconnected(err) {
+			logging.LogSystemWarning(
+				fmt.Sprintf("RESP client %s: %s", c.RemoteAddr(), err),
+			)
+		}
+	})
+}
+
+func (s *respSession) serve() error {
+	for {
+		args, err := s.readCommand()
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if s.subscribed() && !allowedWhileSubscribed(cmd) {
+			s.writeError(fmt.Sprintf(
+				"Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+				strings.ToLower(cmd),
+			))
+			continue
+		}
+
+		switch cmd {
+		case "PUBLISH":
+			s.handlePublish(args[1:])
+		case "SUBSCRIBE":
+			s.handleSubscribe(args[1:])
+		case "PSUBSCRIBE":
+			s.handlePSubscribe(args[1:])
+		case "UNSUBSCRIBE":
+			s.handleUnsubscribe(args[1:])
+		case "PUNSUBSCRIBE":
+			s.handlePUnsubscribe(args[1:])
+		case "AUTH":
+			s.handleAuth(args[1:])
+		case "PING":
+			s.handlePing(args[1:])
+		case "QUIT":
+			s.write([]byte("+OK\r\n"))
+			return nil
+		default:
+			s.writeError(fmt.Sprintf("unknown command '%s'", args[0]))
+		}
+	}
+}
+
+func allowedWhileSubscribed(cmd string) bool {
+	switch cmd {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING", "QUIT":
+		return true
+	}
+	return false
+}
+
+// -------Commands--------------------------------------------------------------
+
+func (s *respSession) handlePublish(args []string) {
+	if len(args) != 2 {
+		s.writeError("wrong number of arguments for 'publish' command")
+		return
+	}
+
+	route, channel, _ := strings.Cut(args[0], globals.RESPDelimiter)
+	receivers := s.receivers(route, channel)
+	s.publish(
+		route, channel, args[0], []byte(args[1]), globals.AckPlcyNoreply,
+	)
+	s.write(respInteger(receivers))
+}
+
+// receivers is the number of subscribers a delivery to the channel, or with
+// no channel to each of the route's channels, is dispatched to.
+func (s *respSession) receivers(route, channel string) int {
+	if channel != "" {
+		ch, _ := s.broker.FindChannel(route, channel)
+		return dispatchCount(ch)
+	}
+
+	n := 0
+	for _, r := range s.broker.Shape() {
+		if r.Name != route {
+			continue
+		}
+		for _, ch := range r.Channels {
+			n += dispatchCount(ch)
+		}
+	}
+	return n
+}
+
+// dispatchCount is how many of the channel's subscribers its strategy sends a
+// delivery to.
+func dispatchCount(ch routing.ChannelShape) int {
+	n := len(ch.Subscribers)
+	if ch.Strategy != globals.SelStratPubSub.String() {
+		n = min(n, 1)
+	}
+	return n
+}
+
+func (s *respSession) handleSubscribe(args []string) {
+	if len(args) == 0 {
+		s.writeError("wrong number of arguments for 'subscribe' command")
+		return
+	}
+
+	for _, name := range args {
+		sub, ok := s.splitChannel(name)
+		if !ok {
+			s.writeError(fmt.Sprintf(
+				"invalid channel '%s', expected route%schannel",
+				name, globals.RESPDelimiter,
+			))
+			continue
+		}
+		if ack := s.bind(sub); ack != globals.AckUnknown {
+			s.writeError(fmt.Sprintf(
+				"could not subscribe to '%s': %s", name, ackName[ack],
+			))
+			continue
+		}
+
+		s.mutex.Lock()
+		s.channels[sub] = true
+		s.mutex.Unlock()
+		s.write(respPush("subscribe", name, s.count()))
+	}
+}
+
+func (s *respSession) handlePSubscribe(args []string) {
+	if len(args) == 0 {
+		s.writeError("wrong number of arguments for 'psubscribe' command")
+		return
+	}
+
+	for _, pattern := range args {
+		// Stored first, so channels created while the existing ones are bound
+		// are bound by ChannelAdded.
+		s.mutex.Lock()
+		s.patterns[pattern] = true
+		s.mutex.Unlock()
+
+		for _, r := range s.broker.Shape() {
+			for _, c := range r.Channels {
+				name := r.Name + globals.RESPDelimiter + c.Name
+				if respMatch(pattern, name) {
+					s.bind(subscription{route: r.Name, channel: c.Name})
+				}
+			}
+		}
+		s.write(respPush("psubscribe", pattern, s.count()))
+	}
+}
+
+func (s *respSession) handleUnsubscribe(args []string) {
+	if len(args) == 0 {
+		s.mutex.Lock()
+		for sub := range s.channels {
+			args = append(args, sub.route+globals.RESPDelimiter+sub.channel)
+		}
+		s.mutex.Unlock()
+	}
+	if len(args) == 0 {
+		s.write(respPush("unsubscribe", "", s.count()))
+		return
+	}
+
+	for _, name := range args {
+		if sub, ok := s.splitChannel(name); ok {
+			s.mutex.Lock()
+			delete(s.channels, sub)
+			s.mutex.Unlock()
+			s.unbind(sub)
+		}
+		s.write(respPush("unsubscribe", name, s.count()))
+	}
+}
+
+func (s *respSession) handlePUnsubscribe(args []string) {
+	if len(args) == 0 {
+		s.mutex.Lock()
+		for pattern := range s.patterns {
+			args = append(args, pattern)
+		}
+		s.mutex.Unlock()
+	}
+	if len(args) == 0 {
+		s.write(respPush("punsubscribe", "", s.count()))
+		return
+	}
+
+	for _, pattern := range args {
+		s.mutex.Lock()
+		delete(s.patterns, pattern)
+		s.mutex.Unlock()
+
+		for _, sub := range s.subscriptions() {
+			if respMatch(pattern, sub.route+globals.RESPDelimiter+sub.channel) {
+				s.unbind(sub)
+			}
+		}
+		s.write(respPush("punsubscribe", pattern, s.count()))
+	}
+}
+
+func (s *respSession) handleAuth(args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		s.writeError("wrong number of arguments for 'auth' command")
+		return
+	}
+	if !s.authenticate(args[len(args)-1]) {
+		s.write([]byte(
+			"-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+		))
+		return
+	}
+	s.write([]byte("+OK\r\n"))
+}
+
+func (s *respSession) handlePing(args []string) {
+	msg := ""
+	if len(args) > 0 {
+		msg = args[0]
+	}
+	if s.subscribed() {
+		s.write(respArray(respBulk("pong"), respBulk(msg)))
+		return
+	}
+	if msg != "" {
+		s.write(respBulk(msg))
+		return
+	}
+	s.write([]byte("+PONG\r\n"))
+}
+
+// -------Subscriptions---------------------------------------------------------
+
+func (s *respSession) splitChannel(name string) (subscription, bool) {
+	route, channel, ok := strings.Cut(name, globals.RESPDelimiter)
+	if !ok || route == "" || channel == "" {
+		return subscription{}, false
+	}
+	return subscription{route: route, channel: channel}, true
+}
+
+// bind subscribes the connection to the channel with the broker, returning
+// the broker's nack, or globals.AckUnknown on success.
+func (s *respSession) bind(sub subscription) uint8 {
+	_, ack, err := s.subscribe(sub.route, sub.channel, globals.CmdAdd)
+	if err != nil && ack == globals.AckUnknown {
+		return globals.AckChannelNotFound
+	}
+	return ack
+}
+
+// unbind unsubscribes the connection from the channel with the broker unless
+// a channel or pattern subscription still needs it.
+func (s *respSession) unbind(sub subscription) {
+	if s.wants(sub) {
+		return
+	}
+	_, _, _ = s.subscribe(sub.route, sub.channel, globals.CmdRemove)
+}
+
+// wants reports whether any channel or pattern subscription covers sub.
+func (s *respSession) wants(sub subscription) bool {
+	direct, patterns := s.covering(sub)
+	return direct || len(patterns) > 0
+}
+
+// covering reports whether sub has a channel subscription, and returns the
+// patterns that match it.
+func (s *respSession) covering(sub subscription) (bool, []string) {
+	name := sub.route + globals.RESPDelimiter + sub.channel
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var patterns []string
+	for pattern := range s.patterns {
+		if respMatch(pattern, name) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return s.channels[sub], patterns
+}
+
+// ChannelAdded binds the connection to a new channel its patterns match.
+func (s *respSession) ChannelAdded(route, channel string) {
+	sub := subscription{route: route, channel: channel}
+	if _, patterns := s.covering(sub); len(patterns) > 0 {
+		s.bind(sub)
+	}
+}
+
+// count is the number of channel and pattern subscriptions, as Redis reports
+// it in subscribe replies.
+func (s *respSession) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+func (s *respSession) subscribed() bool {
+	return s.count() > 0
+}
+
+// Push sends a delivery as a "message" for a channel subscription and a
+// "pmessage" for each pattern that covers the channel.
+func (s *respSession) Push(route, channel string, obj *rhizome.Object) error {
+	sub := subscription{route: route, channel: channel}
+	name := route + globals.RESPDelimiter + channel
+	direct, patterns := s.covering(sub)
+
+	var out []byte
+	if direct {
+		out = append(out, respArray(
+			respBulk("message"), respBulk(name), respBulk(string(obj.Payload)),
+		)...)
+	}
+	for _, pattern := range patterns {
+		out = append(out, respArray(
+			respBulk("pmessage"), respBulk(pattern), respBulk(name),
+			respBulk(string(obj.Payload)),
+		)...)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return s.writeErr(out)
+}
+
+// respMatch reports whether name matches the glob pattern as Redis matches
+// PSUBSCRIBE patterns: * is any run of bytes, ? is any one byte, [...] is one
+// of a set of bytes and ranges, negated by a leading ^, and \ escapes the byte
+// after it.
+func respMatch(pattern, name string) bool {
+	p, n := 0, 0
+	star, mark := -1, 0 // The last *, and the byte of name it resumes from.
+	for n < len(name) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, mark = p, n
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if ok, width := respMatchOne(pattern[p:], name[n]); ok {
+				p += width
+				n++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last * take one more byte and try again from there.
+		mark++
+		p, n = star+1, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// respMatchOne matches c against the first token of the pattern, which is not
+// a *, returning whether it matched and the token's length. A [ without a
+// closing ] runs to the end of the pattern, as in Redis.
+func respMatchOne(pattern string, c byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+	case '\\':
+		if len(pattern) > 1 {
+			return pattern[1] == c, 2
+		}
+	case '[':
+		i := 1
+		negated := i < len(pattern) && pattern[i] == '^'
+		if negated {
+			i++
+		}
+		matched := false
+		for i < len(pattern) && pattern[i] != ']' {
+			switch {
+			case pattern[i] == '\\' && i+1 < len(pattern):
+				matched = matched || pattern[i+1] == c
+				i += 2
+			case i+2 < len(pattern) && pattern[i+1] == '-':
+				lo, hi := pattern[i], pattern[i+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				matched = matched || (lo <= c && c <= hi)
+				i += 3
+			default:
+				matched = matched || pattern[i] == c
+				i++
+			}
+		}
+		if i < len(pattern) {
+			i++ // The closing ].
+		}
+		return matched != negated, i
+	}
+	return pattern[0] == c, 1
+}
+
+// -------Protocol--------------------------------------------------------------
+
+// readCommand reads a RESP array of bulk strings, or an inline command.
+func (s *respSession) readCommand() ([]string, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > respMaxArgs {
+		return nil, errors.New("invalid multibulk length")
+	}
+
+	args := make([]string, 0, n)
+	for range n {
+		hdr, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(hdr) == 0 || hdr[0] != '$' {
+			return nil, errors.New("expected bulk string")
+		}
+		size, err := strconv.Atoi(hdr[1:])
+		if err != nil || size < 0 || size > globals.BytesInMegabyte {
+			return nil, errors.New("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(s.reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of at most respMaxLine bytes, the reader's buffer.
+func (s *respSession) readLine() (string, error) {
+	line, err := s.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (s *respSession) writeError(msg string) {
+	s.write([]byte("-ERR " + msg + "\r\n"))
+}
+
+// write sends a reply, logging rather than returning failures.
+func (s *respSession) write(b []byte) {
+	if err := s.writeErr(b); err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("RESP write to %s: %s", s.conn.RemoteAddr(), err),
+		)
+	}
+}
+
+func (s *respSession) writeErr(b []byte) error {
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(respWriteTimeout))
+	_, err := s.conn.Write(b)
+	return err
+}
+
+func respBulk(s string) []byte {
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
+}
+
+func respInteger(n int) []byte {
+	return []byte(fmt.Sprintf(":%d\r\n", n))
+}
+
+func respArray(items ...[]byte) []byte {
+	out := []byte(fmt.Sprintf("*%d\r\n", len(items)))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+// respPush is a (un)subscribe reply: kind, channel or pattern, and count.
+func respPush(kind, name string, count int) []byte {
+	return respArray(respBulk(kind), respBulk(name), respInteger(count))
+}
@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"mycelia/globals"
+)
+
+func TestRESPMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"orders:*", "orders:audit", true},
+		{"orders:*", "returns:audit", false},
+		{"*", "", true},
+		{"*:audit", "orders:audit", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{"h[ab", "ha", true},
+		{"h[ab", "hab", false},
+		{`h\`, `h\`, true},
+		{"[!a]", "b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if got := respMatch(tt.pattern, tt.name); got != tt.want {
+				t.Errorf("respMatch(%q, %q) = %t, want %t",
+					tt.pattern, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// Pattern subscriptions reach channels created after the PSUBSCRIBE.
+func TestRESPPSubscribeNewChannel(t *testing.T) {
+	b, _ := newTopology(t, "orders", "audit")
+	server, client := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+
+	s := &respSession{
+		conn:     server,
+		reader:   bufio.NewReader(server),
+		channels: map[subscription]bool{},
+		patterns: map[string]bool{},
+	}
+	s.binding = newBinding(b, "resp", "test", s)
+	t.Cleanup(s.close)
+
+	s.handlePSubscribe([]string{"orders" + globals.RESPDelimiter + "[ab]*"})
+
+	strategy := strconv.Itoa(int(globals.SelStratPubSub))
+	for _, channel := range []string{"billing", "fraud"} {
+		_ = b.HandleObject(newObject(
+			globals.ObjChannel, globals.CmdAdd, globals.AckPlcyNoreply,
+			"orders", channel, strategy, "", nil, nil,
+		))
+	}
+
+	subscribed := func(channel string) bool {
+		ch, _ := b.FindChannel("orders", channel)
+		return slices.Contains(ch.Subscribers, s.address)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !subscribed("billing") {
+		if time.Now().After(deadline) {
+			t.Fatal("pattern subscription did not reach the new channel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !subscribed("audit") {
+		t.Error("pattern subscription did not reach the existing channel")
+	}
+	if subscribed("fraud") {
+		t.Error("pattern subscription reached a channel it does not match")
+	}
+}
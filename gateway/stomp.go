@@ -0,0 +1,575 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// The STOMP 1.2 gateway.
+//
+// Destinations map onto Mycelia as "/route/channel", the leading slash being
+// optional. SEND to "/route" becomes a delivery on the route, and to
+// "/route/channel" a delivery to that channel alone. A SEND carrying a receipt
+// header uses AckPlcyOnsent and the RECEIPT is sent once the broker acks the
+// delivery as sent; any other ack is an ERROR. SUBSCRIBE binds the connection
+// as a subscriber of the channel until it disconnects.
+//
+// With ack:client or ack:client-individual subscriptions each MESSAGE waits on
+// the client's ACK in the background, so a slow client never holds up the
+// channel's other subscribers. A NACK, or no ACK within the ack timeout,
+// redelivers the MESSAGE with a new ack id and a redelivered:true header, up to
+// stompMaxDeliveries times before it is dropped. A connection holds at most
+// stompMaxPending unacknowledged MESSAGEs, deliveries beyond that failing.
+// Transactions are not supported and heart-beats are not sent.
+//
+// The CONNECT passcode header is the security token the connection
+// authenticates with; login is ignored.
+// -----------------------------------------------------------------------------
+
+const (
+	stompAckAuto             = "auto"
+	stompAckClient           = "client"
+	stompAckClientIndividual = "client-individual"
+)
+
+const (
+	stompWriteTimeout   = 10 * time.Second
+	stompConnectTimeout = 10 * time.Second
+	stompAckTimeout     = 30 * time.Second
+	stompMaxHeaders     = 128
+	stompMaxDeliveries  = 3
+	stompMaxPending     = 1024
+)
+
+type stompFrame struct {
+	command string
+	headers map[string]string
+	body    []byte
+}
+
+type stompSubscription struct {
+	id      string
+	sub     subscription
+	ackMode string
+}
+
+// stompPending is a MESSAGE waiting on the client's ACK or NACK.
+type stompPending struct {
+	subID    string
+	seq      uint64
+	frame    stompFrame
+	attempts int
+	timer    *time.Timer // Redelivers the MESSAGE if it is not ACKed in time.
+}
+
+type stompSession struct {
+	*binding
+	conn   net.Conn
+	reader *bufio.Reader
+	wmutex sync.Mutex
+
+	smutex  sync.Mutex
+	byID    map[string]*stompSubscription
+	byDest  map[subscription]*stompSubscription
+	pending map[string]*stompPending // by ack id
+	seq     uint64
+}
+
+func startSTOMP(b *routing.Broker) {
+	serveTCP("STOMP", globals.STOMPPort, func(c net.Conn) {
+		s := &stompSession{
+			conn:    c,
+			reader:  bufio.NewReader(c),
+			byID:    map[string]*stompSubscription{},
+			byDest:  map[subscription]*stompSubscription{},
+			pending: map[string]*stompPending{},
+		}
+		s.binding = newBinding(b, "stomp", c.RemoteAddr().String(), s)
+		defer s.close()
+
+		if err := s.serve(); err != nil && !disconnected(err) {
+			logging.LogSystemWarning(
+				fmt.Sprintf("STOMP client %s: %s", c.RemoteAddr(), err),
+			)
+		}
+	})
+}
+
+func (s *stompSession) serve() error {
+	_ = s.conn.SetReadDeadline(time.Now().Add(stompConnectTimeout))
+	f, err := s.readFrame()
+	if err != nil {
+		return err
+	}
+	if f.command != "CONNECT" && f.command != "STOMP" {
+		s.sendError("expected CONNECT", "", nil)
+		return errors.New("first frame was not CONNECT")
+	}
+	if !strings.Contains(","+f.headers["accept-version"]+",", ",1.2,") {
+		s.sendError("only STOMP 1.2 is supported", "", nil)
+		return errors.New("unsupported STOMP version")
+	}
+	if passcode := f.headers["passcode"]; passcode != "" {
+		if !s.authenticate(passcode) {
+			s.sendError("authentication failed", "", nil)
+			return errors.New("authentication failed")
+		}
+	} else if globals.RequireAuth {
+		s.sendError("authentication required", "", nil)
+		return errors.New("authentication required")
+	}
+
+	s.send(stompFrame{command: "CONNECTED", headers: map[string]string{
+		"version":    "1.2",
+		"heart-beat": "0,0",
+		"server":     "mycelia",
+	}})
+	_ = s.conn.SetReadDeadline(time.Time{})
+
+	for {
+		f, err := s.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch f.command {
+		case "SEND":
+			err = s.handleSend(f)
+		case "SUBSCRIBE":
+			err = s.handleSubscribe(f)
+		case "UNSUBSCRIBE":
+			err = s.handleUnsubscribe(f)
+		case "ACK", "NACK":
+			err = s.handleAck(f, f.command == "ACK")
+		case "DISCONNECT":
+			s.receipt(f)
+			return nil
+		default:
+			err = fmt.Errorf("unsupported frame %s", f.command)
+		}
+		if err != nil {
+			s.sendError(err.Error(), f.headers["receipt"], nil)
+			return err
+		}
+	}
+}
+
+// -------Frames----------------------------------------------------------------
+
+func (s *stompSession) handleSend(f stompFrame) error {
+	dest := f.headers["destination"]
+	route, channel, _ := strings.Cut(strings.TrimPrefix(dest, "/"), "/")
+	if route == "" {
+		return errors.New("SEND requires a destination")
+	}
+
+	receipt, wantsReceipt := f.headers["receipt"]
+	if !wantsReceipt {
+		s.publish(route, channel, dest, f.body, globals.AckPlcyNoreply)
+		return nil
+	}
+
+	uid, acks := s.publish(route, channel, dest, f.body, globals.AckPlcyOnsent)
+	go func() {
+		ack := <-acks
+		if ack == globals.AckSent {
+			s.send(stompFrame{command: "RECEIPT", headers: map[string]string{
+				"receipt-id": receipt,
+			}})
+			return
+		}
+		msg := fmt.Sprintf("delivery %s to %s failed: %s", uid, dest, ackName[ack])
+		s.sendError(msg, receipt, nil)
+		_ = s.conn.Close()
+	}()
+	return nil
+}
+
+func (s *stompSession) handleSubscribe(f stompFrame) error {
+	id := f.headers["id"]
+	if id == "" {
+		return errors.New("SUBSCRIBE requires an id")
+	}
+	dest := f.headers["destination"]
+	sub, ok := splitDestination(dest)
+	if !ok {
+		return fmt.Errorf("destination %q must be /route/channel", dest)
+	}
+
+	mode := f.headers["ack"]
+	switch mode {
+	case "":
+		mode = stompAckAuto
+	case stompAckAuto, stompAckClient, stompAckClientIndividual:
+	default:
+		return fmt.Errorf("unknown ack mode %q", mode)
+	}
+
+	s.smutex.Lock()
+	_, idTaken := s.byID[id]
+	_, destTaken := s.byDest[sub]
+	s.smutex.Unlock()
+	if idTaken {
+		return fmt.Errorf("subscription id %q is already in use", id)
+	}
+	if destTaken {
+		return fmt.Errorf("already subscribed to %s", dest)
+	}
+
+	_, ack, err := s.subscribe(sub.route, sub.channel, globals.CmdAdd)
+	if err != nil {
+		return err
+	}
+	if ack != globals.AckUnknown {
+		return fmt.Errorf("could not subscribe to %s: %s", dest, ackName[ack])
+	}
+
+	ss := &stompSubscription{id: id, sub: sub, ackMode: mode}
+	s.smutex.Lock()
+	s.byID[id] = ss
+	s.byDest[sub] = ss
+	s.smutex.Unlock()
+
+	s.receipt(f)
+	return nil
+}
+
+func (s *stompSession) handleUnsubscribe(f stompFrame) error {
+	id := f.headers["id"]
+
+	s.smutex.Lock()
+	ss, ok := s.byID[id]
+	if ok {
+		delete(s.byID, id)
+		delete(s.byDest, ss.sub)
+	}
+	s.smutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no subscription with id %q", id)
+	}
+
+	_, _, _ = s.subscribe(ss.sub.route, ss.sub.channel, globals.CmdRemove)
+	s.failPending(id)
+	s.receipt(f)
+	return nil
+}
+
+// handleAck resolves the MESSAGE the ack id refers to. For ack:client
+// subscriptions this also resolves every earlier MESSAGE of the subscription.
+func (s *stompSession) handleAck(f stompFrame, ok bool) error {
+	id := f.headers["id"]
+
+	s.smutex.Lock()
+	target, exists := s.pending[id]
+	if !exists {
+		s.smutex.Unlock()
+		return fmt.Errorf("no pending message with ack id %q", id)
+	}
+
+	resolve := []*stompPending{target}
+	delete(s.pending, id)
+	if ss := s.byID[target.subID]; ss != nil && ss.ackMode == stompAckClient {
+		for ackID, p := range s.pending {
+			if p.subID == target.subID && p.seq < target.seq {
+				resolve = append(resolve, p)
+				delete(s.pending, ackID)
+			}
+		}
+	}
+	s.smutex.Unlock()
+
+	for _, p := range resolve {
+		p.timer.Stop()
+		if !ok {
+			s.redeliver(p, "NACKed")
+		}
+	}
+	s.receipt(f)
+	return nil
+}
+
+// Push sends a delivery as a MESSAGE. For client ack modes the client's ACK is
+// waited on in the background, see track.
+func (s *stompSession) Push(route, channel string, obj *rhizome.Object) error {
+	sub := subscription{route: route, channel: channel}
+
+	s.smutex.Lock()
+	ss := s.byDest[sub]
+	s.smutex.Unlock()
+	if ss == nil {
+		return errors.New("no STOMP subscription for " + route + "/" + channel)
+	}
+
+	f := stompFrame{
+		command: "MESSAGE",
+		headers: map[string]string{
+			"subscription": ss.id,
+			"message-id":   obj.UID,
+			"destination":  "/" + route + "/" + channel,
+		},
+		body: obj.Payload,
+	}
+
+	if ss.ackMode == stompAckAuto {
+		return s.write(f)
+	}
+
+	s.smutex.Lock()
+	full := len(s.pending) >= stompMaxPending
+	s.smutex.Unlock()
+	if full {
+		return errors.New("client has too many unacknowledged messages")
+	}
+	return s.track(&stompPending{subID: ss.id, frame: f})
+}
+
+// track sends the pending MESSAGE under a new ack id, and starts the timer that
+// redelivers it if the client does not ACK it in time.
+func (s *stompSession) track(p *stompPending) error {
+	s.smutex.Lock()
+	if s.byID[p.subID] == nil {
+		s.smutex.Unlock()
+		return errors.New("subscription " + p.subID + " is gone")
+	}
+	s.seq++
+	p.seq = s.seq
+	p.attempts++
+	ackID := strconv.FormatUint(p.seq, 10)
+	s.pending[ackID] = p
+	p.timer = time.AfterFunc(stompAckTimeout, func() { s.expire(ackID) })
+	s.smutex.Unlock()
+
+	f := p.frame
+	f.headers = maps.Clone(p.frame.headers)
+	f.headers["ack"] = ackID
+	if err := s.write(f); err != nil {
+		p.timer.Stop()
+		s.smutex.Lock()
+		delete(s.pending, ackID)
+		s.smutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// expire redelivers the MESSAGE with the ack id if it is still pending.
+func (s *stompSession) expire(ackID string) {
+	s.smutex.Lock()
+	p, ok := s.pending[ackID]
+	delete(s.pending, ackID)
+	s.smutex.Unlock()
+
+	if ok {
+		s.redeliver(p, "did not ACK")
+	}
+}
+
+// redeliver sends a MESSAGE the client did not take again, or drops it once it
+// was delivered stompMaxDeliveries times.
+func (s *stompSession) redeliver(p *stompPending, reason string) {
+	uid := p.frame.headers["message-id"]
+	if p.attempts >= stompMaxDeliveries {
+		logging.LogObjectWarning(fmt.Sprintf(
+			"STOMP client %s %s the message %d times, dropping it",
+			s.conn.RemoteAddr(), reason, p.attempts,
+		), uid)
+		return
+	}
+
+	p.frame.headers["redelivered"] = "true"
+	if err := s.track(p); err != nil {
+		logging.LogObjectWarning(fmt.Sprintf(
+			"Could not redeliver to STOMP client %s: %s", s.conn.RemoteAddr(), err,
+		), uid)
+	}
+}
+
+// failPending drops every pending message of a subscription, or of all
+// subscriptions if subID is empty.
+func (s *stompSession) failPending(subID string) {
+	s.smutex.Lock()
+	defer s.smutex.Unlock()
+	for ackID, p := range s.pending {
+		if subID == "" || p.subID == subID {
+			p.timer.Stop()
+			delete(s.pending, ackID)
+		}
+	}
+}
+
+func (s *stompSession) receipt(f stompFrame) {
+	if r, ok := f.headers["receipt"]; ok {
+		s.send(stompFrame{command: "RECEIPT", headers: map[string]string{
+			"receipt-id": r,
+		}})
+	}
+}
+
+func (s *stompSession) sendError(msg, receipt string, body []byte) {
+	headers := map[string]string{"message": msg}
+	if receipt != "" {
+		headers["receipt-id"] = receipt
+	}
+	s.send(stompFrame{command: "ERROR", headers: headers, body: body})
+}
+
+func (s *stompSession) close() {
+	s.binding.close()
+	s.failPending("")
+}
+
+// splitDestination maps "/route/channel" onto a route + channel.
+func splitDestination(dest string) (subscription, bool) {
+	route, channel, ok := strings.Cut(strings.TrimPrefix(dest, "/"), "/")
+	if !ok || route == "" || channel == "" || strings.Contains(channel, "/") {
+		return subscription{}, false
+	}
+	return subscription{route: route, channel: channel}, true
+}
+
+// -------Protocol--------------------------------------------------------------
+
+// readFrame reads the next frame, skipping heart-beat EOLs.
+func (s *stompSession) readFrame() (stompFrame, error) {
+	var f stompFrame
+
+	command := ""
+	for command == "" {
+		line, err := s.readLine()
+		if err != nil {
+			return f, err
+		}
+		command = line
+	}
+	f.command = command
+	f.headers = map[string]string{}
+
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return f, err
+		}
+		if line == "" {
+			break
+		}
+		if len(f.headers) >= stompMaxHeaders {
+			return f, errors.New("too many headers")
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return f, fmt.Errorf("malformed header %q", line)
+		}
+		if command != "CONNECT" && command != "CONNECTED" {
+			k, v = stompUnescape(k), stompUnescape(v)
+		}
+		// Repeated headers: only the first occurrence counts.
+		if _, exists := f.headers[k]; !exists {
+			f.headers[k] = v
+		}
+	}
+
+	if cl, ok := f.headers["content-length"]; ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > globals.BytesInMegabyte {
+			return f, fmt.Errorf("invalid content-length %q", cl)
+		}
+		body := make([]byte, n+1)
+		if _, err := io.ReadFull(s.reader, body); err != nil {
+			return f, err
+		}
+		if body[n] != 0 {
+			return f, errors.New("frame body not NUL terminated")
+		}
+		f.body = body[:n]
+		return f, nil
+	}
+
+	var body bytes.Buffer
+	for {
+		b, err := s.reader.ReadByte()
+		if err != nil {
+			return f, err
+		}
+		if b == 0 {
+			break
+		}
+		if body.Len() >= globals.BytesInMegabyte {
+			return f, errors.New("frame body too large")
+		}
+		body.WriteByte(b)
+	}
+	f.body = body.Bytes()
+	return f, nil
+}
+
+func (s *stompSession) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) > 64*globals.BytesInKilobyte {
+		return "", errors.New("line too long")
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// send writes the frame, logging rather than returning failures.
+func (s *stompSession) send(f stompFrame) {
+	if err := s.write(f); err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("STOMP write to %s: %s", s.conn.RemoteAddr(), err),
+		)
+	}
+}
+
+func (s *stompSession) write(f stompFrame) error {
+	var buf bytes.Buffer
+	buf.WriteString(f.command)
+	buf.WriteByte('\n')
+	for k, v := range f.headers {
+		if f.command != "CONNECTED" {
+			k, v = stompEscape(k), stompEscape(v)
+		}
+		buf.WriteString(k + ":" + v + "\n")
+	}
+	if len(f.body) > 0 {
+		buf.WriteString("content-length:" + strconv.Itoa(len(f.body)) + "\n")
+	}
+	buf.WriteByte('\n')
+	buf.Write(f.body)
+	buf.WriteByte(0)
+
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(stompWriteTimeout))
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+var (
+	stompEscaper = strings.NewReplacer(
+		`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`,
+	)
+	stompUnescaper = strings.NewReplacer(
+		`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":",
+	)
+)
+
+func stompEscape(s string) string   { return stompEscaper.Replace(s) }
+func stompUnescape(s string) string { return stompUnescaper.Replace(s) }
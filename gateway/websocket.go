@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"mycelia/globals"
+	"mycelia/logging"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// The WebSocket gateway, served on the HTTP gateway at GET /ws.
+//
+// Every message is a JSON text frame. Clients send:
+//
+//	{"op": "publish", "id": "1", "route": "r", "key": "k", "ack": "onsent", "payload": "..."}
+//	{"op": "subscribe", "id": "2", "route": "r", "channel": "c"}
+//	{"op": "unsubscribe", "id": "3", "route": "r", "channel": "c"}
+//
+// and receive:
+//
+//	{"op": "ack", "id": "1", "uid": "...", "ack": 1, "result": "sent"}
+//	{"op": "delivery", "route": "r", "channel": "c", "uid": "...", "payload": "..."}
+//	{"op": "error", "id": "1", "error": "..."}
+//
+// Deliveries whose payload is not valid UTF-8 are sent in "payload-b64"
+// instead. Subscriptions last as long as the socket does.
+//
+// The socket authenticates with an "Authorization: Bearer <token>" header on
+// the upgrade request, or a token= query parameter for browsers.
+// -----------------------------------------------------------------------------
+
+type wsRequest struct {
+	Op      string `json:"op"`
+	ID      string `json:"id"`
+	Route   string `json:"route"`
+	Channel string `json:"channel"`
+	Key     string `json:"key"`
+	Ack     string `json:"ack"`
+	Payload string `json:"payload"`
+}
+
+type wsEvent struct {
+	Op         string `json:"op"`
+	ID         string `json:"id,omitempty"`
+	UID        string `json:"uid,omitempty"`
+	Ack        *uint8 `json:"ack,omitempty"`
+	Result     string `json:"result,omitempty"`
+	Route      string `json:"route,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+	Payload    string `json:"payload,omitempty"`
+	PayloadB64 []byte `json:"payload-b64,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// wsSession is a single WebSocket client. It is the conduit its own
+// subscriptions deliver through.
+type wsSession struct {
+	*binding
+	ws     *wsConn
+	remote string
+}
+
+func (g *httpGateway) websocket(w http.ResponseWriter, r *http.Request) {
+	s := &wsSession{remote: r.RemoteAddr}
+	s.binding = newBinding(g.broker, "ws", r.RemoteAddr, s)
+
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token != "" && !s.authenticate(token) {
+		s.binding.close()
+		httpError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		s.binding.close()
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.ws = ws
+
+	// Hijacked connections are not the HTTP server's to close on shutdown.
+	if !running.open(ws.conn) {
+		s.binding.close()
+		_ = ws.close()
+		return
+	}
+	defer running.done(ws.conn)
+
+	logging.LogSystemAction(fmt.Sprintf("WebSocket client connected: %s", s.remote))
+	s.serve()
+	logging.LogSystemAction(fmt.Sprintf("WebSocket client disconnected: %s", s.remote))
+}
+
+// serve reads requests until the socket closes, then ends the session's
+// subscriptions.
+func (s *wsSession) serve() {
+	defer s.close()
+
+	for {
+		op, msg, err := s.ws.readMessage()
+		if err != nil {
+			if !disconnected(err) {
+				logging.LogSystemWarning(
+					fmt.Sprintf("WebSocket read from %s: %s", s.remote, err),
+				)
+			}
+			return
+		}
+		if op != wsOpText {
+			s.send(wsEvent{Op: "error", Error: "expected a JSON text message"})
+			continue
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			s.send(wsEvent{Op: "error", Error: "invalid JSON: " + err.Error()})
+			continue
+		}
+		s.handle(req)
+	}
+}
+
+func (s *wsSession) handle(req wsRequest) {
+	switch req.Op {
+	case "publish":
+		s.publishReq(req)
+	case "subscribe":
+		s.subscribeReq(req, globals.CmdAdd)
+	case "unsubscribe":
+		s.subscribeReq(req, globals.CmdRemove)
+	default:
+		s.send(wsEvent{Op: "error", ID: req.ID, Error: "unknown op " + req.Op})
+	}
+}
+
+func (s *wsSession) publishReq(req wsRequest) {
+	ackPlcy := globals.AckPlcyOnsent
+	switch req.Ack {
+	case "", "onsent":
+	case "none":
+		ackPlcy = globals.AckPlcyNoreply
+	default:
+		s.send(wsEvent{Op: "error", ID: req.ID, Error: "ack must be onsent or none"})
+		return
+	}
+
+	uid, acks := s.publish(req.Route, "", req.Key, []byte(req.Payload), ackPlcy)
+	if acks == nil {
+		return
+	}
+	go func() {
+		ack := <-acks
+		s.sendAck(req.ID, uid, ack, ackName[ack])
+	}()
+}
+
+// subscribeReq adds or removes this socket as a subscriber of route + channel.
+func (s *wsSession) subscribeReq(req wsRequest, cmd uint8) {
+	uid, ack, err := s.subscribe(req.Route, req.Channel, cmd)
+	switch {
+	case err != nil:
+		s.send(wsEvent{Op: "error", ID: req.ID, Error: err.Error()})
+	case ack != globals.AckUnknown:
+		s.sendAck(req.ID, uid, ack, ackName[ack])
+	default:
+		s.sendAck(req.ID, uid, ack, "ok")
+	}
+}
+
+// Push sends a delivery from one of the session's subscriptions.
+func (s *wsSession) Push(route, channel string, obj *rhizome.Object) error {
+	ev := wsEvent{Op: "delivery", Route: route, Channel: channel, UID: obj.UID}
+	if utf8.Valid(obj.Payload) {
+		ev.Payload = string(obj.Payload)
+	} else {
+		ev.PayloadB64 = obj.Payload
+	}
+	return s.write(ev)
+}
+
+func (s *wsSession) sendAck(id, uid string, ack uint8, result string) {
+	s.send(wsEvent{Op: "ack", ID: id, UID: uid, Ack: &ack, Result: result})
+}
+
+// send writes the event, logging rather than returning failures.
+func (s *wsSession) send(ev wsEvent) {
+	if err := s.write(ev); err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("WebSocket write to %s: %s", s.remote, err),
+		)
+	}
+}
+
+func (s *wsSession) write(ev wsEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return s.ws.writeFrame(wsOpText, b)
+}
+
+// close ends the socket's subscriptions and closes it.
+func (s *wsSession) close() {
+	s.binding.close()
+	_ = s.ws.close()
+}
@@ -55,6 +55,9 @@ const (
 
 	ObjGlobals uint8 = 20
 
+	// ObjConfig objects carry whole Mycelia_Config.json documents.
+	ObjConfig uint8 = 30
+
 	ObjAction uint8 = 50
 )
 
@@ -65,8 +68,27 @@ const (
 	CmdAdd    uint8 = 2
 	CmdRemove uint8 = 3
 
+	// CmdSendChannel is sent on ObjDelivery to deliver to the channel in arg2
+	// alone, rather than through each of the route's channels in turn.
+	CmdSendChannel uint8 = 4
+
 	CmdUpdate uint8 = 20
 
+	// CmdAuthenticate is sent on ObjAction with a security token in the
+	// payload to authenticate the connection it arrives on.
+	CmdAuthenticate uint8 = 40
+
+	// CmdExport is sent on ObjConfig to write the broker's live topology and
+	// runtime parameters as a config file, to the path in arg1 relative to
+	// ExportDir.
+	CmdExport uint8 = 30
+
+	// CmdApply is sent on ObjConfig with a config document as the payload to
+	// change the broker to match it. Arg1 holds the comma separated apply
+	// options, "dry-run" and "prune", and arg2 the path to write the apply
+	// report to relative to ExportDir, if any.
+	CmdApply uint8 = 31
+
 	CmdSigterm uint8 = 50
 )
 
@@ -90,6 +112,20 @@ const (
 	//subscribers.
 	AckSent uint8 = 1
 
+	// AckAuthenticated means the connection's authentication succeeded.
+	AckAuthenticated uint8 = 2
+
+	// AckRebound means a globals update moved the listener to the new address
+	// or port.
+	AckRebound uint8 = 3
+
+	// AckExported means a config export was written.
+	AckExported uint8 = 4
+
+	// AckApplied means a config apply changed the broker to match the
+	// document, or found what it would change on a dry run.
+	AckApplied uint8 = 5
+
 	// AckTimeout isn't used by the broker, but its here for clarity.
 	// Client APIs do use this value when timing out while trying to connect to
 	// the broker.
@@ -100,6 +136,21 @@ const (
 	AckChannelNotFound      uint8 = 20
 	AckChannelAlreadyExists uint8 = 21
 	AckRouteNotFound        uint8 = 30
+
+	// AckUnauthorized means the connection is not authenticated, or its
+	// principal is not allowed to run the command. The object was dropped.
+	AckUnauthorized uint8 = 40
+
+	// AckRebindFailed means a globals update's new address or port could not
+	// be bound. The broker is still listening on the old one.
+	AckRebindFailed uint8 = 50
+
+	// AckExportFailed means a config export could not be written.
+	AckExportFailed uint8 = 51
+
+	// AckApplyFailed means a config document was invalid, or not every change
+	// it asked for could be made.
+	AckApplyFailed uint8 = 52
 )
 
 // -------Terminal--------------------------------------------------------------
@@ -49,14 +49,157 @@ var TransformTimeout = time.Duration(5) * time.Second
 // SecurityTokens is the list of accepted security tokens to update the broker
 // at runtime.
 // Clients need any one of these to have permission.
+// Tokens prefixed "sha256:" are stored as the hex SHA-256 of the token.
 var SecurityTokens []string
 
+// TokenKeys are the keys signed tokens are verified with. Several keys may be
+// active at once so keys can be rotated without invalidating issued tokens.
+var TokenKeys []TokenKey
+
+// TokenSigningKey is the ID of the key new tokens are signed with. Defaults to
+// the first of TokenKeys.
+var TokenSigningKey = ""
+
+// TokenDenylist is the IDs of revoked signed tokens.
+var TokenDenylist []string
+
+// TokenDenylistFile is a file of further revoked token IDs, one per line. It is
+// re-read when it changes.
+var TokenDenylistFile = ""
+
+// RequireAuth requires every connection to authenticate, with a security token
+// or a verified client certificate, before any command is accepted.
+// When false, anonymous connections may publish and change topology but not
+// update globals or shut the broker down.
+var RequireAuth = false
+
+// Roles are the access control roles principals can be assigned.
+var Roles []Role
+
+// Principals are the named clients that roles are assigned to. When empty,
+// access control is off and every authenticated connection may run every
+// command.
+var Principals []Principal
+
+// AuditLogFile is the append-only log mutating commands are recorded to.
+// Defaults to audit.jsonl in LogDirectory.
+var AuditLogFile = ""
+
+// FileSinkDir is the directory file: subscribers write under, their paths
+// being relative to it. Relative paths resolve against ExeDir. Empty, the
+// default, disables file subscribers, so clients cannot fill the disk unless
+// the operator opts in.
+var FileSinkDir = ""
+
+// ExportDir is the directory config exports and apply reports are written
+// under, their paths being relative to it. Relative paths resolve against
+// ExeDir. Empty, the default, disables writing them.
+var ExportDir = ""
+
+// StateFile is where the broker persists its live topology so a restart
+// restores routes added at runtime. Relative paths resolve against ExeDir.
+// Empty disables the state file.
+var StateFile = "Mycelia_State.json"
+
+// StateInterval is how often the state file is written if the topology
+// changed. 0 writes it on every change.
+var StateInterval time.Duration = 0
+
+// StateRestore is how the state file is restored on startup, one of the
+// StateRestore modes.
+var StateRestore = StateRestoreMerge
+
+// Listeners are the client listeners opened alongside the default listener on
+// Address and Port.
+var Listeners []Listener
+
+// AllowCIDRs are the networks clients may connect from, as CIDRs or bare IPs.
+// Empty allows every address not denied.
+var AllowCIDRs []string
+
+// DenyCIDRs are the networks clients may not connect from. Deny wins over
+// allow.
+var DenyCIDRs []string
+
+// MaxConnections caps concurrent client connections. 0 is unlimited.
+var MaxConnections = 4096
+
+// MaxConnectionsPerIP caps concurrent client connections from one address.
+// 0 is unlimited.
+var MaxConnectionsPerIP = 0
+
+// ConnectionRate is how many new connections per second one address may open,
+// on average. 0 is unlimited.
+var ConnectionRate = 0.0
+
+// ConnectionBurst is how many connections one address may open at once before
+// ConnectionRate applies. Defaults to the rate, rounded up, when 0.
+var ConnectionBurst = 0
+
 // DefaultNumPartitions is the number of partitions a channel is created with.
 var DefaultNumPartitions = 4
 
-// WorkerCount is the number of workers to allocate to the server listener.
+// WorkerCount is the number of workers handling objects read off client
+// connections. Each connection has its own reader, so this bounds how many
+// objects are handled at once, not how many clients are served.
 var WorkerCount = 4
 
+// IdleTimeout closes client connections that send nothing for this long.
+// 0 keeps idle connections open.
+var IdleTimeout time.Duration = 0
+
+// DrainTimeout is how long connections on a replaced listener are given to
+// finish before they are closed.
+var DrainTimeout = 30 * time.Second
+
+// ReadTimeout closes client connections that take longer than this to send
+// the rest of a frame once its header arrived. 0 disables the timeout.
+var ReadTimeout = 30 * time.Second
+
+// ShutdownTimeout is how long queued deliveries are given to reach their
+// subscribers on shutdown before the rest are written to the undelivered log.
+var ShutdownTimeout = 30 * time.Second
+
+// ConfigWatch is how often Mycelia_Config.json is checked for changes, which
+// are reloaded into the running broker. 0 disables watching, a SIGHUP still
+// reloads it.
+var ConfigWatch = 2 * time.Second
+
+// HTTPPort is the port the HTTP gateway listens on, on Address.
+// 0 disables the gateway.
+var HTTPPort = 0
+
+// MQTTPort is the port the MQTT gateway listens on, on Address.
+// 0 disables the gateway.
+var MQTTPort = 0
+
+// RESPPort is the port the Redis pub/sub gateway listens on, on Address.
+// 0 disables the gateway.
+var RESPPort = 0
+
+// RESPDelimiter separates the route from the channel in Redis channel names,
+// i.e. "route:channel".
+var RESPDelimiter = ":"
+
+// STOMPPort is the port the STOMP gateway listens on, on Address.
+// 0 disables the gateway.
+var STOMPPort = 0
+
+// TLSCertFile is the PEM certificate the client listener serves TLS with.
+// TLS is disabled unless both this and TLSKeyFile are set.
+var TLSCertFile = ""
+
+// TLSKeyFile is the PEM private key for TLSCertFile.
+var TLSKeyFile = ""
+
+// TLSMinVersion is the lowest TLS version the client listener accepts:
+// "1.0", "1.1", "1.2", or "1.3".
+var TLSMinVersion = "1.2"
+
+// TLSClientCAFile is a PEM bundle of CAs that client certificates are verified
+// against. When set, clients must present a certificate.
+var TLSClientCAFile = ""
+
 func UpdateVerbosityEnvironVar() {
 	_ = os.Setenv("VERBOSITY", strconv.Itoa(int(Verbosity)))
 }
@@ -70,15 +213,36 @@ func PrintDynamicValues() {
 	fmt.Printf("PrintTree: %v\n", PrintTree)
 	fmt.Printf("TransformTimeout: %s\n", TransformTimeout.String())
 	fmt.Printf("AutoConsolidate: %v\n", AutoConsolidate)
+	fmt.Printf("RequireAuth: %v\n", RequireAuth)
+	fmt.Printf("StateFile: %s (%s)\n", StateFile, StateRestore)
+	for _, l := range Listeners {
+		fmt.Printf("Listener %s: %s %s\n", l.Name, l.Protocol, l.Address)
+	}
+	fmt.Printf("AllowCIDRs: %v\n", AllowCIDRs)
+	fmt.Printf("DenyCIDRs: %v\n", DenyCIDRs)
+	fmt.Printf("MaxConnections: %v\n", MaxConnections)
+	fmt.Printf("MaxConnectionsPerIP: %v\n", MaxConnectionsPerIP)
+	fmt.Printf("IdleTimeout: %s\n", IdleTimeout.String())
+	fmt.Printf("ReadTimeout: %s\n", ReadTimeout.String())
+	fmt.Printf("DrainTimeout: %s\n", DrainTimeout.String())
+	fmt.Printf("ShutdownTimeout: %s\n", ShutdownTimeout.String())
+	fmt.Printf("ConfigWatch: %s\n", ConfigWatch.String())
+	fmt.Printf("ConnectionRate: %v/s (burst %v)\n", ConnectionRate, ConnectionBurst)
+	fmt.Printf("HTTPPort: %v\n", HTTPPort)
+	fmt.Printf("MQTTPort: %v\n", MQTTPort)
+	fmt.Printf("RESPPort: %v\n", RESPPort)
+	fmt.Printf("STOMPPort: %v\n", STOMPPort)
+	fmt.Printf("TLSCertFile: %s\n", TLSCertFile)
+	fmt.Printf("TLSMinVersion: %s\n", TLSMinVersion)
+	fmt.Printf("TLSClientCAFile: %s\n", TLSClientCAFile)
 
 	fmt.Println("Accepted security tokens:")
 	if len(SecurityTokens) > 0 {
-		for _, v := range SecurityTokens {
-			fmt.Printf("  %s\n", v)
-		}
+		fmt.Printf("  %d registered security tokens.\n", len(SecurityTokens))
 	} else {
 		fmt.Println("  No registered security tokens.")
 	}
+	fmt.Printf("Token signing keys: %d\n", len(TokenKeys))
 
 	fmt.Println("-------------------------------------------------")
 }
@@ -31,6 +31,123 @@ var StrategyValue = map[string]SelectionStrategy{
 	"pub-sub":     SelStratPubSub,
 }
 
+// DefaultStrategy is the strategy of channels added without one, whether by the
+// config file, a config apply, the HTTP gateway, or a CHANNEL.ADD command.
+const DefaultStrategy = SelStratRandom
+
 func (ss SelectionStrategy) String() string {
 	return StrategyName[ss]
 }
+
+// -------Access Control--------------------------------------------------------
+
+// Permission is an action a role may grant.
+type Permission string
+
+const (
+	PermPublish        Permission = "publish"
+	PermSubscribe      Permission = "subscribe"
+	PermManageTopology Permission = "manage-topology"
+	PermManageGlobals  Permission = "manage-globals"
+	PermShutdown       Permission = "shutdown"
+	PermReadAudit      Permission = "read-audit"
+	PermExportConfig   Permission = "export-config"
+)
+
+// Permissions is every permission a role may grant.
+var Permissions = []Permission{
+	PermPublish,
+	PermSubscribe,
+	PermManageTopology,
+	PermManageGlobals,
+	PermShutdown,
+	PermReadAudit,
+	PermExportConfig,
+}
+
+// RouteScoped reports whether the permission applies per route. Globals,
+// shutdown, audit, and config permissions are broker wide.
+func (p Permission) RouteScoped() bool {
+	return p == PermPublish || p == PermSubscribe || p == PermManageTopology
+}
+
+// Role grants permissions on the routes whose names match any of Routes, as
+// path.Match patterns. No routes means every route.
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+	Routes      []string     `json:"routes"`
+}
+
+// Principal is a named client, identified by any of its security tokens or
+// client certificate identities, and the roles it holds.
+type Principal struct {
+	Name       string   `json:"name"`
+	Tokens     []string `json:"tokens"`
+	Identities []string `json:"identities"`
+	Roles      []string `json:"roles"`
+}
+
+// -------Listeners-------------------------------------------------------------
+
+// Listener protocols.
+const (
+	ListenTCP  = "tcp"
+	ListenTLS  = "tls"
+	ListenUnix = "unix"
+)
+
+// Listener auth policies.
+const (
+	// ListenAuthDefault follows RequireAuth.
+	ListenAuthDefault = ""
+
+	// ListenAuthRequired requires connections to authenticate.
+	ListenAuthRequired = "required"
+
+	// ListenAuthOptional lets anonymous connections run unprivileged commands.
+	ListenAuthOptional = "optional"
+
+	// ListenAuthTrusted gives every connection full access, as a principal
+	// named after the listener. Meant for Unix sockets only local processes
+	// can reach.
+	ListenAuthTrusted = "trusted"
+)
+
+// DefaultListener is the name of the listener on Address and Port.
+const DefaultListener = "default"
+
+// Listener is a client listener the broker accepts connections on, alongside
+// the default listener on Address and Port.
+type Listener struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"` // ListenTCP, ListenTLS, or ListenUnix
+	Address  string `json:"address"`  // host:port, or the socket path for unix
+	Mode     string `json:"mode"`     // Octal socket file permissions for unix
+	Auth     string `json:"auth"`     // One of the ListenAuth policies
+}
+
+// -------Signed Tokens---------------------------------------------------------
+
+// TokenKey is an HMAC key signed tokens are verified with. The key material is
+// either Secret, raw or "base64:" prefixed, or the contents of File.
+type TokenKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	File   string `json:"file"`
+}
+
+// -------State File------------------------------------------------------------
+
+// How the state file's topology is restored against the config file's routes.
+const (
+	// StateRestoreMerge adds the state file's routes to the config file's.
+	StateRestoreMerge = "merge"
+
+	// StateRestoreReplace uses the state file's routes instead of the config
+	// file's, if there is a state file.
+	StateRestoreReplace = "replace"
+
+	// StateRestoreOff writes the state file but never restores it.
+	StateRestoreOff = "off"
+)
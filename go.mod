@@ -5,8 +5,10 @@ go 1.25.1
 require github.com/google/uuid v1.6.0
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/signal-weave/rhizome v0.0.0-20251026012104-ff1807d82b48
 	github.com/signal-weave/siglog v0.0.0-20251013030320-702a33f5c16e
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
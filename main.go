@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"os"
 
+	"mycelia/gateway"
 	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
 	"mycelia/server"
+	"mycelia/source"
 	"mycelia/system"
+	"mycelia/system/reload"
 	"mycelia/system/shutdown"
 	"mycelia/system/startup"
 )
@@ -18,9 +23,9 @@ func main() {
 
 	globals.PrintDynamicValues()
 
-	startServer() // Performs loop until globals.PerformShutdown is true.
+	s, err := startServer() // Performs loop until globals.PerformShutdown is true.
 
-	shutdown.Shutdown()
+	shutdown.Shutdown(s.Broker, err)
 }
 
 // Sets the build metadata fields denoting what kind of build that will be
@@ -35,8 +40,10 @@ func updateVersion() {
 }
 
 // Starts the server - checks for preloaded commands from the PreInit.json file
-// and loads them into the server's broker, then runs the server.
-func startServer() {
+// and loads them into the server's broker, replays anything the last run left
+// undelivered, starts any source connectors and gateways and the config file
+// reload, then runs the server.
+func startServer() (*server.Server, error) {
 	s := server.NewServer(globals.Address, globals.Port)
 	for _, cmd := range system.ObjectList {
 		err := s.Broker.HandleObject(cmd)
@@ -44,8 +51,36 @@ func startServer() {
 			fmt.Println(err.Error())
 		}
 	}
+	replayUndelivered(s.Broker)
+	source.Start(s.Broker, system.SourceList)
+	gateway.Start(s.Broker)
+	shutdown.HandleSignals(s)
+	reload.Watch(s.Broker)
 
-	if err := s.Run(); err != nil {
+	err := s.Run()
+	if err != nil {
 		fmt.Println(err.Error())
 	}
+	return s, err
+}
+
+// replayUndelivered requeues the deliveries the last shutdown wrote to the
+// undelivered log.
+func replayUndelivered(b *routing.Broker) {
+	path := routing.UndeliveredLogPath()
+	if r := system.LastShutdown; r != nil && r.UndeliveredLog != nil {
+		path = *r.UndeliveredLog
+	}
+
+	n, err := b.Replay(path)
+	if err != nil {
+		logging.LogSystemError(
+			fmt.Sprintf("Could not replay undelivered log %s: %s", path, err),
+		)
+	}
+	if n > 0 {
+		logging.LogSystemAction(
+			fmt.Sprintf("Replayed %d undelivered deliveries from %s", n, path),
+		)
+	}
 }
@@ -0,0 +1,857 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/system"
+
+	"github.com/google/uuid"
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the config apply, which changes the running broker to match a
+// Mycelia_Config.json document, such as one written by an export.
+//
+// The document is compared with the live broker and the differences are made
+// with the same commands a client would send. Nothing is changed unless the
+// whole document is valid and the sender may make every change it asks for.
+// A dry run only reports the changes.
+//
+// Routes, channels, transformers, and subscribers the document lists are
+// added, new channels without a strategy getting globals.DefaultStrategy.
+// Channel strategies the document gives and the order of channels and
+// transformers are updated to match it. Ones it does not list are left alone,
+// unless the apply prunes, in which case they are removed. Reloads of the
+// config file only prune what the previously loaded file listed. Subscribers
+// bound to a gateway connection are never pruned. A document without "routes"
+// leaves the topology alone.
+//
+// Parameters that can be updated at runtime are updated as by a globals
+// update, with the document's listeners replacing the live ones. The rest are
+// reported as needing a restart. Security tokens, sources, and access control
+// are never applied.
+// -----------------------------------------------------------------------------
+
+const (
+	applyDryRun = "dry-run"
+	applyPrune  = "prune"
+)
+
+const (
+	changeAdd    = "add"
+	changeRemove = "remove"
+	changeUpdate = "update"
+)
+
+// ErrInvalidConfig is returned for config documents that cannot be applied.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// ErrApplyIncomplete is returned when an apply could not make every change.
+var ErrApplyIncomplete = errors.New("apply incomplete")
+
+// ApplyOptions are how a config document is applied.
+type ApplyOptions struct {
+	DryRun bool // Only report the changes.
+	Prune  bool // Remove what the document does not list.
+
+	// Previous is the routes of the document applied before this one. When
+	// set, pruning only removes what it listed, so topology added by other
+	// means is kept.
+	Previous *[]system.RouteData
+}
+
+// ParseApplyOptions parses a comma separated list of apply options.
+func ParseApplyOptions(s string) (ApplyOptions, error) {
+	var opts ApplyOptions
+	for opt := range strings.SplitSeq(s, ",") {
+		switch strings.TrimSpace(opt) {
+		case "":
+		case applyDryRun:
+			opts.DryRun = true
+		case applyPrune:
+			opts.Prune = true
+		default:
+			return opts, fmt.Errorf("unknown apply option %q", opt)
+		}
+	}
+	return opts, nil
+}
+
+// prunable reports whether the apply removes the live route, channel, or
+// component address when the document does not list it.
+func (o ApplyOptions) prunable(route, channel, address string) bool {
+	if !o.Prune {
+		return false
+	}
+	if o.Previous == nil {
+		return true
+	}
+
+	for _, rd := range *o.Previous {
+		if rd.Name != route {
+			continue
+		}
+		if channel == "" {
+			return true
+		}
+		for _, cd := range rd.Channels {
+			if cd.Name != channel {
+				continue
+			}
+			return address == "" ||
+				slices.Contains(addresses(cd.Transformers), address) ||
+				slices.Contains(addresses(cd.Subscribers), address)
+		}
+	}
+	return false
+}
+
+func (o ApplyOptions) String() string {
+	var opts []string
+	if o.DryRun {
+		opts = append(opts, applyDryRun)
+	}
+	if o.Prune {
+		opts = append(opts, applyPrune)
+	}
+	return strings.Join(opts, ",")
+}
+
+// Change is one difference between a config document and the live broker.
+type Change struct {
+	Action  string `json:"action"`
+	Object  string `json:"object"`
+	Route   string `json:"route,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Address string `json:"address,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Before  any    `json:"before,omitempty"`
+	After   any    `json:"after,omitempty"`
+
+	perm globals.Permission
+	run  func()
+}
+
+func (c Change) String() string {
+	target := c.Route
+	if c.Channel != "" {
+		target += "." + c.Channel
+	}
+	for _, s := range []string{c.Address, c.Field} {
+		if s != "" {
+			target = strings.TrimSpace(target + " " + s)
+		}
+	}
+	return fmt.Sprintf("%s %s %s", c.Action, c.Object, target)
+}
+
+// ApplyReport lists the changes an apply made, or would make on a dry run.
+type ApplyReport struct {
+	DryRun          bool     `json:"dry-run"`
+	Prune           bool     `json:"prune"`
+	Changes         []Change `json:"changes"`
+	RestartRequired []Change `json:"restart-required,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+// applyDocument is the part of a config document an apply reads.
+type applyDocument struct {
+	Parameters map[string]json.RawMessage `json:"parameters"`
+	Routes     *[]system.RouteData        `json:"routes"`
+}
+
+// ApplyConfig applies the config document in the payload of a CmdApply object
+// and returns the report, authorizing and auditing the object as HandleObject
+// does. Objects without a responder apply as the broker itself.
+func (b *Broker) ApplyConfig(obj *rhizome.Object) (*ApplyReport, error) {
+	return b.applyConfig(obj, nil)
+}
+
+// ReloadConfig applies a config file's document as the broker itself, pruning
+// what the previously loaded routes listed and the document no longer does.
+func (b *Broker) ReloadConfig(
+	doc []byte, previous []system.RouteData,
+) (*ApplyReport, error) {
+	obj := rhizome.NewObject(
+		globals.ObjConfig, globals.CmdApply, globals.AckPlcyNoreply,
+		uuid.New().String(),
+		applyPrune, "", "", "",
+		doc,
+	)
+	return b.applyConfig(obj, &previous)
+}
+
+func (b *Broker) applyConfig(
+	obj *rhizome.Object, previous *[]system.RouteData,
+) (*ApplyReport, error) {
+	b.gate.RLock()
+	defer b.gate.RUnlock()
+	if b.closed {
+		return nil, ErrShuttingDown
+	}
+
+	if !b.authorize(obj) {
+		if auditable(obj) {
+			b.auditRefused(obj)
+		}
+		return nil, ErrUnauthorized
+	}
+	if auditable(obj) {
+		defer b.auditCommand(obj)()
+	}
+	return b.apply(obj, previous)
+}
+
+// apply runs a CmdApply object, leaving the ack it should be answered with in
+// its response. previous is set as the options' Previous.
+func (b *Broker) apply(
+	obj *rhizome.Object, previous *[]system.RouteData,
+) (*ApplyReport, error) {
+	report := &ApplyReport{Changes: []Change{}}
+	fail := func(ack uint8, err error, msgs ...string) (*ApplyReport, error) {
+		report.Errors = append(report.Errors, msgs...)
+		obj.Response.Ack = ack
+		logging.LogObjectWarning(fmt.Sprintf("Config apply failed: %s: %s",
+			err, strings.Join(report.Errors, "; "),
+		), obj.UID)
+		return report, err
+	}
+
+	opts, err := ParseApplyOptions(obj.Arg1)
+	if err != nil {
+		return fail(globals.AckApplyFailed, ErrInvalidConfig, err.Error())
+	}
+	report.DryRun, report.Prune = opts.DryRun, opts.Prune
+	opts.Previous = previous
+
+	var doc applyDocument
+	if err := json.Unmarshal(obj.Payload, &doc); err != nil {
+		return fail(globals.AckApplyFailed, ErrInvalidConfig, err.Error())
+	}
+	params, err := diffParameters(doc.Parameters)
+	var errs []string
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if doc.Routes != nil {
+		for _, e := range ValidateRoutes(*doc.Routes) {
+			errs = append(errs, e.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fail(globals.AckApplyFailed, ErrInvalidConfig, errs...)
+	}
+
+	report.Changes = append(report.Changes, params.updates...)
+	report.RestartRequired = params.restart
+	if doc.Routes != nil {
+		report.Changes = append(
+			report.Changes, b.diffRoutes(*doc.Routes, opts)...,
+		)
+	}
+
+	p := b.principalOf(obj)
+	var refused []string
+	for _, c := range report.Changes {
+		if p == nil || !p.can(c.perm, c.Route) {
+			refused = append(refused, "unauthorized to "+c.String())
+		}
+	}
+	if len(refused) > 0 {
+		return fail(globals.AckUnauthorized, ErrUnauthorized, refused...)
+	}
+
+	if opts.DryRun || len(report.Changes) == 0 {
+		obj.Response.Ack = globals.AckApplied
+		return report, nil
+	}
+
+	// Parameters first, as they change how the topology behaves.
+	if len(params.updates) > 0 {
+		unpackGlobals(params.runtime, "config apply")
+		globals.PrintDynamicValues()
+		if _, err := b.syncListeners(); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	for _, c := range report.Changes {
+		if c.run != nil {
+			c.run()
+		}
+	}
+
+	// Anything still different is a change that failed, the handlers having
+	// logged why.
+	if after, err := diffParameters(doc.Parameters); err == nil {
+		for _, c := range after.updates {
+			report.Errors = append(report.Errors, "could not "+c.String())
+		}
+	}
+	if doc.Routes != nil {
+		for _, c := range b.diffRoutes(*doc.Routes, opts) {
+			report.Errors = append(report.Errors, "could not "+c.String())
+		}
+	}
+	if len(report.Errors) > 0 {
+		return fail(globals.AckApplyFailed, ErrApplyIncomplete)
+	}
+
+	obj.Response.Ack = globals.AckApplied
+	logging.LogObjectAction(
+		fmt.Sprintf("Applied %d config changes", len(report.Changes)), obj.UID,
+	)
+	return report, nil
+}
+
+// -------Validation------------------------------------------------------------
+
+// ValidateRoutes returns what is wrong with a document's routes, if anything.
+func ValidateRoutes(routes []system.RouteData) system.ConfigErrors {
+	var errs system.ConfigErrors
+
+	routeNames := map[string]bool{}
+	for i, rd := range routes {
+		path := system.IndexPath("routes", i)
+		switch {
+		case rd.Name == "":
+			errs.Addf(path+".name", "route has no name")
+		case routeNames[rd.Name]:
+			errs.Addf(path+".name", "route %q is listed twice", rd.Name)
+		}
+		routeNames[rd.Name] = true
+
+		channelNames := map[string]bool{}
+		for j, cd := range rd.Channels {
+			path := system.IndexPath(path+".channels", j)
+			switch {
+			case cd.Name == "":
+				errs.Addf(path+".name", "channel has no name")
+			case cd.Name == globals.DeadLetter:
+				errs.Addf(path+".name", "%q is reserved", cd.Name)
+			case channelNames[cd.Name]:
+				errs.Addf(path+".name", "channel %q is listed twice", cd.Name)
+			}
+			channelNames[cd.Name] = true
+
+			if _, ok := globals.StrategyValue[cd.Strategy]; cd.Strategy != "" && !ok {
+				errs.Addf(path+".strategy", "unknown strategy %q, expected %s",
+					cd.Strategy, strategyNames(),
+				)
+			}
+
+			endpoints := map[string][]system.EndpointData{
+				"transformers": cd.Transformers,
+				"subscribers":  cd.Subscribers,
+			}
+			for _, field := range slices.Sorted(maps.Keys(endpoints)) {
+				addresses := map[string]bool{}
+				for k, ed := range endpoints[field] {
+					path := system.IndexPath(path+"."+field, k) + ".address"
+					addr := ed.DialAddress()
+					switch {
+					case ed.Address == "":
+						errs.Addf(path, "address is empty")
+						continue
+					case strings.HasPrefix(addr, connScheme):
+						errs.Addf(path, "gateway connections cannot be configured")
+						continue
+					case addresses[addr]:
+						errs.Addf(path, "%q is listed twice", addr)
+					}
+					addresses[addr] = true
+
+					var err error
+					if field == "subscribers" && strings.HasPrefix(addr, fileScheme) {
+						_, err = parseFileAddress(addr)
+					} else {
+						_, _, err = comm.ParseDialAddress(addr)
+					}
+					if err != nil {
+						errs.Addf(path, "%s", err)
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// strategyNames lists the selection strategies for error messages.
+func strategyNames() string {
+	names := slices.Sorted(maps.Keys(globals.StrategyValue))
+	return strings.Join(names, ", ")
+}
+
+// -------Parameters------------------------------------------------------------
+
+// parameterDiff is how a document's parameters differ from the live ones.
+type parameterDiff struct {
+	updates []Change
+	restart []Change
+	runtime runtimeUpdater
+}
+
+// runtimeParameters are the parameters a globals update can change, by the
+// runtimeUpdater fields.
+var runtimeParameters = func() map[string]bool {
+	keys := map[string]bool{}
+	t := reflect.TypeFor[runtimeUpdater]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		keys[name] = true
+	}
+	delete(keys, "security-token")
+	return keys
+}()
+
+// diffParameters compares the document's parameters with the live ones.
+// Errors if the document has parameters that are unknown or invalid.
+func diffParameters(doc map[string]json.RawMessage) (parameterDiff, error) {
+	var diff parameterDiff
+	if len(doc) == 0 {
+		return diff, nil
+	}
+
+	// Type checks every parameter, not only the ones that can be applied.
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, &system.ParamData{})
+	}
+	if err != nil {
+		return diff, fmt.Errorf("parameters: %s", err)
+	}
+
+	params := system.NewParamData()
+	params.LogOutput = &globals.LogOutput
+	live := map[string]json.RawMessage{}
+	data, err = json.Marshal(params)
+	if err == nil {
+		err = json.Unmarshal(data, &live)
+	}
+	if err != nil {
+		return diff, err
+	}
+
+	runtime := map[string]json.RawMessage{}
+	for _, key := range slices.Sorted(maps.Keys(doc)) {
+		if key == "security-tokens" {
+			continue // Access control is never applied.
+		}
+		before, known := live[key]
+		if !known {
+			return diff, fmt.Errorf("parameters.%s: unknown parameter", key)
+		}
+		if sameParameter(key, before, doc[key]) {
+			continue
+		}
+
+		c := Change{
+			Action: changeUpdate,
+			Object: "parameter",
+			Field:  key,
+			Before: before,
+			After:  doc[key],
+			perm:   globals.PermManageGlobals,
+		}
+		if runtimeParameters[key] {
+			runtime[key] = doc[key]
+			diff.updates = append(diff.updates, c)
+		} else {
+			diff.restart = append(diff.restart, c)
+		}
+	}
+
+	data, err = json.Marshal(runtime)
+	if err == nil {
+		err = json.Unmarshal(data, &diff.runtime)
+	}
+	if err != nil {
+		return diff, fmt.Errorf("parameters: %s", err)
+	}
+	if err := validateRuntime(&diff.runtime); err != nil {
+		return diff, err
+	}
+	return diff, nil
+}
+
+// sameParameter reports whether two encoded values of the parameter are equal,
+// comparing durations by length rather than spelling, and leaving out fields
+// set to their zero value.
+func sameParameter(key string, a, b json.RawMessage) bool {
+	va, vb := decodeParameter(key, a), decodeParameter(key, b)
+	if la, ok := va.([]any); ok && len(la) == 0 {
+		va = nil
+	}
+	if lb, ok := vb.([]any); ok && len(lb) == 0 {
+		vb = nil
+	}
+
+	sa, aok := va.(string)
+	sb, bok := vb.(string)
+	if aok && bok {
+		da, aerr := time.ParseDuration(sa)
+		db, berr := time.ParseDuration(sb)
+		if aerr == nil && berr == nil {
+			return da == db
+		}
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// decodeParameter decodes the parameter's value through system.ParamData, so
+// its typed fields are all set.
+func decodeParameter(key string, v json.RawMessage) any {
+	var pd system.ParamData
+	data, err := json.Marshal(map[string]json.RawMessage{key: v})
+	if err == nil {
+		err = json.Unmarshal(data, &pd)
+	}
+	if err == nil {
+		data, err = json.Marshal(pd)
+	}
+
+	var decoded map[string]any
+	if err != nil || json.Unmarshal(data, &decoded) != nil {
+		return nil
+	}
+	return decoded[key]
+}
+
+// validateRuntime errors on the runtime parameters unpackGlobals would ignore,
+// and turns the listeners into the updates that replace the live ones.
+func validateRuntime(ru *runtimeUpdater) error {
+	if ru.TransformTimeout != nil {
+		if _, err := time.ParseDuration(*ru.TransformTimeout); err != nil {
+			return fmt.Errorf("parameters.xform-timeout: %s", err)
+		}
+	}
+	if ru.AllowCIDRs != nil {
+		if _, err := comm.ParsePrefixes(*ru.AllowCIDRs); err != nil {
+			return fmt.Errorf("parameters.allow-cidrs: %s", err)
+		}
+	}
+	if ru.DenyCIDRs != nil {
+		if _, err := comm.ParsePrefixes(*ru.DenyCIDRs); err != nil {
+			return fmt.Errorf("parameters.deny-cidrs: %s", err)
+		}
+	}
+
+	limits := map[string]*int{
+		"max-conns":        ru.MaxConnections,
+		"max-conns-per-ip": ru.MaxConnectionsPerIP,
+		"conn-burst":       ru.ConnectionBurst,
+	}
+	for _, name := range slices.Sorted(maps.Keys(limits)) {
+		if v := limits[name]; v != nil && *v < 0 {
+			return fmt.Errorf("parameters.%s: must not be negative", name)
+		}
+	}
+	if ru.ConnectionRate != nil && *ru.ConnectionRate < 0 {
+		return errors.New("parameters.conn-rate: must not be negative")
+	}
+
+	if ru.Listeners == nil {
+		return nil
+	}
+	listed := map[string]bool{}
+	for i, u := range *ru.Listeners {
+		if err := comm.ValidateListener(u.Listener); err != nil {
+			return fmt.Errorf("parameters.listeners[%d]: %s", i, err)
+		}
+		listed[u.Name] = true
+	}
+	for _, l := range globals.Listeners {
+		if !listed[l.Name] {
+			*ru.Listeners = append(*ru.Listeners, listenerUpdate{
+				Listener: l, Remove: true,
+			})
+		}
+	}
+	return nil
+}
+
+// -------Topology--------------------------------------------------------------
+
+// diffRoutes compares the document's routes with the live ones, in the order
+// the changes must be made. Within a channel, components are added before any
+// are removed so auto consolidation does not remove the channel midway.
+func (b *Broker) diffRoutes(routes []system.RouteData, opts ApplyOptions) []Change {
+	live := map[string]system.RouteData{}
+	for _, rd := range b.Topology() {
+		live[rd.Name] = rd
+	}
+
+	var changes []Change
+	listed := map[string]bool{}
+	for _, rd := range routes {
+		listed[rd.Name] = true
+		changes = append(changes, b.diffRoute(rd, live[rd.Name], opts)...)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(live)) {
+		if listed[name] || !opts.prunable(name, "", "") {
+			continue
+		}
+		if !allPrunable(live[name], opts) {
+			// Only some of its channels go, the route stays.
+			unlisted := system.RouteData{Name: name}
+			changes = append(changes, b.diffRoute(unlisted, live[name], opts)...)
+			continue
+		}
+		changes = append(changes, Change{
+			Action: changeRemove,
+			Object: "route",
+			Route:  name,
+			perm:   globals.PermManageTopology,
+			run: func() {
+				for _, cd := range live[name].Channels {
+					b.runCommand(globals.ObjChannel, globals.CmdRemove,
+						name, cd.Name, "",
+					)
+				}
+			},
+		})
+	}
+	return changes
+}
+
+// allPrunable reports whether every channel of the live route is prunable.
+func allPrunable(live system.RouteData, opts ApplyOptions) bool {
+	for _, cd := range live.Channels {
+		if !opts.prunable(live.Name, cd.Name, "") {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Broker) diffRoute(rd, live system.RouteData, opts ApplyOptions) []Change {
+	var changes []Change
+	liveChannels := map[string]system.ChannelData{}
+	var order []string
+	for _, cd := range live.Channels {
+		liveChannels[cd.Name] = cd
+		order = append(order, cd.Name)
+	}
+
+	listed := make([]string, 0, len(rd.Channels))
+	for _, cd := range rd.Channels {
+		listed = append(listed, cd.Name)
+		lc, exists := liveChannels[cd.Name]
+		if !exists {
+			order = append(order, cd.Name)
+			changes = append(changes, Change{
+				Action:  changeAdd,
+				Object:  "channel",
+				Route:   rd.Name,
+				Channel: cd.Name,
+				After:   strategyOf(cd),
+				perm:    globals.PermManageTopology,
+				run: func() {
+					strat := cd.SelectionStrategy()
+					b.runCommand(globals.ObjChannel, globals.CmdAdd,
+						rd.Name, cd.Name, strconv.Itoa(int(strat)),
+					)
+				},
+			})
+		}
+		changes = append(changes, b.diffChannel(rd.Name, cd, lc, opts)...)
+	}
+
+	for _, cd := range live.Channels {
+		if slices.Contains(listed, cd.Name) || !opts.prunable(rd.Name, cd.Name, "") {
+			continue
+		}
+		order = slices.DeleteFunc(order, func(n string) bool {
+			return n == cd.Name
+		})
+		changes = append(changes, Change{
+			Action:  changeRemove,
+			Object:  "channel",
+			Route:   rd.Name,
+			Channel: cd.Name,
+			perm:    globals.PermManageTopology,
+			run: func() {
+				b.runCommand(globals.ObjChannel, globals.CmdRemove,
+					rd.Name, cd.Name, "",
+				)
+			},
+		})
+	}
+
+	if ordered := orderBy(order, listed, identity); !slices.Equal(order, ordered) {
+		changes = append(changes, Change{
+			Action: changeUpdate,
+			Object: "route",
+			Route:  rd.Name,
+			Field:  "channels",
+			Before: order,
+			After:  ordered,
+			perm:   globals.PermManageTopology,
+			run: func() {
+				b.mutex.RLock()
+				r := b.routes[rd.Name]
+				b.mutex.RUnlock()
+				if r != nil {
+					r.orderChannels(listed)
+					b.state.touch()
+				}
+			},
+		})
+	}
+	return changes
+}
+
+func (b *Broker) diffChannel(
+	route string, cd, live system.ChannelData, opts ApplyOptions,
+) []Change {
+	var changes []Change
+	change := func(action, object, address string, run func()) {
+		perm := globals.PermManageTopology
+		if object == "subscriber" {
+			perm = globals.PermSubscribe
+		}
+		changes = append(changes, Change{
+			Action:  action,
+			Object:  object,
+			Route:   route,
+			Channel: cd.Name,
+			Address: address,
+			perm:    perm,
+			run:     run,
+		})
+	}
+	command := func(objType, cmd uint8, address string) func() {
+		return func() { b.runCommand(objType, cmd, route, cd.Name, address) }
+	}
+
+	if live.Name != "" && cd.Strategy != "" && cd.Strategy != live.Strategy {
+		changes = append(changes, Change{
+			Action:  changeUpdate,
+			Object:  "channel",
+			Route:   route,
+			Channel: cd.Name,
+			Field:   "strategy",
+			Before:  live.Strategy,
+			After:   cd.Strategy,
+			perm:    globals.PermManageTopology,
+			run: func() {
+				if ch := b.channelByName(route, cd.Name); ch != nil {
+					ch.setStrategy(globals.StrategyValue[cd.Strategy])
+					b.state.touch()
+				}
+			},
+		})
+	}
+
+	transformers := addresses(live.Transformers)
+	listedTransformers := addresses(cd.Transformers)
+	subscribers := addresses(live.Subscribers)
+	listedSubscribers := addresses(cd.Subscribers)
+
+	for _, addr := range listedTransformers {
+		if !slices.Contains(transformers, addr) {
+			transformers = append(transformers, addr)
+			change(changeAdd, "transformer", addr,
+				command(globals.ObjTransformer, globals.CmdAdd, addr),
+			)
+		}
+	}
+	for _, addr := range listedSubscribers {
+		if !slices.Contains(subscribers, addr) {
+			change(changeAdd, "subscriber", addr,
+				command(globals.ObjSubscriber, globals.CmdAdd, addr),
+			)
+		}
+	}
+
+	prunable := func(listed []string, addr string) bool {
+		return !slices.Contains(listed, addr) &&
+			opts.prunable(route, cd.Name, addr)
+	}
+	for _, addr := range addresses(live.Transformers) {
+		if prunable(listedTransformers, addr) {
+			transformers = slices.DeleteFunc(transformers, func(a string) bool {
+				return a == addr
+			})
+			change(changeRemove, "transformer", addr,
+				command(globals.ObjTransformer, globals.CmdRemove, addr),
+			)
+		}
+	}
+	for _, addr := range subscribers {
+		if prunable(listedSubscribers, addr) {
+			change(changeRemove, "subscriber", addr,
+				command(globals.ObjSubscriber, globals.CmdRemove, addr),
+			)
+		}
+	}
+
+	ordered := orderBy(transformers, listedTransformers, identity)
+	if !slices.Equal(transformers, ordered) {
+		changes = append(changes, Change{
+			Action:  changeUpdate,
+			Object:  "channel",
+			Route:   route,
+			Channel: cd.Name,
+			Field:   "transformers",
+			Before:  transformers,
+			After:   ordered,
+			perm:    globals.PermManageTopology,
+			run: func() {
+				if ch := b.channelByName(route, cd.Name); ch != nil {
+					ch.orderTransformers(listedTransformers)
+					b.state.touch()
+				}
+			},
+		})
+	}
+	return changes
+}
+
+// runCommand runs a topology command as the broker itself.
+func (b *Broker) runCommand(objType, cmd uint8, route, channel, arg3 string) {
+	obj := rhizome.NewObject(
+		objType, cmd, globals.AckPlcyNoreply,
+		uuid.New().String(),
+		route, channel, arg3, "",
+		[]byte{},
+	)
+
+	switch objType {
+	case globals.ObjChannel:
+		b.handleChannel(obj)
+	case globals.ObjTransformer:
+		b.handleTransformer(obj)
+	case globals.ObjSubscriber:
+		b.handleSubscriber(obj)
+	}
+}
+
+// strategyOf is the strategy a new channel is created with.
+func strategyOf(cd system.ChannelData) string {
+	return cd.SelectionStrategy().String()
+}
+
+// addresses returns the dial addresses of the endpoints.
+func addresses(endpoints []system.EndpointData) []string {
+	addrs := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		addrs = append(addrs, e.DialAddress())
+	}
+	return addrs
+}
+
+func identity(s string) string { return s }
@@ -0,0 +1,244 @@
+package routing
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"mycelia/globals"
+	"mycelia/system"
+
+	"github.com/google/uuid"
+	"github.com/signal-weave/rhizome"
+)
+
+// newApplyBroker returns a broker with the topology of doc, keeping the state
+// file and audit log out of the way.
+func newApplyBroker(t *testing.T, doc string) *Broker {
+	t.Helper()
+	prevState, prevAudit := globals.StateFile, globals.AuditLogFile
+	t.Cleanup(func() {
+		globals.StateFile, globals.AuditLogFile = prevState, prevAudit
+	})
+	globals.StateFile = ""
+	globals.AuditLogFile = filepath.Join(t.TempDir(), "audit.jsonl")
+
+	b := NewBroker(nil)
+	if doc != "" {
+		applyDoc(t, b, "", doc)
+	}
+	return b
+}
+
+// applyDoc applies doc to the broker as the broker itself.
+func applyDoc(t *testing.T, b *Broker, opts, doc string) *ApplyReport {
+	t.Helper()
+	obj := rhizome.NewObject(
+		globals.ObjConfig, globals.CmdApply, globals.AckPlcyNoreply,
+		uuid.New().String(),
+		opts, "", "", "",
+		[]byte(doc),
+	)
+	report, err := b.ApplyConfig(obj)
+	if err != nil {
+		t.Fatalf("ApplyConfig(%q): %v", opts, err)
+	}
+	return report
+}
+
+// changeNames returns the changes as strings, for comparing.
+func changeNames(changes []Change) []string {
+	names := make([]string, 0, len(changes))
+	for _, c := range changes {
+		names = append(names, c.String())
+	}
+	slices.Sort(names)
+	return names
+}
+
+const applyLive = `{"routes": [
+	{"name": "orders", "channels": [
+		{"name": "audit", "strategy": "pub-sub",
+			"transformers": [{"address": "127.0.0.1:9001"}],
+			"subscribers": [
+				{"address": "127.0.0.1:9101"},
+				{"address": "127.0.0.1:9102"}
+			]},
+		{"name": "billing", "strategy": "round-robin",
+			"subscribers": [{"address": "127.0.0.1:9103"}]}
+	]},
+	{"name": "returns", "channels": [
+		{"name": "intake", "strategy": "pub-sub",
+			"subscribers": [{"address": "127.0.0.1:9104"}]}
+	]}
+]}`
+
+func TestApplyDryRun(t *testing.T) {
+	b := newApplyBroker(t, applyLive)
+	before := b.Topology()
+
+	doc := `{"routes": [
+		{"name": "orders", "channels": [
+			{"name": "audit", "strategy": "round-robin"},
+			{"name": "fraud", "strategy": "pub-sub",
+				"subscribers": [{"address": "127.0.0.1:9105"}]}
+		]},
+		{"name": "shipping", "channels": [
+			{"name": "labels", "strategy": "pub-sub"}
+		]}
+	]}`
+	for _, opts := range []string{"dry-run", "dry-run,prune"} {
+		t.Run(opts, func(t *testing.T) {
+			report := applyDoc(t, b, opts, doc)
+			if !report.DryRun || len(report.Changes) == 0 {
+				t.Fatalf("report = %+v, want a dry run with changes", report)
+			}
+			if after := b.Topology(); !reflect.DeepEqual(before, after) {
+				t.Errorf("dry run changed the topology\n got %+v\nwant %+v",
+					after, before)
+			}
+		})
+	}
+}
+
+func TestApplyPrune(t *testing.T) {
+	doc := `{"routes": [
+		{"name": "orders", "channels": [
+			{"name": "audit", "strategy": "pub-sub",
+				"transformers": [{"address": "127.0.0.1:9001"}],
+				"subscribers": [{"address": "127.0.0.1:9101"}]}
+		]}
+	]}`
+	want := []system.RouteData{{
+		Name: "orders",
+		Channels: []system.ChannelData{{
+			Name:         "audit",
+			Strategy:     "pub-sub",
+			Transformers: []system.EndpointData{{Address: "127.0.0.1:9001"}},
+			Subscribers:  []system.EndpointData{{Address: "127.0.0.1:9101"}},
+		}},
+	}}
+
+	t.Run("without prune", func(t *testing.T) {
+		b := newApplyBroker(t, applyLive)
+		before := b.Topology()
+		report := applyDoc(t, b, "", doc)
+		if len(report.Changes) != 0 {
+			t.Errorf("changes = %v, want none", changeNames(report.Changes))
+		}
+		if after := b.Topology(); !reflect.DeepEqual(before, after) {
+			t.Errorf("topology = %+v, want it unchanged", after)
+		}
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		b := newApplyBroker(t, applyLive)
+		report := applyDoc(t, b, "prune", doc)
+
+		wantChanges := []string{
+			"remove channel orders.billing",
+			"remove route returns",
+			"remove subscriber orders.audit 127.0.0.1:9102",
+		}
+		if got := changeNames(report.Changes); !slices.Equal(got, wantChanges) {
+			t.Errorf("changes = %v, want %v", got, wantChanges)
+		}
+		if got := b.Topology(); !reflect.DeepEqual(got, want) {
+			t.Errorf("topology = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		// Reloads only prune what the previous document listed, here the
+		// orders route, so the returns route added by other means stays.
+		b := newApplyBroker(t, applyLive)
+		previous := slices.DeleteFunc(
+			b.Topology(),
+			func(rd system.RouteData) bool { return rd.Name == "returns" },
+		)
+		report, err := b.ReloadConfig([]byte(doc), previous)
+		if err != nil {
+			t.Fatalf("ReloadConfig: %v", err)
+		}
+
+		wantChanges := []string{
+			"remove channel orders.billing",
+			"remove subscriber orders.audit 127.0.0.1:9102",
+		}
+		if got := changeNames(report.Changes); !slices.Equal(got, wantChanges) {
+			t.Errorf("changes = %v, want %v", got, wantChanges)
+		}
+		names := []string{}
+		for _, rd := range b.Topology() {
+			names = append(names, rd.Name)
+		}
+		if !slices.Equal(names, []string{"orders", "returns"}) {
+			t.Errorf("routes = %v, want [orders returns]", names)
+		}
+	})
+}
+
+func TestApplyUnchanged(t *testing.T) {
+	b := newApplyBroker(t, applyLive)
+	export, err := b.Export()
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		opts string
+		doc  string
+	}{
+		{"same document", "", applyLive},
+		{"same document pruned", "prune", applyLive},
+		{"export", "prune", string(export)},
+		{"no routes", "prune", `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := applyDoc(t, b, tt.opts, tt.doc)
+			if len(report.Changes) != 0 || len(report.RestartRequired) != 0 {
+				t.Errorf("changes = %v, restart required = %v, want none",
+					changeNames(report.Changes),
+					changeNames(report.RestartRequired))
+			}
+		})
+	}
+}
+
+func TestApplyDefaultStrategy(t *testing.T) {
+	b := newApplyBroker(t, `{"routes": [
+		{"name": "orders", "channels": [
+			{"name": "audit"},
+			{"name": "billing", "strategy": "round-robin"}
+		]}
+	]}`)
+
+	// Omitting the strategy of a live channel leaves it alone.
+	report := applyDoc(t, b, "", `{"routes": [
+		{"name": "orders", "channels": [{"name": "billing"}]}
+	]}`)
+	if len(report.Changes) != 0 {
+		t.Errorf("changes = %v, want none", changeNames(report.Changes))
+	}
+
+	// A CHANNEL.ADD without a strategy gets the same default.
+	b.runCommand(globals.ObjChannel, globals.CmdAdd, "orders", "fraud", "")
+
+	want := map[string]string{
+		"audit":   "random",
+		"billing": "round-robin",
+		"fraud":   "random",
+	}
+	if n := len(b.Topology()[0].Channels); n != len(want) {
+		t.Fatalf("channels = %d, want %d", n, len(want))
+	}
+	for _, cd := range b.Topology()[0].Channels {
+		if cd.Strategy != want[cd.Name] {
+			t.Errorf("channel %s strategy = %q, want %q",
+				cd.Name, cd.Strategy, want[cd.Name])
+		}
+	}
+}
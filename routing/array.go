@@ -2,6 +2,7 @@ package routing
 
 import (
 	"math/rand"
+	"slices"
 )
 
 // Remove the element of s at index i.
@@ -26,3 +27,31 @@ func randomElement[T any](s []T) (T, bool) {
 	i := rand.Intn(len(s))
 	return s[i], true
 }
+
+// Returns a copy of s with the elements whose key is listed in keys moved into
+// the listed order. They fill the places the listed elements held, so elements
+// that are not listed keep their place.
+func orderBy[T any](s []T, keys []string, key func(T) string) []T {
+	listed := map[string]T{}
+	for _, v := range s {
+		listed[key(v)] = v
+	}
+
+	var ordered []T
+	for _, k := range keys {
+		if v, ok := listed[k]; ok {
+			ordered = append(ordered, v)
+		}
+	}
+
+	out := make([]T, 0, len(s))
+	for _, v := range s {
+		if !slices.Contains(keys, key(v)) {
+			out = append(out, v)
+			continue
+		}
+		out = append(out, ordered[0])
+		ordered = ordered[1:]
+	}
+	return out
+}
@@ -0,0 +1,224 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"mycelia/audit"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/system"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is how the broker records mutating commands to the audit log.
+//
+// Channel, transformer, and subscriber adds and removes, globals updates,
+// config applies, and sigterms are recorded with the state they touched before
+// and after running. Dry runs are not recorded.
+// Commands that were refused are recorded too, without state.
+// -----------------------------------------------------------------------------
+
+var auditObjectNames = map[uint8]string{
+	globals.ObjChannel:     "channel",
+	globals.ObjTransformer: "transformer",
+	globals.ObjSubscriber:  "subscriber",
+	globals.ObjGlobals:     "globals",
+	globals.ObjConfig:      "config",
+	globals.ObjAction:      "action",
+}
+
+var auditCommandNames = map[uint8]string{
+	globals.CmdAdd:     "add",
+	globals.CmdRemove:  "remove",
+	globals.CmdUpdate:  "update",
+	globals.CmdApply:   "apply",
+	globals.CmdSigterm: "sigterm",
+}
+
+// auditNackResults name the nacks a command can fail with.
+var auditNackResults = map[uint8]string{
+	globals.AckChannelNotFound:      "channel-not-found",
+	globals.AckChannelAlreadyExists: "channel-already-exists",
+	globals.AckRouteNotFound:        "route-not-found",
+	globals.AckUnauthorized:         audit.ResultUnauthorized,
+	globals.AckRebindFailed:         "rebind-failed",
+	globals.AckApplyFailed:          "apply-failed",
+}
+
+// globalsState is the runtime configurable globals, as recorded in the audit
+// log for globals updates.
+type globalsState struct {
+	Address          string `json:"address"`
+	Port             int    `json:"port"`
+	Verbosity        int    `json:"verbosity"`
+	PrintTree        bool   `json:"print-tree"`
+	TransformTimeout string `json:"xform-timeout"`
+	AutoConsolidate  bool   `json:"consolidate"`
+
+	Listeners []globals.Listener `json:"listeners"`
+
+	AllowCIDRs          []string `json:"allow-cidrs"`
+	DenyCIDRs           []string `json:"deny-cidrs"`
+	MaxConnections      int      `json:"max-conns"`
+	MaxConnectionsPerIP int      `json:"max-conns-per-ip"`
+	ConnectionRate      float64  `json:"conn-rate"`
+	ConnectionBurst     int      `json:"conn-burst"`
+}
+
+// auditable reports whether the object is a mutating command.
+func auditable(obj *rhizome.Object) bool {
+	switch obj.ObjType {
+	case globals.ObjChannel, globals.ObjTransformer, globals.ObjSubscriber:
+		return obj.CmdType == globals.CmdAdd || obj.CmdType == globals.CmdRemove
+	case globals.ObjGlobals:
+		return obj.CmdType == globals.CmdUpdate
+	case globals.ObjAction:
+		return obj.CmdType == globals.CmdSigterm
+	case globals.ObjConfig:
+		opts, _ := ParseApplyOptions(obj.Arg1)
+		return obj.CmdType == globals.CmdApply && !opts.DryRun
+	}
+	return false
+}
+
+// auditState returns the state the object's command touches: the channel for
+// topology commands, the globals for globals updates, or both the globals and
+// every route for config applies. nil if there is none.
+func (b *Broker) auditState(obj *rhizome.Object) json.RawMessage {
+	var state any
+	switch obj.ObjType {
+	case globals.ObjGlobals:
+		state = currentGlobals()
+	case globals.ObjConfig:
+		state = struct {
+			Globals globalsState       `json:"globals"`
+			Routes  []system.RouteData `json:"routes"`
+		}{currentGlobals(), b.Topology()}
+	case globals.ObjAction:
+		return nil
+	default:
+		r := b.getRoute(obj)
+		if r == nil {
+			return nil
+		}
+		ch := r.getChannel(obj.Arg2)
+		if ch == nil {
+			return nil
+		}
+		state = ch.shape()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// currentGlobals returns the runtime configurable globals.
+func currentGlobals() globalsState {
+	return globalsState{
+		Address:          globals.Address,
+		Port:             globals.Port,
+		Verbosity:        int(globals.Verbosity),
+		PrintTree:        globals.PrintTree,
+		TransformTimeout: globals.TransformTimeout.String(),
+		AutoConsolidate:  globals.AutoConsolidate,
+
+		Listeners: globals.Listeners,
+
+		AllowCIDRs:          globals.AllowCIDRs,
+		DenyCIDRs:           globals.DenyCIDRs,
+		MaxConnections:      globals.MaxConnections,
+		MaxConnectionsPerIP: globals.MaxConnectionsPerIP,
+		ConnectionRate:      globals.ConnectionRate,
+		ConnectionBurst:     globals.ConnectionBurst,
+	}
+}
+
+// newAuditEntry fills in who sent the object and what it asked for.
+func newAuditEntry(obj *rhizome.Object, p *principal) *audit.Entry {
+	e := &audit.Entry{
+		Principal:  "anonymous",
+		RemoteAddr: "internal",
+		UID:        obj.UID,
+		Object:     auditObjectNames[obj.ObjType],
+		Command:    auditCommandNames[obj.CmdType],
+	}
+	if p != nil {
+		e.Principal, e.Method = p.Name, p.Method
+	}
+	if obj.Responder != nil {
+		e.RemoteAddr = obj.Responder.RemoteAddr()
+	}
+
+	switch obj.ObjType {
+	case globals.ObjChannel:
+		e.Route, e.Channel = obj.Arg1, obj.Arg2
+	case globals.ObjTransformer, globals.ObjSubscriber:
+		e.Route, e.Channel, e.Address = obj.Arg1, obj.Arg2, obj.Arg3
+	}
+	return e
+}
+
+// auditRefused records a mutating command that failed authorization.
+func (b *Broker) auditRefused(obj *rhizome.Object) {
+	e := newAuditEntry(obj, b.principalOf(obj))
+	e.Result = audit.ResultUnauthorized
+	recordAudit(e)
+}
+
+// auditCommand records the state the object's command touches and returns a
+// func that records the command once it has run.
+func (b *Broker) auditCommand(obj *rhizome.Object) func() {
+	e := newAuditEntry(obj, b.principalOf(obj))
+	e.Before = b.auditState(obj)
+
+	return func() {
+		e.After = b.auditState(obj)
+		e.Result = auditResult(obj, e.Before, e.After)
+		recordAudit(e)
+	}
+}
+
+// auditResult is the name of the nack the command failed with, or whether it
+// changed the state it touched.
+func auditResult(obj *rhizome.Object, before, after json.RawMessage) string {
+	if obj.Response != nil {
+		if result, ok := auditNackResults[obj.Response.Ack]; ok {
+			return result
+		}
+	}
+	if obj.ObjType == globals.ObjAction || !bytes.Equal(before, after) {
+		return audit.ResultApplied
+	}
+	return audit.ResultUnchanged
+}
+
+func recordAudit(e *audit.Entry) {
+	if err := audit.Record(e); err != nil {
+		logging.LogSystemError(
+			fmt.Sprintf("Could not record %s %s to audit log: %s",
+				e.Object, e.Command, err,
+			),
+		)
+	}
+}
+
+// -------Queries---------------------------------------------------------------
+
+// QueryAudit returns the audit entries matching the filter, if the responder's
+// connection may read the audit log.
+func (b *Broker) QueryAudit(
+	resp *rhizome.ConnResponder, f audit.Filter,
+) ([]audit.Entry, error) {
+	p := b.principalOf(&rhizome.Object{Responder: resp})
+	if p == nil || !p.can(globals.PermReadAudit, "") {
+		return nil, ErrUnauthorized
+	}
+	return audit.Query(f)
+}
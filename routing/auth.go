@@ -0,0 +1,404 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/tokens"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the broker's authentication and authorization checks.
+//
+// A connection authenticates once, either by sending a CmdAuthenticate action
+// with a security token as the payload, or by presenting a verified client
+// certificate over mTLS. Every object is then authorized against the
+// connection's principal before HandleObject dispatches it.
+//
+// The tokens in globals.SecurityTokens may run every command. Tokens and
+// certificate identities of globals.Principals get the permissions of their
+// roles, scoped to the routes each role matches. While no principals are
+// configured, every authenticated connection may run every command.
+//
+// Signed tokens authenticate as their subject with the permissions of their
+// scopes, until they expire or are revoked.
+//
+// Anonymous connections may only publish and change the topology while no
+// security tokens, principals, or token keys are configured, or on listeners
+// with the optional auth policy, which opts in to it explicitly.
+//
+// Objects without a responder come from inside the broker, such as the config
+// file or source connectors, and are always trusted, as are connections on
+// listeners with the trusted auth policy.
+// -----------------------------------------------------------------------------
+
+const (
+	authToken       = "token"
+	authSignedToken = "signed-token"
+	authCertificate = "certificate"
+	authInternal    = "internal"
+	authListener    = "listener"
+)
+
+// principal is who a connection authenticated as.
+type principal struct {
+	Name      string
+	Method    string // authToken, authSignedToken, authCertificate, or authInternal
+	Superuser bool
+	Roles     []string
+
+	// Set for signed tokens.
+	Grants  []globals.Role
+	TokenID string
+	Expires time.Time
+}
+
+// ErrUnauthorized is returned by HandleObject for objects it refused.
+var ErrUnauthorized = errors.New("unauthorized")
+
+var internalPrincipal = &principal{
+	Name: "mycelia", Method: authInternal, Superuser: true,
+}
+
+// sessionTable maps connections onto the principal they authenticated as, and
+// the auth policy of the listener they arrived on.
+type sessionTable struct {
+	mutex    sync.RWMutex
+	sessions map[*rhizome.ConnResponder]*principal
+	policies map[*rhizome.ConnResponder]string
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions: map[*rhizome.ConnResponder]*principal{},
+		policies: map[*rhizome.ConnResponder]string{},
+	}
+}
+
+func (st *sessionTable) get(resp *rhizome.ConnResponder) *principal {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.sessions[resp]
+}
+
+func (st *sessionTable) set(resp *rhizome.ConnResponder, p *principal) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.sessions[resp] = p
+}
+
+func (st *sessionTable) remove(resp *rhizome.ConnResponder) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.sessions, resp)
+	delete(st.policies, resp)
+}
+
+func (st *sessionTable) setPolicy(resp *rhizome.ConnResponder, policy string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.policies[resp] = policy
+}
+
+func (st *sessionTable) policy(resp *rhizome.ConnResponder) string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.policies[resp]
+}
+
+// requireAuth reports whether anonymous objects from the connection are
+// refused, by its listener's auth policy or else globals.RequireAuth.
+func (st *sessionTable) requireAuth(resp *rhizome.ConnResponder) bool {
+	switch st.policy(resp) {
+	case globals.ListenAuthRequired:
+		return true
+	case globals.ListenAuthOptional:
+		return false
+	}
+	return globals.RequireAuth
+}
+
+// openToAnonymous reports whether anonymous objects from the connection may
+// publish and change the topology: on listeners with the optional auth
+// policy, or while there is no access control to bypass.
+func (st *sessionTable) openToAnonymous(resp *rhizome.ConnResponder) bool {
+	return st.policy(resp) == globals.ListenAuthOptional || !AccessConfigured()
+}
+
+// AccessConfigured reports whether security tokens, principals, or token keys
+// are configured, i.e. whether connections have anything to authenticate with.
+func AccessConfigured() bool {
+	return len(globals.SecurityTokens) > 0 || len(globals.Principals) > 0 ||
+		len(globals.TokenKeys) > 0
+}
+
+// BeginSession applies the auth policy of the listener the connection behind
+// the responder arrived on. Connections on trusted listeners are authenticated
+// straight away, as a principal named after the listener.
+func (b *Broker) BeginSession(resp *rhizome.ConnResponder, listener, policy string) {
+	switch policy {
+	case globals.ListenAuthTrusted:
+		b.sessions.set(resp, &principal{
+			Name: listener, Method: authListener, Superuser: true,
+		})
+	case globals.ListenAuthRequired, globals.ListenAuthOptional:
+		b.sessions.setPolicy(resp, policy)
+	}
+}
+
+// EndSession forgets the connection's principal. Must be called once the
+// connection behind the responder closes.
+func (b *Broker) EndSession(resp *rhizome.ConnResponder) {
+	b.sessions.remove(resp)
+}
+
+// principalOf returns who sent the object, or nil if its connection has not
+// authenticated.
+func (b *Broker) principalOf(obj *rhizome.Object) *principal {
+	if obj.Responder == nil {
+		return internalPrincipal
+	}
+	if p := b.sessions.get(obj.Responder); p != nil {
+		return p
+	}
+
+	if id := comm.PeerIdentity(obj.Responder.C); id != "" {
+		p := principalForIdentity(id)
+		b.sessions.set(obj.Responder, p)
+		return p
+	}
+
+	return nil
+}
+
+// authenticate handles a CmdAuthenticate action, answering with
+// AckAuthenticated or AckUnauthorized.
+func (b *Broker) authenticate(obj *rhizome.Object) {
+	if obj.Responder == nil {
+		return
+	}
+
+	p := principalForToken(string(obj.Payload))
+	if p == nil {
+		logging.LogObjectWarning(
+			fmt.Sprintf("Failed authentication from %s", obj.Responder.RemoteAddr()),
+			obj.UID,
+		)
+		err := obj.ResponeWithAck(globals.AckUnauthorized)
+		LogPossibleAckError(obj, err)
+		return
+	}
+
+	b.sessions.set(obj.Responder, p)
+	logging.LogObjectAction(
+		fmt.Sprintf("Authenticated %s as %s", obj.Responder.RemoteAddr(), p.Name),
+		obj.UID,
+	)
+	err := obj.ResponeWithAck(globals.AckAuthenticated)
+	LogPossibleAckError(obj, err)
+}
+
+// authorize reports whether the object may be dispatched.
+//
+// Authenticated principals need the permission the command requires on its
+// route. Anonymous connections are refused everything when their listener, or
+// else globals.RequireAuth, requires auth. Otherwise they are refused
+// privileged commands, and publishing and topology changes too unless
+// openToAnonymous. Anonymous globals updates are left to updateGlobals, which
+// still accepts a security token in the payload.
+func (b *Broker) authorize(obj *rhizome.Object) bool {
+	p := b.principalOf(obj)
+	if p == nil {
+		switch {
+		case b.sessions.requireAuth(obj.Responder):
+			return false
+		case obj.ObjType == globals.ObjAction, obj.ObjType == globals.ObjConfig:
+			return false
+		case obj.ObjType == globals.ObjGlobals:
+			return true
+		}
+		return b.sessions.openToAnonymous(obj.Responder)
+	}
+
+	perm, route, needed := requiredPermission(obj)
+	if !needed {
+		return true
+	}
+	return p.can(perm, route)
+}
+
+// requiredPermission returns the permission the object's command needs, and
+// the route it needs it on. needed is false for objects HandleObject rejects
+// anyway, and for config applies.
+func requiredPermission(obj *rhizome.Object) (
+	perm globals.Permission, route string, needed bool,
+) {
+	switch obj.ObjType {
+	case globals.ObjDelivery:
+		return globals.PermPublish, obj.Arg1, true
+	case globals.ObjSubscriber:
+		return globals.PermSubscribe, obj.Arg1, true
+	case globals.ObjChannel, globals.ObjTransformer:
+		return globals.PermManageTopology, obj.Arg1, true
+	case globals.ObjGlobals:
+		return globals.PermManageGlobals, "", true
+	case globals.ObjAction:
+		return globals.PermShutdown, "", true
+	case globals.ObjConfig:
+		if obj.CmdType == globals.CmdApply {
+			// Checked for each change the document asks for.
+			return "", "", false
+		}
+		return globals.PermExportConfig, "", true
+	}
+	return "", "", false
+}
+
+// can reports whether any of the principal's roles grants perm on route.
+// Principals of expired or revoked tokens can do nothing.
+func (p *principal) can(perm globals.Permission, route string) bool {
+	if !p.Expires.IsZero() && !time.Now().Before(p.Expires) {
+		return false
+	}
+	if p.TokenID != "" && tokens.Revoked(p.TokenID) {
+		return false
+	}
+	if p.Superuser {
+		return true
+	}
+
+	for _, grant := range p.Grants {
+		if roleGrants(grant, perm, route) {
+			return true
+		}
+	}
+
+	for _, name := range p.Roles {
+		for _, role := range globals.Roles {
+			if role.Name == name && roleGrants(role, perm, route) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func roleGrants(role globals.Role, perm globals.Permission, route string) bool {
+	if !slices.Contains(role.Permissions, perm) {
+		return false
+	}
+	if !perm.RouteScoped() || len(role.Routes) == 0 {
+		return true
+	}
+	for _, pattern := range role.Routes {
+		if ok, _ := path.Match(pattern, route); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// principalForToken returns the principal a security token authenticates as,
+// or nil if the token is not valid.
+func principalForToken(token string) *principal {
+	if tokens.IsSigned(token) {
+		return principalForSignedToken(token)
+	}
+	if validToken(token) {
+		return &principal{Name: authToken, Method: authToken, Superuser: true}
+	}
+
+	for _, p := range globals.Principals {
+		for _, t := range p.Tokens {
+			if tokens.Match(t, token) {
+				return &principal{Name: p.Name, Method: authToken, Roles: p.Roles}
+			}
+		}
+	}
+	return nil
+}
+
+func principalForSignedToken(token string) *principal {
+	claims, err := tokens.Verify(token)
+	if err != nil {
+		logging.LogSystemWarning(fmt.Sprintf("Rejected signed token: %s", err))
+		return nil
+	}
+
+	p := &principal{
+		Name:    claims.Subject,
+		Method:  authSignedToken,
+		TokenID: claims.ID,
+		Expires: claims.ExpiresAt(),
+	}
+	for _, scope := range claims.Scopes {
+		if role, ok := strings.CutPrefix(scope, "role:"); ok {
+			p.Roles = append(p.Roles, role)
+			continue
+		}
+		perm, pattern, _ := strings.Cut(scope, ":")
+		grant := globals.Role{
+			Name:        scope,
+			Permissions: []globals.Permission{globals.Permission(perm)},
+		}
+		if pattern != "" {
+			grant.Routes = []string{pattern}
+		}
+		p.Grants = append(p.Grants, grant)
+	}
+	return p
+}
+
+// principalForIdentity returns the principal a verified client certificate
+// authenticates as. Identities no principal claims may run every command
+// while access control is off, and nothing once it is on.
+func principalForIdentity(id string) *principal {
+	for _, p := range globals.Principals {
+		if slices.Contains(p.Identities, id) {
+			return &principal{Name: p.Name, Method: authCertificate, Roles: p.Roles}
+		}
+	}
+	return &principal{
+		Name:      id,
+		Method:    authCertificate,
+		Superuser: len(globals.Principals) == 0,
+	}
+}
+
+// rejectUnauthorized nacks the object with AckUnauthorized.
+func rejectUnauthorized(obj *rhizome.Object) {
+	if obj.Responder == nil {
+		return
+	}
+	logging.LogObjectWarning(
+		fmt.Sprintf("Unauthorized object %d/%d from %s",
+			obj.ObjType, obj.CmdType, obj.Responder.RemoteAddr(),
+		), obj.UID,
+	)
+	err := obj.ResponeWithAck(globals.AckUnauthorized)
+	LogPossibleAckError(obj, err)
+}
+
+// validToken reports whether token is one of globals.SecurityTokens.
+func validToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	valid := false
+	for _, t := range globals.SecurityTokens {
+		if tokens.Match(t, token) {
+			valid = true
+		}
+	}
+	return valid
+}
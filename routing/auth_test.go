@@ -0,0 +1,71 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/tokens"
+)
+
+func TestSignedTokenScopes(t *testing.T) {
+	prevKeys, prevSigning := globals.TokenKeys, globals.TokenSigningKey
+	prevRoles := globals.Roles
+	t.Cleanup(func() {
+		globals.TokenKeys, globals.TokenSigningKey = prevKeys, prevSigning
+		globals.Roles = prevRoles
+	})
+	globals.TokenKeys = []globals.TokenKey{
+		{ID: "a", Secret: "0123456789abcdef-a"},
+	}
+	globals.TokenSigningKey = "a"
+	globals.Roles = []globals.Role{{
+		Name:        "auditor",
+		Permissions: []globals.Permission{globals.PermReadAudit},
+	}}
+
+	token, _, err := tokens.Issue("checkout", []string{
+		"publish:orders-*",
+		"subscribe:orders-?",
+		"manage-topology:[a-c]*",
+		"shutdown",
+		"role:auditor",
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	p := principalForToken(token)
+	if p == nil {
+		t.Fatal("principalForToken returned nil for a valid token")
+	}
+
+	tests := []struct {
+		perm  globals.Permission
+		route string
+		want  bool
+	}{
+		{globals.PermPublish, "orders-eu", true},
+		{globals.PermPublish, "orders-", true},
+		{globals.PermPublish, "orders", false},
+		{globals.PermPublish, "billing", false},
+		{globals.PermSubscribe, "orders-1", true},
+		{globals.PermSubscribe, "orders-10", false},
+		{globals.PermManageTopology, "billing", true},
+		{globals.PermManageTopology, "orders", false},
+		{globals.PermShutdown, "", true},
+		{globals.PermReadAudit, "", true},
+		{globals.PermManageGlobals, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.perm)+" "+tt.route, func(t *testing.T) {
+			if got := p.can(tt.perm, tt.route); got != tt.want {
+				t.Errorf("can(%s, %q) = %t, want %t",
+					tt.perm, tt.route, got, tt.want)
+			}
+		})
+	}
+
+	if principalForToken(token+"x") != nil {
+		t.Error("principalForToken accepted a tampered token")
+	}
+}
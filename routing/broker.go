@@ -1,9 +1,12 @@
 package routing
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
+	"mycelia/comm"
 	"mycelia/errgo"
 	"mycelia/globals"
 	"mycelia/logging"
@@ -16,6 +19,7 @@ import (
 // causing a circular dependency.
 type server interface {
 	UpdateListener() error
+	SyncListeners() (bool, error)
 	GetAddress() string
 	GetPort() int
 	Shutdown()
@@ -31,13 +35,26 @@ type Broker struct {
 	ManagingServer server
 	mutex          sync.RWMutex
 	routes         map[string]*route
+	sessions       *sessionTable
+
+	// gate is held for reading while an object is handled and for writing
+	// when the broker closes, so no object is half handled once it is closed.
+	gate    sync.RWMutex
+	closed  bool
+	closeBy atomic.Int64 // Shutdown deadline in unix nanoseconds, 0 if open.
+	spill   *spillLog
+
+	state *stateWriter
 }
 
 func NewBroker(s server) *Broker {
-	return &Broker{
+	b := &Broker{
 		ManagingServer: s,
 		routes:         map[string]*route{},
+		sessions:       newSessionTable(),
 	}
+	b.state = newStateWriter(b)
+	return b
 }
 
 // HandleBytes handles the raw byte form of a object, hot off a socket, converts
@@ -121,7 +138,33 @@ func (b *Broker) getChannel(obj *rhizome.Object) *channel {
 
 // HandleObject routes the object generated from the incoming byte stream.
 // Is exported for boot to load PreInit.json structures into.
+//
+// Objects are authorized against the sending connection's principal first;
+// unauthorized objects are nacked with AckUnauthorized and dropped.
+// Mutating commands are recorded to the audit log, refused or not.
+// Objects handed to a closed broker are dropped with ErrShuttingDown.
 func (b *Broker) HandleObject(obj *rhizome.Object) error {
+	b.gate.RLock()
+	defer b.gate.RUnlock()
+	if b.closed {
+		return ErrShuttingDown
+	}
+
+	if obj.ObjType == globals.ObjAction && obj.CmdType == globals.CmdAuthenticate {
+		b.authenticate(obj)
+		return nil
+	}
+	if !b.authorize(obj) {
+		if auditable(obj) {
+			b.auditRefused(obj)
+		}
+		rejectUnauthorized(obj)
+		return ErrUnauthorized
+	}
+	if auditable(obj) {
+		defer b.auditCommand(obj)()
+	}
+
 	switch obj.ObjType {
 	case globals.ObjDelivery:
 		b.handleDelivery(obj)
@@ -135,6 +178,8 @@ func (b *Broker) HandleObject(obj *rhizome.Object) error {
 		b.handleGlobals(obj)
 	case globals.ObjAction:
 		b.handleActions(obj)
+	case globals.ObjConfig:
+		b.handleConfig(obj)
 	default:
 		wErr := errgo.NewError("Unknown object type!", globals.VerbWrn)
 		return wErr
@@ -149,10 +194,26 @@ func (b *Broker) handleDelivery(obj *rhizome.Object) {
 	case globals.CmdSend:
 		r := b.getRoute(obj)
 		if r == nil {
+			if obj.AckPlcy == globals.AckPlcyOnsent {
+				err := obj.ResponeWithAck(globals.AckRouteNotFound)
+				LogPossibleAckError(obj, err)
+			}
 			return
 		}
 		r.enqueue(obj) // no channels means route will send to dead letter.
 
+	case globals.CmdSendChannel:
+		// Args: route, channel, key, nil
+		ch := b.channelByName(obj.Arg1, obj.Arg2)
+		if ch == nil {
+			if obj.AckPlcy == globals.AckPlcyOnsent {
+				err := obj.ResponeWithAck(globals.AckChannelNotFound)
+				LogPossibleAckError(obj, err)
+			}
+			return
+		}
+		ch.enqueue(obj) // Not passed on to the channels after it.
+
 	default:
 		logging.LogObjectWarning(
 			fmt.Sprintf("Unknown command type for delivery from %s",
@@ -173,8 +234,15 @@ func (b *Broker) handleChannel(obj *rhizome.Object) {
 
 	case globals.CmdRemove:
 		// Args: route, name, nil, nil
-		fmt.Println("CHANNEL.REMOVE not yet implemented.")
-		return
+		c := b.getChannel(obj)
+		if c == nil {
+			return
+		}
+		c.close()
+		c.route.removeChannel(c.name)
+		logging.LogObjectAction(
+			fmt.Sprintf("Removed channel: %s.%s", obj.Arg1, obj.Arg2), obj.UID,
+		)
 
 	default:
 		logging.LogObjectWarning(
@@ -185,6 +253,7 @@ func (b *Broker) handleChannel(obj *rhizome.Object) {
 		return
 	}
 
+	b.state.touch()
 	b.printStructure()
 }
 
@@ -193,6 +262,13 @@ func (b *Broker) handleTransformer(obj *rhizome.Object) {
 
 	case globals.CmdAdd:
 		// Args: route, channel, address, nil
+		if _, _, err := comm.ParseDialAddress(obj.Arg3); err != nil {
+			logging.LogObjectWarning(
+				fmt.Sprintf("Could not create transformer %s: %s", obj.Arg3, err),
+				obj.UID,
+			)
+			return
+		}
 		t := newTransformer(obj.Arg3)
 		c := b.getChannel(obj)
 		if c == nil {
@@ -218,6 +294,7 @@ func (b *Broker) handleTransformer(obj *rhizome.Object) {
 		return
 	}
 
+	b.state.touch()
 	b.printStructure()
 }
 
@@ -226,21 +303,29 @@ func (b *Broker) handleSubscriber(obj *rhizome.Object) {
 
 	case globals.CmdAdd:
 		// Args: route, channel, address, nil
-		s := newSubscriber(obj.Arg3)
 		c := b.getChannel(obj)
 		if c == nil {
 			return
 		}
-		c.addSubscriber(*s)
+		s, err := newSubscriber(obj.Arg1, obj.Arg2, obj.Arg3)
+		if err != nil {
+			logging.LogObjectWarning(
+				fmt.Sprintf("Could not create subscriber %s: %s", obj.Arg3, err),
+				obj.UID,
+			)
+			return
+		}
+		if !c.addSubscriber(*s) {
+			s.release()
+		}
 
 	case globals.CmdRemove:
 		// Args: route, channel, address, nil
-		s := newSubscriber(obj.Arg3)
 		c := b.getChannel(obj)
 		if c == nil {
 			return
 		}
-		c.removeSubscriber(*s)
+		c.removeSubscriber(subscriber{Address: obj.Arg3})
 
 	default:
 		logging.LogObjectWarning(
@@ -251,6 +336,7 @@ func (b *Broker) handleSubscriber(obj *rhizome.Object) {
 		return
 	}
 
+	b.state.touch()
 	b.printStructure()
 }
 
@@ -258,17 +344,13 @@ func (b *Broker) handleGlobals(obj *rhizome.Object) {
 	switch obj.CmdType {
 
 	case globals.CmdUpdate:
-		hasPermission := updateGlobals(obj)
+		hasPermission := updateGlobals(obj, b.principalOf(obj))
 		if !hasPermission {
+			err := obj.ResponeWithAck(globals.AckUnauthorized)
+			LogPossibleAckError(obj, err)
 			return
 		}
-		if b.ManagingServer.GetAddress() != globals.Address ||
-			b.ManagingServer.GetPort() != globals.Port {
-			err := b.ManagingServer.UpdateListener()
-			if err != nil {
-				logging.LogObjectError(err.Error(), obj.UID)
-			}
-		}
+		b.rebindListeners(obj)
 
 	default:
 		logging.LogObjectWarning(
@@ -280,6 +362,44 @@ func (b *Broker) handleGlobals(obj *rhizome.Object) {
 	}
 }
 
+// rebindListeners moves the default listener if the address or port changed,
+// and syncs the other listeners with globals.Listeners. If any listener
+// changed the sender is acked with AckRebound, or AckRebindFailed if any
+// failed to open.
+func (b *Broker) rebindListeners(obj *rhizome.Object) {
+	changed, err := b.syncListeners()
+	if !changed {
+		return
+	}
+	ack := globals.AckRebound
+	if err != nil {
+		logging.LogObjectError(err.Error(), obj.UID)
+		ack = globals.AckRebindFailed
+	}
+	if obj.Responder != nil {
+		err := obj.ResponeWithAck(ack)
+		LogPossibleAckError(obj, err)
+	}
+}
+
+// syncListeners moves the default listener if the address or port changed, and
+// syncs the other listeners with globals.Listeners.
+// Returns whether any listener changed, and the errors of those that failed.
+func (b *Broker) syncListeners() (bool, error) {
+	changed := false
+	var errs []error
+
+	if b.ManagingServer.GetAddress() != globals.Address ||
+		b.ManagingServer.GetPort() != globals.Port {
+		changed = true
+		errs = append(errs, b.ManagingServer.UpdateListener())
+	}
+	synced, err := b.ManagingServer.SyncListeners()
+	errs = append(errs, err)
+
+	return changed || synced, errors.Join(errs...)
+}
+
 func (b *Broker) handleActions(obj *rhizome.Object) {
 	switch obj.CmdType {
 
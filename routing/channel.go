@@ -59,7 +59,6 @@ func newChannel(
 	for range numPartitions {
 		np := newPartition(r, ch)
 		partitions = append(partitions, np)
-		np.in = make(chan *rhizome.Object, globals.PartitionChanSize)
 		np.start()
 	}
 	ch.partitions = partitions
@@ -117,12 +116,14 @@ func (ch *channel) loadTransformers() []transformer {
 	return nil
 }
 
-func (ch *channel) addSubscriber(s subscriber) {
+// Adds the subscriber to the channel.
+// Returns false if a subscriber with the same address already exists.
+func (ch *channel) addSubscriber(s subscriber) bool {
 	ch.mutex.Lock()
 	for _, existing := range ch.subscribers {
 		if existing.Address == s.Address {
 			ch.mutex.Unlock()
-			return
+			return false
 		}
 	}
 	ch.subscribers = append(ch.subscribers, s)
@@ -133,13 +134,16 @@ func (ch *channel) addSubscriber(s subscriber) {
 	logging.LogSystemAction(
 		fmt.Sprintf("Added subscriber at address: %s", s.Address),
 	)
+	return true
 }
 
 func (ch *channel) removeSubscriber(s subscriber) {
 	ch.mutex.Lock()
 
+	var removed *subscriber
 	for i, subscriber := range ch.subscribers {
 		if s.Address == subscriber.Address {
+			removed = &subscriber
 			ch.subscribers = append(ch.subscribers[:i], ch.subscribers[i+1:]...)
 			break
 		}
@@ -149,6 +153,10 @@ func (ch *channel) removeSubscriber(s subscriber) {
 	ch.mutex.Unlock()
 	ch.sSnap.Store(snap)
 
+	if removed != nil {
+		removed.release()
+	}
+
 	logging.LogSystemAction(
 		fmt.Sprintf("Removed subscriber for address: %s", s.Address),
 	)
@@ -166,7 +174,42 @@ func (ch *channel) loadSubscribers() []subscriber {
 // Get the selected subscribers to forward a message to using channel's
 // selection strategy.
 func (ch *channel) selectSubscribers() []subscriber {
-	return ch.selector.Select()
+	return ch.loadSelector().Select()
+}
+
+func (ch *channel) loadSelector() selector {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.selector
+}
+
+// setStrategy swaps the channel's selector for one of the given strategy.
+func (ch *channel) setStrategy(strat globals.SelectionStrategy) {
+	sel := newSelector(ch, strat)
+	ch.mutex.Lock()
+	ch.selector = sel
+	ch.mutex.Unlock()
+
+	logging.LogSystemAction(fmt.Sprintf(
+		"Set channel %s.%s strategy to %s", ch.route.name, ch.name, strat,
+	))
+}
+
+// orderTransformers reorders the channel's transformers whose addresses are
+// listed to the listed order. Transformers that are not listed keep their
+// place.
+func (ch *channel) orderTransformers(addresses []string) {
+	ch.mutex.Lock()
+	ch.transformers = orderBy(ch.transformers, addresses,
+		func(t transformer) string { return t.Address },
+	)
+	snap := append([]transformer(nil), ch.transformers...)
+	ch.mutex.Unlock()
+	ch.tSnap.Store(snap)
+
+	logging.LogSystemAction(fmt.Sprintf(
+		"Reordered transformers of channel %s.%s", ch.route.name, ch.name,
+	))
 }
 
 func (ch *channel) checkEmptyChannel() {
@@ -177,16 +220,27 @@ func (ch *channel) checkEmptyChannel() {
 	subs := ch.loadSubscribers()
 	trans := ch.loadTransformers()
 	if len(subs) == 0 && len(trans) == 0 {
-		ch.mutex.Lock()
-		parts := ch.partitions
-		ch.partitions = nil
-		ch.mutex.Unlock()
+		ch.close()
+		ch.route.removeChannel(ch.name)
+	}
+}
 
-		for _, p := range parts {
-			p.stop()
-		}
+// close stops the channel's partitions and releases its subscribers.
+// Deliveries enqueued after the channel is closed are dropped.
+func (ch *channel) close() {
+	ch.mutex.Lock()
+	parts := ch.partitions
+	ch.partitions = nil
+	subs := ch.subscribers
+	ch.subscribers = nil
+	ch.mutex.Unlock()
+	ch.sSnap.Store([]subscriber{})
 
-		ch.route.removeChannel(ch.name)
+	for _, p := range parts {
+		p.stop()
+	}
+	for _, s := range subs {
+		s.release()
 	}
 }
 
@@ -200,5 +254,5 @@ func (ch *channel) enqueue(m *rhizome.Object) {
 	}
 
 	idx := int(ch.hash([]byte(m.Arg3))) % len(parts)
-	parts[idx].in <- m
+	parts[idx].send(m)
 }
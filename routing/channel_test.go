@@ -0,0 +1,38 @@
+package routing
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"mycelia/globals"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// Closing a channel while publishes are blocked on a full partition, as a
+// remove or prune can, drops those deliveries rather than sending on a closed
+// channel.
+func TestChannelCloseDuringEnqueue(t *testing.T) {
+	r := newRoute(NewBroker(nil), "orders")
+	ch := newChannel(r, "audit", 0, globals.SelStratPubSub)
+	p := newPartition(r, ch) // Not started, so nothing drains it.
+	ch.partitions = []*partition{p}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range cap(p.in) {
+				ch.enqueue(&rhizome.Object{})
+			}
+		}()
+	}
+	for len(p.in) < cap(p.in) {
+		runtime.Gosched()
+	}
+
+	ch.close()
+	wg.Wait()
+}
@@ -0,0 +1,90 @@
+package routing
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are connection-bound subscribers.
+//
+// Address subscribers are dialed by the broker. Gateway clients such as
+// WebSockets instead hold a connection open to the broker and want deliveries
+// pushed back over it. A gateway registers that connection as a Conduit and
+// gets a conn:// address back, which it then subscribes with like any other
+// subscriber address. Unregistering the conduit, when the connection closes,
+// ends its subscriptions.
+// -----------------------------------------------------------------------------
+
+const connScheme = "conn://"
+
+// Conduit is a client connection that deliveries can be pushed over.
+type Conduit interface {
+	// Push sends the delivery for the given route + channel subscription over
+	// the connection.
+	Push(route, channel string, obj *rhizome.Object) error
+}
+
+// ChannelWatcher is a Conduit that is told of channels as they are created,
+// such as a connection with pattern subscriptions to extend to them.
+type ChannelWatcher interface {
+	Conduit
+
+	// ChannelAdded is called once the channel exists, in its own goroutine
+	// so the watcher can subscribe to it through the broker.
+	ChannelAdded(route, channel string)
+}
+
+// conduits holds the registered conduits by address.
+var conduits sync.Map // map[string]Conduit
+
+// RegisterConduit makes the conduit subscribable and returns the address to
+// subscribe it with.
+func RegisterConduit(c Conduit) string {
+	address := connScheme + uuid.New().String()
+	conduits.Store(address, c)
+	return address
+}
+
+// UnregisterConduit removes the conduit so it can no longer be subscribed.
+// Existing subscriptions stop delivering and should be removed by the caller.
+func UnregisterConduit(address string) {
+	conduits.Delete(address)
+}
+
+// channelAdded tells the registered ChannelWatchers of a new channel.
+func channelAdded(route, channel string) {
+	conduits.Range(func(_, v any) bool {
+		if w, ok := v.(ChannelWatcher); ok {
+			go w.ChannelAdded(route, channel)
+		}
+		return true
+	})
+}
+
+// conduitSink is the sink for a subscriber bound to a conduit.
+type conduitSink struct {
+	address string
+	route   string
+	channel string
+}
+
+func newConduitSink(route, channel, address string) (*conduitSink, error) {
+	if _, ok := conduits.Load(address); !ok {
+		return nil, errors.New("no connection is registered for " + address)
+	}
+	return &conduitSink{address: address, route: route, channel: channel}, nil
+}
+
+func (cs *conduitSink) write(obj *rhizome.Object) error {
+	v, ok := conduits.Load(cs.address)
+	if !ok {
+		return errors.New("connection closed")
+	}
+	return v.(Conduit).Push(cs.route, cs.channel, obj)
+}
+
+func (cs *conduitSink) close() error { return nil }
@@ -2,14 +2,20 @@ package routing
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"sync"
 	"time"
+
+	"mycelia/comm"
 )
 
 // Pool is a per-address connection pool. It reuses TCP connections and
 // redials only when the pool is empty or a connection is unhealthy/expired.
+//
+// Addresses with the comm.TLSScheme prefix are dialed over TLS; the pooled
+// connections have already completed the handshake.
 type Pool struct {
 	pools sync.Map // map[string]*addrPool
 
@@ -25,8 +31,10 @@ type addrPool struct {
 	addr   string
 	ch     chan net.Conn // The pool
 	dialer *net.Dialer
+	tlsCfg *tls.Config // nil dials plain TCP
 	idleTO time.Duration
 	mu     sync.Mutex
+	closed bool // Set once the pool is closed, returned conns are closed.
 
 	// track last-used to evict stale conns when returned
 	lastUsed map[net.Conn]time.Time
@@ -54,26 +62,37 @@ func NewPool() *Pool {
 // tracking the per-address pools.
 var globalConnPool = NewPool()
 
-func (p *Pool) getAddrPool(addr string) *addrPool {
+// getAddrPool returns the pool for addr, creating it if needed. Errors if addr
+// is a TLS address whose settings cannot be loaded.
+func (p *Pool) getAddrPool(addr string) (*addrPool, error) {
 	v, ok := p.pools.Load(addr)
 	if ok {
-		return v.(*addrPool)
+		return v.(*addrPool), nil
+	}
+
+	hostport, tlsCfg, err := comm.ParseDialAddress(addr)
+	if err != nil {
+		return nil, err
 	}
 	ap := &addrPool{
-		addr:     addr,
+		addr:     hostport,
 		ch:       make(chan net.Conn, p.MaxPerAddr),
 		dialer:   &net.Dialer{Timeout: p.DialTimeout, KeepAlive: p.KeepAlive},
+		tlsCfg:   tlsCfg,
 		idleTO:   p.IdleTimeout,
 		lastUsed: make(map[net.Conn]time.Time),
 	}
 	// publish-or-use the winner
 	actual, _ := p.pools.LoadOrStore(addr, ap)
-	return actual.(*addrPool)
+	return actual.(*addrPool), nil
 }
 
 // Get borrows a connection for addr (reused if available, else it dials).
 func (p *Pool) Get(ctx context.Context, addr string) (*Borrowed, error) {
-	ap := p.getAddrPool(addr)
+	ap, err := p.getAddrPool(addr)
+	if err != nil {
+		return nil, err
+	}
 
 	select {
 	case c := <-ap.ch:
@@ -98,7 +117,7 @@ func (p *Pool) Get(ctx context.Context, addr string) (*Borrowed, error) {
 
 	done := make(chan dialRes, 1)
 	go func() {
-		c, e := ap.dialer.DialContext(ctx, "tcp", addr)
+		c, e := ap.dial(ctx)
 		done <- dialRes{c: c, err: e}
 	}()
 
@@ -113,6 +132,37 @@ func (p *Pool) Get(ctx context.Context, addr string) (*Borrowed, error) {
 	}
 }
 
+// dial opens a new connection, completing the TLS handshake for TLS addresses.
+func (ap *addrPool) dial(ctx context.Context) (net.Conn, error) {
+	if ap.tlsCfg == nil {
+		return ap.dialer.DialContext(ctx, "tcp", ap.addr)
+	}
+	d := &tls.Dialer{NetDialer: ap.dialer, Config: ap.tlsCfg}
+	return d.DialContext(ctx, "tcp", ap.addr)
+}
+
+// Close closes every idle connection and drops the per-address pools.
+// Connections borrowed at the time are closed when they are put back.
+func (p *Pool) Close() {
+	p.pools.Range(func(key, value any) bool {
+		p.pools.Delete(key)
+
+		ap := value.(*addrPool)
+		ap.mu.Lock()
+		ap.closed = true
+		ap.mu.Unlock()
+		for drained := false; !drained; {
+			select {
+			case c := <-ap.ch:
+				_ = c.Close()
+			default:
+				drained = true
+			}
+		}
+		return true
+	})
+}
+
 func (b *Borrowed) Conn() net.Conn { return b.conn }
 func (b *Borrowed) MarkBroken()    { b.broken = true }
 
@@ -121,7 +171,10 @@ func (b *Borrowed) Put() {
 	if b.conn == nil || b.owner == nil {
 		return
 	}
-	if b.broken {
+	b.owner.mu.Lock()
+	closed := b.owner.closed
+	b.owner.mu.Unlock()
+	if b.broken || closed {
 		_ = b.conn.Close()
 		return
 	}
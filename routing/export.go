@@ -0,0 +1,162 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/system"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the config export, a snapshot of the running broker written as a
+// Mycelia_Config.json document, and the handling of config objects.
+//
+// The export holds the runtime parameters, the live routes, and the configured
+// sources, so starting a broker from it gives one with the same shape.
+// Security tokens, roles, principals, and token keys are left out, as they
+// hold secrets that do not belong in a file meant for version control.
+// Subscribers bound to a gateway connection are left out as well.
+//
+// Exports and apply reports are only written under globals.ExportDir, so a
+// client cannot have the broker overwrite files anywhere else.
+// -----------------------------------------------------------------------------
+
+// defaultExportFile is where exports without a path are written, relative to
+// globals.ExportDir.
+const defaultExportFile = "Mycelia_Export.json"
+
+// exportPath resolves the path of an export or apply report, which has to be
+// relative and inside globals.ExportDir.
+func exportPath(name string) (string, error) {
+	if globals.ExportDir == "" {
+		return "", errors.New("writing exports is disabled, see -export-dir")
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf(
+			"path %q must be a relative path inside the export directory", name,
+		)
+	}
+	return filepath.Join(comm.ResolvePath(globals.ExportDir), name), nil
+}
+
+// Export returns the broker's live topology and runtime parameters encoded as
+// a config file.
+func (b *Broker) Export() ([]byte, error) {
+	params := system.NewParamData()
+	params.SecurityToken = nil
+	params.LogOutput = &globals.LogOutput
+
+	routes := b.Topology()
+	sd := &system.SystemData{Parameters: params, Routes: &routes}
+	if len(system.SourceList) > 0 {
+		sources := slices.Clone(system.SourceList)
+		sd.Sources = &sources
+	}
+
+	data, err := json.MarshalIndent(sd, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// ExportConfig returns the encoded export for the responder's connection,
+// which needs PermExportConfig.
+func (b *Broker) ExportConfig(resp *rhizome.ConnResponder) ([]byte, error) {
+	p := b.principalOf(&rhizome.Object{Responder: resp})
+	if p == nil || !p.can(globals.PermExportConfig, "") {
+		return nil, ErrUnauthorized
+	}
+	return b.Export()
+}
+
+func (b *Broker) handleConfig(obj *rhizome.Object) {
+	switch obj.CmdType {
+
+	case globals.CmdExport:
+		// Args: path, nil, nil, nil
+		path := obj.Arg1
+		if path == "" {
+			path = defaultExportFile
+		}
+
+		ack := globals.AckExported
+		file, err := exportPath(path)
+		if err == nil {
+			path = file
+			var data []byte
+			if data, err = b.Export(); err == nil {
+				err = system.WriteFileAtomic(path, data)
+			}
+		}
+		if err != nil {
+			ack = globals.AckExportFailed
+			logging.LogObjectWarning(
+				fmt.Sprintf("Could not export config to %s: %s", path, err),
+				obj.UID,
+			)
+		} else {
+			logging.LogObjectAction(
+				fmt.Sprintf("Exported config to %s", path), obj.UID,
+			)
+		}
+
+		if obj.Responder != nil {
+			err := obj.ResponeWithAck(ack)
+			LogPossibleAckError(obj, err)
+		}
+
+	case globals.CmdApply:
+		// Args: options, report path, nil, nil
+		var path string
+		var err error
+		if obj.Arg2 != "" {
+			path, err = exportPath(obj.Arg2)
+		}
+		if err != nil {
+			obj.Response.Ack = globals.AckApplyFailed
+			logging.LogObjectWarning(
+				fmt.Sprintf("Refused config apply: %s", err), obj.UID,
+			)
+		} else if report, _ := b.apply(obj, nil); path != "" {
+			writeApplyReport(obj, path, report)
+		}
+
+		if obj.Responder != nil {
+			err := obj.ResponeWithAck(obj.Response.Ack)
+			LogPossibleAckError(obj, err)
+		}
+
+	default:
+		from := "internal"
+		if obj.Responder != nil {
+			from = obj.Responder.RemoteAddr()
+		}
+		logging.LogObjectWarning(
+			fmt.Sprintf("Unknown command type for config from %s", from),
+			obj.UID,
+		)
+	}
+}
+
+// writeApplyReport writes the report of a CmdApply object to path.
+func writeApplyReport(obj *rhizome.Object, path string, report *ApplyReport) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = system.WriteFileAtomic(path, append(data, '\n'))
+	}
+	if err != nil {
+		logging.LogObjectWarning(
+			fmt.Sprintf("Could not write apply report to %s: %s", path, err),
+			obj.UID,
+		)
+	}
+}
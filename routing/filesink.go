@@ -0,0 +1,433 @@
+package routing
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the file sink, a subscriber that archives every delivery it is
+// handed to local disk instead of dialing out.
+//
+// File subscribers are addressed like:
+//
+//	file:orders/orders.jsonl?format=jsonl&max-size=64MB&max-age=1h&gzip=true&fsync=1s
+//
+// Paths are relative to globals.FileSinkDir and cannot leave it, so clients
+// adding subscribers cannot write anywhere else. FileSinkDir is empty unless
+// set, which disables file subscribers.
+//
+//	format   - jsonl (default) or u32 for big-endian u32 length-prefixed
+//	           payloads, the same framing the broker reads from clients.
+//	max-size - Rotate once the active segment reaches this many bytes.
+//	           Accepts KB, MB, and GB suffixes. 0 disables. Default 64MB.
+//	max-age  - Rotate once the active segment is this old. 0 disables.
+//	gzip     - Compress rotated segments.
+//	fsync    - always, never (default), or an interval such as 500ms.
+// -----------------------------------------------------------------------------
+
+const fileScheme = "file:"
+
+const (
+	fileFormatJSONL = "jsonl"
+	fileFormatU32   = "u32"
+)
+
+const defaultFileMaxSize = 64 * globals.BytesInMegabyte
+
+// fsyncAlways and fsyncNever are the sentinel fsync intervals; any positive
+// value syncs at most once per interval.
+const (
+	fsyncNever  time.Duration = 0
+	fsyncAlways time.Duration = -1
+)
+
+type fileSinkOptions struct {
+	path    string
+	format  string
+	maxSize int64
+	maxAge  time.Duration
+	gzip    bool
+	fsync   time.Duration
+}
+
+// fileRecord is the jsonl representation of an archived delivery.
+type fileRecord struct {
+	Time    time.Time `json:"time"`
+	UID     string    `json:"uid"`
+	Route   string    `json:"route"`
+	Arg2    string    `json:"arg2,omitempty"`
+	Arg3    string    `json:"arg3,omitempty"`
+	Arg4    string    `json:"arg4,omitempty"`
+	Payload []byte    `json:"payload"`
+}
+
+type fileSink struct {
+	mutex sync.Mutex
+	opts  fileSinkOptions
+	refs  int
+
+	file     *os.File
+	size     int64
+	opened   time.Time
+	lastSync time.Time
+}
+
+// Open file sinks keyed by their absolute path so that the same file added to
+// multiple channels shares one writer.
+var (
+	fileSinksMutex sync.Mutex
+	fileSinks      = map[string]*fileSink{}
+)
+
+// acquireFileSink returns the shared sink for the address, creating it if no
+// other subscriber has it open. Each acquire must be paired with a close().
+// Errors if the file is open with other options.
+func acquireFileSink(address string) (*fileSink, error) {
+	opts, err := parseFileAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	fileSinksMutex.Lock()
+	defer fileSinksMutex.Unlock()
+
+	fs, exists := fileSinks[opts.path]
+	if exists && fs.opts != opts {
+		return nil, fmt.Errorf(
+			"file sink %s is already open with other options", opts.path,
+		)
+	}
+	if !exists {
+		fs = &fileSink{opts: opts}
+		fileSinks[opts.path] = fs
+	}
+	fs.refs++
+
+	return fs, nil
+}
+
+// parseFileAddress parses a file: subscriber address into its sink options.
+func parseFileAddress(address string) (fileSinkOptions, error) {
+	opts := fileSinkOptions{
+		format:  fileFormatJSONL,
+		maxSize: defaultFileMaxSize,
+		fsync:   fsyncNever,
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return opts, fmt.Errorf("invalid file address %q: %w", address, err)
+	}
+
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return opts, fmt.Errorf("file address %q has no path", address)
+	}
+	if globals.FileSinkDir == "" {
+		return opts, errors.New("file subscribers are disabled, see -sink-dir")
+	}
+	if !filepath.IsLocal(path) {
+		return opts, fmt.Errorf(
+			"file address %q must be a relative path inside the sink directory",
+			address,
+		)
+	}
+	opts.path = filepath.Join(comm.ResolvePath(globals.FileSinkDir), path)
+
+	q := u.Query()
+	if v := q.Get("format"); v != "" {
+		if v != fileFormatJSONL && v != fileFormatU32 {
+			return opts, fmt.Errorf("unknown file format %q", v)
+		}
+		opts.format = v
+	}
+	if v := q.Get("max-size"); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.maxSize = n
+	}
+	if v := q.Get("max-age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid max-age %q: %w", v, err)
+		}
+		opts.maxAge = d
+	}
+	if v := q.Get("gzip"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid gzip value %q: %w", v, err)
+		}
+		opts.gzip = b
+	}
+	switch v := q.Get("fsync"); v {
+	case "", "never":
+		opts.fsync = fsyncNever
+	case "always":
+		opts.fsync = fsyncAlways
+	default:
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid fsync policy %q", v)
+		}
+		opts.fsync = d
+	}
+
+	return opts, nil
+}
+
+// parseByteSize parses sizes such as 512, 10KB, 64MB, or 1GB.
+func parseByteSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{
+		{"GB", 1024 * globals.BytesInMegabyte},
+		{"MB", globals.BytesInMegabyte},
+		{"KB", globals.BytesInKilobyte},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			mult = unit.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// write appends the delivery to the active segment, rotating first if the
+// segment has outgrown its size or age limit.
+func (fs *fileSink) write(obj *rhizome.Object) error {
+	record, err := fs.encode(obj)
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.file != nil && fs.shouldRotate(int64(len(record))) {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	if fs.file == nil {
+		if err := fs.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := fs.file.Write(record)
+	fs.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return fs.maybeSync()
+}
+
+func (fs *fileSink) encode(obj *rhizome.Object) ([]byte, error) {
+	switch fs.opts.format {
+
+	case fileFormatU32:
+		buf := make([]byte, 4+len(obj.Payload))
+		binary.BigEndian.PutUint32(buf, uint32(len(obj.Payload)))
+		copy(buf[4:], obj.Payload)
+		return buf, nil
+
+	default:
+		rec := fileRecord{
+			Time:    time.Now().UTC(),
+			UID:     obj.UID,
+			Route:   obj.Arg1,
+			Arg2:    obj.Arg2,
+			Arg3:    obj.Arg3,
+			Arg4:    obj.Arg4,
+			Payload: obj.Payload,
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	}
+}
+
+func (fs *fileSink) shouldRotate(next int64) bool {
+	if fs.size == 0 {
+		return false
+	}
+	if fs.opts.maxSize > 0 && fs.size+next > fs.opts.maxSize {
+		return true
+	}
+	if fs.opts.maxAge > 0 && time.Since(fs.opened) >= fs.opts.maxAge {
+		return true
+	}
+	return false
+}
+
+// open opens, or creates, the active segment for appending.
+func (fs *fileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(fs.opts.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(
+		fs.opts.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644,
+	)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	fs.file = f
+	fs.size = info.Size()
+	fs.opened = time.Now()
+	if fs.size > 0 {
+		fs.opened = info.ModTime()
+	}
+	fs.lastSync = time.Now()
+	return nil
+}
+
+// rotate closes the active segment and renames it with a timestamp suffix,
+// compressing it in the background if gzip is enabled.
+func (fs *fileSink) rotate() error {
+	if err := fs.closeFile(); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(fs.opts.path)
+	base := strings.TrimSuffix(fs.opts.path, ext)
+	stamp := time.Now().UTC().Format("20060102T150405.000000000")
+	rotated := fmt.Sprintf("%s-%s%s", base, stamp, ext)
+	if err := os.Rename(fs.opts.path, rotated); err != nil {
+		return err
+	}
+	logging.LogSystemAction(fmt.Sprintf("Rotated file sink to %s", rotated))
+
+	if fs.opts.gzip {
+		go compressSegment(rotated)
+	}
+	return nil
+}
+
+func (fs *fileSink) maybeSync() error {
+	switch {
+	case fs.opts.fsync == fsyncNever:
+		return nil
+	case fs.opts.fsync == fsyncAlways:
+		return fs.file.Sync()
+	case time.Since(fs.lastSync) >= fs.opts.fsync:
+		fs.lastSync = time.Now()
+		return fs.file.Sync()
+	}
+	return nil
+}
+
+func (fs *fileSink) closeFile() error {
+	if fs.file == nil {
+		return nil
+	}
+	syncErr := error(nil)
+	if fs.opts.fsync != fsyncNever {
+		syncErr = fs.file.Sync()
+	}
+	closeErr := fs.file.Close()
+	fs.file = nil
+	fs.size = 0
+	return errors.Join(syncErr, closeErr)
+}
+
+// close releases one reference to the sink, closing the active segment once
+// no subscriber uses it anymore.
+func (fs *fileSink) close() error {
+	fileSinksMutex.Lock()
+	fs.refs--
+	last := fs.refs <= 0
+	if last {
+		delete(fileSinks, fs.opts.path)
+	}
+	fileSinksMutex.Unlock()
+
+	if !last {
+		return nil
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.closeFile()
+}
+
+// compressSegment gzips the rotated segment at path and removes the original.
+func compressSegment(path string) {
+	if err := gzipFile(path); err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Could not compress segment %s: %s", path, err),
+		)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Could not remove compressed segment %s: %s", path, err),
+		)
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	err = errors.Join(err, zw.Close(), out.Sync(), out.Close())
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path+".gz")
+}
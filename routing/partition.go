@@ -17,6 +17,7 @@ type partition struct {
 	route   *route
 	channel *channel
 	in      chan *rhizome.Object
+	done    chan struct{}
 	wg      sync.WaitGroup
 }
 
@@ -24,70 +25,115 @@ func newPartition(r *route, c *channel) *partition {
 	return &partition{
 		route:   r,
 		channel: c,
+		in:      make(chan *rhizome.Object, globals.PartitionChanSize),
+		done:    make(chan struct{}),
 	}
 }
 
 func (p *partition) start() { p.wg.Add(1); go p.loop() }
-func (p *partition) stop()  { close(p.in); p.wg.Wait() }
+
+// stop ends the loop once the deliveries already queued are handled.
+// partition.in is never closed, so a send racing a stop cannot panic.
+func (p *partition) stop() { close(p.done); p.wg.Wait() }
+
+// send queues m for the loop. Deliveries sent after the partition is stopped
+// are dropped.
+func (p *partition) send(m *rhizome.Object) {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	select {
+	case p.in <- m:
+	case <-p.done:
+	}
+}
 
 // Should be called as a go routine so the partition worker is always working.
-// It can be fed messages through partition.in which will be processed by the
-// loop. Remember to call partition.stop() to close loop + channel and shutdown.
+// It can be fed messages through partition.send which will be processed by the
+// loop. Remember to call partition.stop() to end the loop and shutdown.
 func (p *partition) loop() {
 	defer p.wg.Done()
-	for m := range p.in {
-		if m == nil {
-			continue
+	for {
+		select {
+		case m := <-p.in:
+			p.handle(m)
+		case <-p.done:
+			for {
+				select {
+				case m := <-p.in:
+					p.handle(m)
+				default:
+					return
+				}
+			}
 		}
+	}
+}
 
-		var err error
+// handle runs m through the channel's transformers and delivers it to the
+// selected subscribers.
+func (p *partition) handle(m *rhizome.Object) {
+	if m == nil {
+		return
+	}
+	if p.route.broker.pastDeadline() {
+		p.route.broker.spill.write(p.route.name, p.channel.name, m)
+		return
+	}
 
-		ts := p.channel.loadTransformers()
-		result := m
-		for _, t := range ts {
-			result, err = t.apply(result)
-			if err != nil {
-				continue
-			}
-		}
-		if result == nil {
+	var err error
+
+	ts := p.channel.loadTransformers()
+	result := m
+	for _, t := range ts {
+		result, err = t.apply(result)
+		if err != nil {
 			continue
 		}
+	}
+	if result == nil {
+		return
+	}
 
-		ss := p.channel.selectSubscribers()
-		var wg sync.WaitGroup
-		wg.Add(len(ss))
+	ss := p.channel.selectSubscribers()
+	var wg sync.WaitGroup
+	wg.Add(len(ss))
 
-		for _, sub := range ss {
-			s := sub // capture - loops use pointers for tracking
-			msg := result
+	for _, sub := range ss {
+		s := sub // capture - loops use pointers for tracking
+		msg := result
 
-			go func() {
-				defer wg.Done()
-				s.deliver(msg)
-			}()
-		}
+		go func() {
+			defer wg.Done()
+			s.deliver(msg)
+		}()
+	}
 
-		wg.Wait()
-
-		// pass to next channel
-		if next := p.route.getNextChannel(p.channel); next != nil {
-			next.enqueue(result)
-		} else {
-			// If no remaining channels, inform sender the message was sent.
-			if result.AckPlcy == globals.AckPlcyOnsent {
-				result.Response.Ack = globals.AckSent
-				payload, err := rhizome.EncodeResponse(result)
-				if err != nil {
-					logging.LogSystemError(
-						fmt.Sprintf("could not encode msg from %s", result.Responder.RemoteAddr()),
-					)
-				}
-				err = result.Responder.Write(payload)
-				if err != nil {
-					m := fmt.Sprintf("Unable to write to %s: %s", result.Responder.RemoteAddr(), err)
-					logging.LogObjectWarning(m, result.UID)
-				}
+	wg.Wait()
+
+	// pass to next channel, unless the delivery was sent to this one alone.
+	next := p.route.getNextChannel(p.channel)
+	if result.CmdType == globals.CmdSendChannel {
+		next = nil
+	}
+	if next != nil {
+		next.enqueue(result)
+	} else {
+		// If no remaining channels, inform sender the message was sent.
+		if result.AckPlcy == globals.AckPlcyOnsent {
+			result.Response.Ack = globals.AckSent
+			payload, err := rhizome.EncodeResponse(result)
+			if err != nil {
+				logging.LogSystemError(
+					fmt.Sprintf("could not encode msg from %s", result.Responder.RemoteAddr()),
+				)
+			}
+			err = result.Responder.Write(payload)
+			if err != nil {
+				m := fmt.Sprintf("Unable to write to %s: %s", result.Responder.RemoteAddr(), err)
+				logging.LogObjectWarning(m, result.UID)
 			}
 		}
 	}
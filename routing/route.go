@@ -63,7 +63,8 @@ func (r *route) getChannel(name string) *channel {
 }
 
 // Creates a new channel and adds it to the route from the given obj.
-// Arg2 is the channel name, arg3 is the selection strategy.
+// Arg2 is the channel name, arg3 is the selection strategy, or empty for
+// globals.DefaultStrategy.
 //
 // If the channel already exists, a response is sent with an ack value of
 // globals.ACK_TYPE_CHANNEL_ALREADY_EXISTS.
@@ -88,21 +89,43 @@ func (r *route) createChannel(obj *rhizome.Object) {
 		return
 	}
 
-	i, err := strconv.Atoi(obj.Arg3)
-	if err != nil {
-		logging.LogObjectWarning(
-			fmt.Sprintf(
-				"Unable to parse new channel selection strategy from %s",
-				obj.Responder.RemoteAddr(),
-			), obj.UID,
-		)
+	strat := globals.DefaultStrategy
+	if obj.Arg3 != "" {
+		i, err := strconv.Atoi(obj.Arg3)
+		if err == nil {
+			strat = globals.SelectionStrategy(i)
+		} else {
+			from := "internal"
+			if obj.Responder != nil {
+				from = obj.Responder.RemoteAddr()
+			}
+			logging.LogObjectWarning(
+				fmt.Sprintf(
+					"Unable to parse new channel selection strategy from %s",
+					from,
+				), obj.UID,
+			)
+		}
 	}
-	strat := globals.SelectionStrategy(i)
 
 	ch = newChannel(r, obj.Arg2, globals.DefaultNumPartitions, strat)
 	r.mutex.Lock()
 	r.channels = append(r.channels, ch)
 	r.mutex.Unlock()
+
+	channelAdded(r.name, ch.name)
+}
+
+// orderChannels reorders the route's channels whose names are listed to the
+// listed order. Channels that are not listed keep their place.
+func (r *route) orderChannels(names []string) {
+	r.mutex.Lock()
+	r.channels = orderBy(r.channels, names,
+		func(ch *channel) string { return ch.name },
+	)
+	r.mutex.Unlock()
+
+	logging.LogSystemAction(fmt.Sprintf("Reordered channels of route %s", r.name))
 }
 
 // Returns the channel in next sequential order after the given channel.
@@ -6,6 +6,7 @@ import (
 	"slices"
 	"time"
 
+	"mycelia/comm"
 	"mycelia/errgo"
 	"mycelia/globals"
 	"mycelia/logging"
@@ -30,12 +31,30 @@ type runtimeUpdater struct {
 	PrintTree        *bool            `json:"print-tree"`
 	TransformTimeout *string          `json:"xform-timeout"`
 	AutoConsolidate  *bool            `json:"consolidate"`
+
+	Listeners *[]listenerUpdate `json:"listeners"`
+
+	AllowCIDRs          *[]string `json:"allow-cidrs"`
+	DenyCIDRs           *[]string `json:"deny-cidrs"`
+	MaxConnections      *int      `json:"max-conns"`
+	MaxConnectionsPerIP *int      `json:"max-conns-per-ip"`
+	ConnectionRate      *float64  `json:"conn-rate"`
+	ConnectionBurst     *int      `json:"conn-burst"`
+}
+
+// listenerUpdate adds or rebinds the listener of the same name, or closes it
+// when Remove is set.
+type listenerUpdate struct {
+	globals.Listener
+	Remove bool `json:"remove"`
 }
 
 // Verify that the values and sender are valid and then update the globals, if
 // they are.
+// Authenticated connections are trusted; anonymous ones must carry a valid
+// security token in the payload.
 // Returns if the user was verified or not.
-func updateGlobals(obj *rhizome.Object) bool {
+func updateGlobals(obj *rhizome.Object, p *principal) bool {
 	var rv runtimeUpdater
 	err := json.Unmarshal(obj.Payload, &rv)
 	if err != nil {
@@ -48,14 +67,16 @@ func updateGlobals(obj *rhizome.Object) bool {
 	}
 
 	// Is user authorized
-	if rv.SecurityToken == nil {
-		logging.LogObjectError(
-			fmt.Sprintf("Message lacks security token from %s",
-				obj.Responder.RemoteAddr(),
-			), obj.UID,
-		)
-	} else {
-		if !slices.Contains(globals.SecurityTokens, *rv.SecurityToken) {
+	if p == nil {
+		if rv.SecurityToken == nil {
+			logging.LogObjectError(
+				fmt.Sprintf("Message lacks security token from %s",
+					obj.Responder.RemoteAddr(),
+				), obj.UID,
+			)
+			return false
+		}
+		if !validToken(*rv.SecurityToken) {
 			logging.LogObjectError(
 				fmt.Sprintf(
 					"Unauthorized user attempting globals update from %s",
@@ -100,4 +121,88 @@ func unpackGlobals(ru runtimeUpdater, sender string) {
 	if ru.AutoConsolidate != nil {
 		globals.AutoConsolidate = *ru.AutoConsolidate
 	}
+	if ru.Listeners != nil {
+		unpackListeners(*ru.Listeners, sender)
+	}
+	unpackAdmission(ru, sender)
+}
+
+// Merge the listener updates into globals.Listeners by name. Invalid listeners
+// are ignored with a warning. The server opens, rebinds, and closes listeners
+// to match afterwards.
+func unpackListeners(updates []listenerUpdate, sender string) {
+	listeners := slices.Clone(globals.Listeners)
+	for _, u := range updates {
+		i := slices.IndexFunc(listeners, func(l globals.Listener) bool {
+			return l.Name == u.Name
+		})
+
+		if u.Remove {
+			if i >= 0 {
+				listeners = slices.Delete(listeners, i, i+1)
+			}
+			continue
+		}
+		if err := comm.ValidateListener(u.Listener); err != nil {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Ignoring listener from %s: %s", sender, err),
+			)
+			continue
+		}
+		if i >= 0 {
+			listeners[i] = u.Listener
+		} else {
+			listeners = append(listeners, u.Listener)
+		}
+	}
+	globals.Listeners = listeners
+}
+
+// Unpack the connection admission values into the globals. Invalid CIDR lists
+// and negative limits are ignored with a warning.
+func unpackAdmission(ru runtimeUpdater, sender string) {
+	if ru.AllowCIDRs != nil {
+		if _, err := comm.ParsePrefixes(*ru.AllowCIDRs); err != nil {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Ignoring allow-cidrs from %s: %s", sender, err),
+			)
+		} else {
+			globals.AllowCIDRs = *ru.AllowCIDRs
+		}
+	}
+	if ru.DenyCIDRs != nil {
+		if _, err := comm.ParsePrefixes(*ru.DenyCIDRs); err != nil {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Ignoring deny-cidrs from %s: %s", sender, err),
+			)
+		} else {
+			globals.DenyCIDRs = *ru.DenyCIDRs
+		}
+	}
+
+	setLimit := func(name string, v *int, dst *int) {
+		if v == nil {
+			return
+		}
+		if *v < 0 {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Ignoring negative %s from %s", name, sender),
+			)
+			return
+		}
+		*dst = *v
+	}
+	setLimit("max-conns", ru.MaxConnections, &globals.MaxConnections)
+	setLimit("max-conns-per-ip", ru.MaxConnectionsPerIP, &globals.MaxConnectionsPerIP)
+	setLimit("conn-burst", ru.ConnectionBurst, &globals.ConnectionBurst)
+
+	if ru.ConnectionRate != nil {
+		if *ru.ConnectionRate < 0 {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Ignoring negative conn-rate from %s", sender),
+			)
+		} else {
+			globals.ConnectionRate = *ru.ConnectionRate
+		}
+	}
 }
@@ -0,0 +1,109 @@
+package routing
+
+import (
+	"sort"
+
+	"mycelia/globals"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the read-only view of the broker's routing structure, for
+// components outside the routing package that need to inspect it.
+// -----------------------------------------------------------------------------
+
+// RouteShape is a point-in-time copy of a route and its channels.
+type RouteShape struct {
+	Name     string         `json:"name"`
+	Channels []ChannelShape `json:"channels"`
+}
+
+// ChannelShape is a point-in-time copy of a channel's components.
+type ChannelShape struct {
+	Name         string   `json:"name"`
+	Strategy     string   `json:"strategy"`
+	Transformers []string `json:"transformers"`
+	Subscribers  []string `json:"subscribers"`
+}
+
+// Shape returns a copy of the broker's routes sorted by name. Channels keep
+// their route order, as that is the order deliveries travel through them.
+func (b *Broker) Shape() []RouteShape {
+	b.mutex.RLock()
+	routes := make([]*route, 0, len(b.routes))
+	for _, r := range b.routes {
+		routes = append(routes, r)
+	}
+	b.mutex.RUnlock()
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].name < routes[j].name
+	})
+
+	shape := make([]RouteShape, 0, len(routes))
+	for _, r := range routes {
+		shape = append(shape, r.shape())
+	}
+	return shape
+}
+
+// ShapeFor returns Shape for the sender behind resp. The shape lists every
+// route, channel, and subscriber address, so once access control is configured
+// or auth is required, only senders that may export the config may read it.
+func (b *Broker) ShapeFor(resp *rhizome.ConnResponder) ([]RouteShape, error) {
+	if AccessConfigured() || globals.RequireAuth {
+		p := b.principalOf(&rhizome.Object{Responder: resp})
+		if p == nil || !p.can(globals.PermExportConfig, "") {
+			return nil, ErrUnauthorized
+		}
+	}
+	return b.Shape(), nil
+}
+
+// FindChannel returns a copy of the channel on the route, if there is one.
+func (b *Broker) FindChannel(route, channel string) (ChannelShape, bool) {
+	b.mutex.RLock()
+	r, ok := b.routes[route]
+	b.mutex.RUnlock()
+	if !ok {
+		return ChannelShape{}, false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, ch := range r.channels {
+		if ch.name == channel {
+			return ch.shape(), true
+		}
+	}
+	return ChannelShape{}, false
+}
+
+func (r *route) shape() RouteShape {
+	r.mutex.RLock()
+	channels := append([]*channel(nil), r.channels...)
+	r.mutex.RUnlock()
+
+	rs := RouteShape{Name: r.name, Channels: []ChannelShape{}}
+	for _, ch := range channels {
+		rs.Channels = append(rs.Channels, ch.shape())
+	}
+	return rs
+}
+
+func (ch *channel) shape() ChannelShape {
+	cs := ChannelShape{
+		Name:         ch.name,
+		Strategy:     ch.loadSelector().GetStrategyName(),
+		Transformers: []string{},
+		Subscribers:  []string{},
+	}
+	for _, t := range ch.loadTransformers() {
+		cs.Transformers = append(cs.Transformers, t.Address)
+	}
+	for _, s := range ch.loadSubscribers() {
+		cs.Subscribers = append(cs.Subscribers, s.Address)
+	}
+	return cs
+}
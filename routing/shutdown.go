@@ -0,0 +1,271 @@
+package routing
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/system"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is how the broker shuts down and how it picks up what a previous run
+// could not deliver.
+//
+// Closing the broker stops it taking objects, then stops every route's
+// channels in order so each channel's partitions flush their queues into the
+// next channel before it is stopped. Deliveries still queued once the shutdown
+// deadline passes are written to the undelivered log instead of to their
+// subscribers, and are replayed onto the channel they were waiting on the next
+// time the broker starts.
+// -----------------------------------------------------------------------------
+
+// undeliveredLogName is the undelivered log's file name in the log directory.
+const undeliveredLogName = "undelivered.jsonl"
+
+// ErrShuttingDown is returned for objects handed to a closed broker.
+var ErrShuttingDown = errors.New("broker is shutting down")
+
+// UndeliveredLogPath is where deliveries left queued at shutdown are written.
+func UndeliveredLogPath() string {
+	return filepath.Join(globals.LogDirectory, undeliveredLogName)
+}
+
+// Close stops the broker handling objects and drains its routes, delivering
+// what is queued until the deadline and writing the rest to the undelivered
+// log. Writes the state file one last time and closes the subscriber
+// connection pool once every partition has stopped.
+// Returns how many deliveries were written to the undelivered log.
+func (b *Broker) Close(deadline time.Time) (int, error) {
+	// Waits on objects being handled, nothing is handled after this.
+	b.gate.Lock()
+	b.closed = true
+	b.gate.Unlock()
+	b.state.flush()
+
+	b.spill = &spillLog{path: UndeliveredLogPath()}
+	b.closeBy.Store(deadline.UnixNano())
+
+	b.mutex.RLock()
+	routes := slices.Collect(maps.Values(b.routes))
+	b.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, r := range routes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.close()
+		}()
+	}
+	wg.Wait()
+
+	globalConnPool.Close()
+	return b.spill.close()
+}
+
+// pastDeadline reports whether the broker is closing and out of time to
+// deliver what is still queued.
+func (b *Broker) pastDeadline() bool {
+	by := b.closeBy.Load()
+	return by != 0 && time.Now().UnixNano() > by
+}
+
+// close stops the route's channels first to last, so deliveries flushed from
+// one channel still reach the next, and then its dead-letter channel.
+func (r *route) close() {
+	r.mutex.RLock()
+	channels := slices.Clone(r.channels)
+	r.mutex.RUnlock()
+
+	for _, ch := range channels {
+		ch.close()
+	}
+	r.deadLetter.close()
+}
+
+// -------Undelivered Log-------------------------------------------------------
+
+// undeliveredRecord is a delivery that was still queued on a channel when the
+// broker shut down.
+type undeliveredRecord struct {
+	Time    time.Time `json:"time"`
+	Route   string    `json:"route"`
+	Channel string    `json:"channel"`
+	UID     string    `json:"uid"`
+	Arg2    string    `json:"arg2,omitempty"`
+	Arg3    string    `json:"arg3,omitempty"`
+	Arg4    string    `json:"arg4,omitempty"`
+	Payload []byte    `json:"payload"`
+
+	// Targeted deliveries were sent to the channel alone, CmdSendChannel.
+	Targeted bool `json:"targeted,omitempty"`
+}
+
+// spillLog appends deliveries to the undelivered log, opening it on first use.
+type spillLog struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	written int
+	lost    int
+	err     error
+}
+
+func (sl *spillLog) write(route, channel string, obj *rhizome.Object) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if sl.file == nil && sl.err == nil {
+		sl.file, sl.err = os.OpenFile(
+			sl.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600,
+		)
+		if sl.err != nil {
+			logging.LogSystemError(fmt.Sprintf(
+				"Could not open undelivered log %s: %s", sl.path, sl.err,
+			))
+		}
+	}
+	if sl.err != nil {
+		sl.lost++
+		return
+	}
+
+	line, err := json.Marshal(undeliveredRecord{
+		Time:    time.Now().UTC(),
+		Route:   route,
+		Channel: channel,
+		UID:     obj.UID,
+		Arg2:    obj.Arg2,
+		Arg3:    obj.Arg3,
+		Arg4:    obj.Arg4,
+		Payload: obj.Payload,
+
+		Targeted: obj.CmdType == globals.CmdSendChannel,
+	})
+	if err == nil {
+		_, err = sl.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logging.LogObjectWarning(
+			fmt.Sprintf("Could not write to undelivered log: %s", err), obj.UID,
+		)
+		sl.lost++
+		return
+	}
+	sl.written++
+}
+
+// close syncs and closes the log. Errors if any delivery could not be written.
+func (sl *spillLog) close() (int, error) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	var errs []error
+	if sl.file != nil {
+		errs = append(errs, sl.file.Sync(), sl.file.Close())
+		sl.file = nil
+	}
+	if sl.lost > 0 {
+		errs = append(errs, fmt.Errorf(
+			"%d deliveries could not be written to %s", sl.lost, sl.path,
+		))
+	}
+	return sl.written, errors.Join(errs...)
+}
+
+// -------Replay----------------------------------------------------------------
+
+// Replay enqueues the deliveries in the undelivered log at path onto the
+// channels they were waiting on. Deliveries whose channel no longer exists are
+// kept in the log for the next start, the log is removed once it is empty.
+// Returns how many deliveries were replayed.
+func (b *Broker) Replay(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var kept [][]byte
+	replayed := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 64*globals.BytesInMegabyte)
+	for sc.Scan() {
+		var rec undeliveredRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue // Torn by a crash mid-write.
+		}
+
+		ch := b.channelByName(rec.Route, rec.Channel)
+		if ch == nil {
+			kept = append(kept, slices.Clone(sc.Bytes()))
+			continue
+		}
+
+		cmd := globals.CmdSend
+		if rec.Targeted {
+			cmd = globals.CmdSendChannel
+		}
+		obj := rhizome.NewObject(
+			globals.ObjDelivery,
+			cmd,
+			globals.AckPlcyNoreply,
+			rec.UID,
+			rec.Route,
+			rec.Arg2,
+			rec.Arg3,
+			rec.Arg4,
+			rec.Payload,
+		)
+		obj.Version = rhizome.ProtocolV1
+		ch.enqueue(obj)
+		replayed++
+	}
+	_ = f.Close()
+	if err := sc.Err(); err != nil {
+		return replayed, err
+	}
+
+	if len(kept) == 0 {
+		return replayed, os.Remove(path)
+	}
+
+	logging.LogSystemWarning(fmt.Sprintf(
+		"Keeping %d undelivered deliveries in %s, their channels do not exist",
+		len(kept), path,
+	))
+	var data []byte
+	for _, line := range kept {
+		data = append(append(data, line...), '\n')
+	}
+	return replayed, system.WriteFileAtomic(path, data)
+}
+
+// channelByName returns the named channel on the named route, or nil.
+func (b *Broker) channelByName(route, channel string) *channel {
+	b.mutex.RLock()
+	r := b.routes[route]
+	b.mutex.RUnlock()
+
+	if r == nil {
+		return nil
+	}
+	if channel == globals.DeadLetter {
+		return r.deadLetter
+	}
+	return r.getChannel(channel)
+}
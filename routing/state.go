@@ -0,0 +1,159 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/system"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the state file, the broker's live topology persisted so routes
+// added at runtime survive a restart.
+//
+// The state file has the same shape as the config file's "routes" field and is
+// restored through the same path on startup. It is rewritten atomically on
+// every topology change, or every globals.StateInterval if that is set, and
+// once more when the broker closes.
+//
+// Subscribers bound to a gateway connection are not persisted, as the
+// connection does not outlive the broker.
+// -----------------------------------------------------------------------------
+
+type stateWriter struct {
+	broker *Broker
+	kick   chan struct{}
+
+	mutex sync.Mutex
+	dirty bool
+	last  []byte
+}
+
+// newStateWriter creates the broker's state writer, starting it if a state
+// file is configured.
+func newStateWriter(b *Broker) *stateWriter {
+	sw := &stateWriter{
+		broker: b,
+		kick:   make(chan struct{}, 1),
+	}
+	if globals.StateFile != "" {
+		go sw.run()
+	}
+	return sw
+}
+
+// StatePath is the resolved state file path, or "" if it is disabled.
+func StatePath() string {
+	if globals.StateFile == "" {
+		return ""
+	}
+	return comm.ResolvePath(globals.StateFile)
+}
+
+// touch marks the topology as changed.
+func (sw *stateWriter) touch() {
+	if globals.StateFile == "" {
+		return
+	}
+
+	sw.mutex.Lock()
+	sw.dirty = true
+	sw.mutex.Unlock()
+
+	if globals.StateInterval == 0 {
+		select {
+		case sw.kick <- struct{}{}:
+		default: // A write is already pending and will see this change.
+		}
+	}
+}
+
+func (sw *stateWriter) run() {
+	var tick <-chan time.Time
+	if globals.StateInterval > 0 {
+		tick = time.NewTicker(globals.StateInterval).C
+	}
+
+	for {
+		select {
+		case <-sw.kick:
+		case <-tick:
+		}
+		sw.flush()
+	}
+}
+
+// flush writes the topology to the state file if it changed since the last
+// write. Failed writes are logged and retried on the next flush.
+func (sw *stateWriter) flush() {
+	path := StatePath()
+	if path == "" {
+		return
+	}
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	if !sw.dirty {
+		return
+	}
+
+	data, err := json.MarshalIndent(
+		system.StateData{Routes: sw.broker.Topology()}, "", "  ",
+	)
+	if err != nil {
+		logging.LogSystemError(fmt.Sprintf("Could not encode state: %s", err))
+		return
+	}
+	data = append(data, '\n')
+
+	if !bytes.Equal(data, sw.last) {
+		if err := system.WriteFileAtomic(path, data); err != nil {
+			logging.LogSystemError(
+				fmt.Sprintf("Could not write state file %s: %s", path, err),
+			)
+			return
+		}
+		sw.last = data
+	}
+	sw.dirty = false
+}
+
+// Topology returns the broker's routes as they would be written to the config
+// file's "routes" field, leaving out gateway connection subscribers.
+func (b *Broker) Topology() []system.RouteData {
+	shape := b.Shape()
+
+	routes := make([]system.RouteData, 0, len(shape))
+	for _, rs := range shape {
+		rd := system.RouteData{
+			Name:     rs.Name,
+			Channels: make([]system.ChannelData, 0, len(rs.Channels)),
+		}
+		for _, cs := range rs.Channels {
+			cd := system.ChannelData{Name: cs.Name, Strategy: cs.Strategy}
+			for _, addr := range cs.Transformers {
+				cd.Transformers = append(cd.Transformers, system.EndpointData{
+					Address: addr,
+				})
+			}
+			for _, addr := range cs.Subscribers {
+				if strings.HasPrefix(addr, connScheme) {
+					continue
+				}
+				cd.Subscribers = append(cd.Subscribers, system.EndpointData{
+					Address: addr,
+				})
+			}
+			rd.Channels = append(rd.Channels, cd)
+		}
+		routes = append(routes, rd)
+	}
+	return routes
+}
@@ -3,8 +3,10 @@ package routing
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
+	"mycelia/comm"
 	"mycelia/logging"
 
 	"github.com/signal-weave/rhizome"
@@ -14,14 +16,72 @@ import (
 // distributed machine that a delivery will be forwarded to.
 type subscriber struct {
 	Address string
+
+	// sink is set when deliveries are written somewhere other than a dialed
+	// socket, such as a local file. A nil sink means Address is dialed.
+	sink sink
+}
+
+// A sink is a subscriber destination that the broker writes to directly
+// instead of dialing out to an address.
+type sink interface {
+	write(obj *rhizome.Object) error
+	close() error
+}
+
+// newSubscriber creates the subscriber for the given address on route +
+// channel, opening any sink that the address scheme refers to.
+func newSubscriber(route, channel, address string) (*subscriber, error) {
+	s := &subscriber{Address: address}
+
+	switch {
+	case strings.HasPrefix(address, fileScheme):
+		fs, err := acquireFileSink(address)
+		if err != nil {
+			return nil, err
+		}
+		s.sink = fs
+
+	case strings.HasPrefix(address, connScheme):
+		cs, err := newConduitSink(route, channel, address)
+		if err != nil {
+			return nil, err
+		}
+		s.sink = cs
+
+	case strings.HasPrefix(address, comm.TLSScheme):
+		if _, _, err := comm.ParseDialAddress(address); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
 }
 
-func newSubscriber(address string) *subscriber {
-	return &subscriber{Address: address}
+// release frees any resources held by the subscriber's sink.
+func (c *subscriber) release() {
+	if c.sink == nil {
+		return
+	}
+	if err := c.sink.close(); err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Could not close sink for %s: %s", c.Address, err),
+		)
+	}
 }
 
 // Forwards the delivery to the client represented by the consumer object.
 func (c *subscriber) deliver(obj *rhizome.Object) {
+	if c.sink != nil {
+		if err := c.sink.write(obj); err != nil {
+			wMsg := fmt.Sprintf("Error writing to %s: %s", c.Address, err)
+			logging.LogObjectWarning(wMsg, obj.UID)
+			return
+		}
+		logging.LogObjectAction(fmt.Sprintf("Wrote delivery to: %s", c.Address), obj.UID)
+		return
+	}
+
 	logging.LogObjectAction(fmt.Sprintf("Attempting to dial %s", c.Address), obj.UID)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -29,7 +89,9 @@ func (c *subscriber) deliver(obj *rhizome.Object) {
 
 	b, err := globalConnPool.Get(ctx, c.Address)
 	if err != nil {
-		logging.LogObjectWarning(fmt.Sprintf("Could not dial %s", c.Address), obj.UID)
+		logging.LogObjectWarning(
+			fmt.Sprintf("Could not dial %s: %s", c.Address, err), obj.UID,
+		)
 		return
 	}
 	defer b.Put()
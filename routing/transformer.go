@@ -34,7 +34,7 @@ func (t *transformer) apply(obj *rhizome.Object) (*rhizome.Object, error) {
 
 	b, err := globalConnPool.Get(ctx, t.Address)
 	if err != nil {
-		wMsg := fmt.Sprintf("Could not dial transformer %s", t.Address)
+		wMsg := fmt.Sprintf("Could not dial transformer %s: %s", t.Address, err)
 		wErr := errgo.NewError(wMsg, globals.VerbWrn)
 		return obj, wErr // Return original delivery on failure
 	}
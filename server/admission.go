@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the client listener's admission control.
+//
+// Every accepted connection is checked against the allow and deny lists, the
+// global and per address connection limits, and the per address connection
+// rate before it is handed to a worker. Refused connections are closed
+// straight away.
+//
+// The limits are read from the globals on every accept, so a globals update
+// applies to the next connection. Connections already admitted are left open.
+// -----------------------------------------------------------------------------
+
+// bucketIdleTime is how long an address's rate bucket is kept after it refills.
+const bucketIdleTime = time.Minute
+
+type admission struct {
+	mutex sync.Mutex
+	total int
+	perIP map[netip.Addr]int
+
+	buckets map[netip.Addr]*rateBucket
+	pruned  time.Time
+
+	// Parsed forms of the globals CIDR lists, reparsed when those change.
+	allowSrc, denySrc []string
+	allow, deny       []netip.Prefix
+}
+
+// rateBucket is a token bucket of connections for one address.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newAdmission() *admission {
+	return &admission{
+		perIP:   map[netip.Addr]int{},
+		buckets: map[netip.Addr]*rateBucket{},
+	}
+}
+
+// admit reports whether the connection may be served, and counts it if so.
+// Admitted connections must be released once closed.
+func (a *admission) admit(conn net.Conn) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if globals.MaxConnections > 0 && a.total >= globals.MaxConnections {
+		return a.refuse(conn, "connection limit reached")
+	}
+
+	ip, ok := comm.RemoteIP(conn)
+	if !ok {
+		a.total++
+		return true
+	}
+
+	a.refreshLists()
+	if comm.PrefixesContain(a.deny, ip) {
+		return a.refuse(conn, "address denied")
+	}
+	if len(a.allow) > 0 && !comm.PrefixesContain(a.allow, ip) {
+		return a.refuse(conn, "address not allowed")
+	}
+	if globals.MaxConnectionsPerIP > 0 && a.perIP[ip] >= globals.MaxConnectionsPerIP {
+		return a.refuse(conn, "per address connection limit reached")
+	}
+	if !a.takeToken(ip) {
+		return a.refuse(conn, "connection rate exceeded")
+	}
+
+	a.total++
+	a.perIP[ip]++
+	return true
+}
+
+// release uncounts an admitted connection.
+func (a *admission) release(conn net.Conn) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.total--
+	ip, ok := comm.RemoteIP(conn)
+	if !ok {
+		return
+	}
+	if a.perIP[ip] <= 1 {
+		delete(a.perIP, ip)
+	} else {
+		a.perIP[ip]--
+	}
+}
+
+func (a *admission) refuse(conn net.Conn, reason string) bool {
+	logging.LogSystemWarning(
+		fmt.Sprintf("Refused connection from %s: %s", conn.RemoteAddr(), reason),
+	)
+	return false
+}
+
+// refreshLists reparses the allow and deny lists if the globals changed.
+// Invalid lists are rejected when set, so parse errors keep the old lists.
+// Must hold the mutex.
+func (a *admission) refreshLists() {
+	if !slices.Equal(a.allowSrc, globals.AllowCIDRs) {
+		if p, err := comm.ParsePrefixes(globals.AllowCIDRs); err == nil {
+			a.allow = p
+		}
+		a.allowSrc = slices.Clone(globals.AllowCIDRs)
+	}
+	if !slices.Equal(a.denySrc, globals.DenyCIDRs) {
+		if p, err := comm.ParsePrefixes(globals.DenyCIDRs); err == nil {
+			a.deny = p
+		}
+		a.denySrc = slices.Clone(globals.DenyCIDRs)
+	}
+}
+
+// takeToken takes a connection from the address's rate bucket, reporting
+// false if it is empty. Must hold the mutex.
+func (a *admission) takeToken(ip netip.Addr) bool {
+	rate := globals.ConnectionRate
+	if rate <= 0 {
+		return true
+	}
+	burst := float64(globals.ConnectionBurst)
+	if burst <= 0 {
+		burst = math.Ceil(rate)
+	}
+
+	now := time.Now()
+	a.prune(now, rate, burst)
+
+	b := a.buckets[ip]
+	if b == nil {
+		b = &rateBucket{tokens: burst, last: now}
+		a.buckets[ip] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets of addresses that have long since refilled, at most
+// once per bucketIdleTime. Must hold the mutex.
+func (a *admission) prune(now time.Time, rate, burst float64) {
+	if now.Sub(a.pruned) < bucketIdleTime {
+		return
+	}
+	a.pruned = now
+
+	refill := time.Duration(burst / rate * float64(time.Second))
+	for ip, b := range a.buckets {
+		if now.Sub(b.last) > refill+bucketIdleTime {
+			delete(a.buckets, ip)
+		}
+	}
+}
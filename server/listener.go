@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the bound listener and how it is retired when the server rebinds.
+//
+// Rebinding opens the new listener before the old one is retired, so the
+// accept loop moves straight onto it. Connections accepted on the old
+// listener are drained: each is closed once the object it is handling
+// finishes, and any still open after globals.DrainTimeout are closed.
+// -----------------------------------------------------------------------------
+
+// boundListener is a listener, what it was opened from, and the connections
+// accepted on it.
+type boundListener struct {
+	net.Listener
+	spec    globals.Listener
+	retired atomic.Bool
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newBoundListener(l net.Listener, spec globals.Listener) *boundListener {
+	return &boundListener{
+		Listener: l,
+		spec:     spec,
+		conns:    map[net.Conn]struct{}{},
+	}
+}
+
+// track registers a connection accepted on the listener.
+func (bl *boundListener) track(c net.Conn) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bl.conns[c] = struct{}{}
+}
+
+func (bl *boundListener) untrack(c net.Conn) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	delete(bl.conns, c)
+}
+
+// draining reports whether connections accepted on the listener should close.
+func (bl *boundListener) draining() bool {
+	return bl.retired.Load()
+}
+
+// retire stops the listener accepting and drains its connections.
+func (bl *boundListener) retire() {
+	bl.retired.Store(true)
+	_ = bl.Close()
+
+	bl.mutex.Lock()
+	open := len(bl.conns)
+	bl.mutex.Unlock()
+	if open == 0 {
+		return
+	}
+
+	logging.LogSystemAction(fmt.Sprintf(
+		"Draining %d connections from %s", open, bl.Addr(),
+	))
+	time.AfterFunc(globals.DrainTimeout, bl.closeRemaining)
+}
+
+// closeRemaining closes the connections that outlived the drain.
+func (bl *boundListener) closeRemaining() {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	if len(bl.conns) > 0 {
+		logging.LogSystemAction(fmt.Sprintf(
+			"Closing %d connections left on %s", len(bl.conns), bl.Addr(),
+		))
+	}
+	for c := range bl.conns {
+		_ = c.Close()
+	}
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"mycelia/comm"
 	"mycelia/globals"
@@ -14,8 +18,18 @@ import (
 	"github.com/signal-weave/rhizome"
 )
 
+const tlsHandshakeTimeout = 10 * time.Second
+
+// acceptRetryDelay is how long an accept loop waits after a failed accept
+// before trying again.
+const acceptRetryDelay = 100 * time.Millisecond
+
 func NewServer(address string, port int) *Server {
-	server := &Server{}
+	server := &Server{
+		admission: newAdmission(),
+		listeners: map[string]*listenerSlot{},
+		stopped:   make(chan struct{}),
+	}
 	server.Broker = routing.NewBroker(server)
 	server.address = address
 	server.port = port
@@ -24,16 +38,38 @@ func NewServer(address string, port int) *Server {
 
 // Server is responsible for translating raw TCP string input into routable
 // messages.
+//
+// The server listens on the default listener, on globals.Address and
+// globals.Port, and on each of globals.Listeners. Every listener has its own
+// accept loop and can be rebound on its own.
+//
+// Every accepted connection gets its own reader goroutine, so any number of
+// persistent clients can be connected at once. Frames the readers decode are
+// handled by a fixed pool of globals.WorkerCount workers. A reader waits for
+// its frame to be handled before reading the next, which keeps each
+// connection's objects in order and means one busy client holds at most one
+// slot in the pool.
 type Server struct {
-	jobs     chan net.Conn
-	listener net.Listener
+	jobs      chan job
+	startPool sync.Once
+	admission *admission
 
 	Broker *routing.Broker
 
 	address string
 	port    int
 
-	mutex sync.RWMutex
+	mutex     sync.RWMutex
+	listeners map[string]*listenerSlot
+	stopOnce  sync.Once
+	stopped   chan struct{}
+}
+
+// job is a frame read off a connection, waiting on a worker.
+type job struct {
+	frame []byte
+	resp  *rhizome.ConnResponder
+	done  chan struct{}
 }
 
 func (s *Server) GetAddress() string {
@@ -44,70 +80,96 @@ func (s *Server) GetPort() int {
 	return s.port
 }
 
-// Run ...
+// Run opens the listeners and serves them until the server shuts down.
+// Returns an error if the default listener cannot be opened. Other listeners
+// that fail to open are logged and skipped.
 func (s *Server) Run() error {
-	if s.listener == nil {
+	s.startPool.Do(s.startWorkers)
+
+	if s.slot(globals.DefaultListener) == nil {
 		if err := s.UpdateListener(); err != nil {
 			return err
 		}
 	}
-	return s.serve()
-}
-
-// Spins up the server...
-// Caps concurrency and avoids spawning unbound go routines.
-func (s *Server) serve() error {
-	if s.jobs == nil {
-		s.jobs = make(chan net.Conn, 1024)
+	if _, err := s.SyncListeners(); err != nil {
+		logging.LogSystemError(err.Error())
 	}
 
+	<-s.stopped
+	return nil
+}
+
+// startWorkers starts the pool that handles frames read off connections.
+func (s *Server) startWorkers() {
+	s.jobs = make(chan job, globals.WorkerCount)
 	for range globals.WorkerCount {
 		go func() {
-			for c := range s.jobs {
-				s.HandleConnection(c)
+			for j := range s.jobs {
+				s.Broker.HandleBytes(j.frame, j.resp)
+				j.done <- struct{}{}
 			}
 		}()
 	}
-
-	for !globals.PerformShutdown.Load() {
-		c, err := s.listener.Accept()
-		if err != nil {
-			fmt.Println(err.Error())
-			return err
-		}
-
-		// Go runtime selects an unblocked worker when we push the
-		// listener.Accept() into a channel of multiple objects.
-		s.jobs <- c
-	}
-
-	return nil
 }
 
+// Shutdown stops the server accepting connections and returns Run. Open
+// connections are drained like those of a rebound listener. Draining the
+// broker is left to whoever called Run, as Shutdown may be called while an
+// object is being handled.
 func (s *Server) Shutdown() {
 	globals.PerformShutdown.Store(true)
 
 	s.mutex.Lock()
-	l := s.listener
-	s.listener = nil
+	slots := s.listeners
+	s.listeners = map[string]*listenerSlot{}
 	s.mutex.Unlock()
 
-	if l != nil {
-		_ = l.Close()
-	}
-	if s.jobs != nil {
-		close(s.jobs)
+	for _, slot := range slots {
+		if bl := slot.swap(nil); bl != nil {
+			bl.retire()
+		}
 	}
+	s.stopOnce.Do(func() { close(s.stopped) })
+}
+
+// -------Listeners-------------------------------------------------------------
+
+// listenerSlot holds a named listener's current bound listener. Its accept
+// loop follows whatever the slot holds, so rebinding is a swap.
+type listenerSlot struct {
+	mutex sync.Mutex
+	bl    *boundListener
+}
+
+func (ls *listenerSlot) get() *boundListener {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.bl
+}
+
+func (ls *listenerSlot) swap(bl *boundListener) *boundListener {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	old := ls.bl
+	ls.bl = bl
+	return old
+}
+
+func (s *Server) slot(name string) *listenerSlot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listeners[name]
 }
 
 // UpdateListener updates which socket the server is listening to at runtime.
+// The new listener is opened before the old one is retired, so no connection
+// is refused in between. If the new address cannot be bound the server stays
+// on the old one.
 func (s *Server) UpdateListener() error {
-	// open new first
-	addr := fmt.Sprintf("%s:%d", globals.Address, globals.Port)
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
+	spec := comm.DefaultListenerSpec()
+	if err := s.bind(spec); err != nil {
 		wMsg := fmt.Sprintf(
-			"Could not open listener to %s, staying on old listener!", addr,
+			"Could not open listener to %s, staying on old listener!", spec.Address,
 		)
 		logging.LogSystemError(wMsg)
 
@@ -117,40 +179,216 @@ func (s *Server) UpdateListener() error {
 		return err
 	}
 
-	s.mutex.Lock()
-	old := s.listener
-	s.listener = l
 	s.address = globals.Address
 	s.port = globals.Port
+	return nil
+}
+
+// SyncListeners opens, rebinds, and closes listeners until the open listeners
+// match globals.Listeners. Listeners that fail to open keep their old address,
+// or are dropped from globals.Listeners if they are new. Reports whether any
+// listener changed.
+func (s *Server) SyncListeners() (bool, error) {
+	changed := false
+	var errs []error
+	wanted := map[string]bool{globals.DefaultListener: true}
+	kept := make([]globals.Listener, 0, len(globals.Listeners))
+
+	for _, spec := range globals.Listeners {
+		wanted[spec.Name] = true
+
+		var running *globals.Listener
+		if slot := s.slot(spec.Name); slot != nil {
+			if bl := slot.get(); bl != nil {
+				running = &bl.spec
+			}
+		}
+		if running != nil && *running == spec {
+			kept = append(kept, spec)
+			continue
+		}
+
+		changed = true
+		if err := s.bind(spec); err != nil {
+			err = fmt.Errorf("could not open listener %s on %s: %w",
+				spec.Name, spec.Address, err,
+			)
+			logging.LogSystemError(err.Error())
+			errs = append(errs, err)
+			if running != nil {
+				kept = append(kept, *running)
+			}
+			continue
+		}
+		kept = append(kept, spec)
+	}
+	globals.Listeners = kept
+
+	s.mutex.RLock()
+	var closing []string
+	for name := range s.listeners {
+		if !wanted[name] {
+			closing = append(closing, name)
+		}
+	}
+	s.mutex.RUnlock()
+
+	for _, name := range closing {
+		changed = true
+		s.unbind(name)
+	}
+
+	return changed, errors.Join(errs...)
+}
+
+// bind opens the listener and swaps it into its slot, retiring the listener it
+// replaces. New slots get an accept loop.
+func (s *Server) bind(spec globals.Listener) error {
+	l, err := comm.Listen(spec)
+	if err != nil {
+		return err
+	}
+	bl := newBoundListener(l, spec)
+
+	s.mutex.Lock()
+	slot, exists := s.listeners[spec.Name]
+	if !exists {
+		slot = &listenerSlot{}
+		s.listeners[spec.Name] = slot
+	}
+	old := slot.swap(bl)
 	s.mutex.Unlock()
 
-	str.SprintfLn("Now listening on %s", addr)
+	str.SprintfLn("Now listening on %s (%s)", bl.Addr().String(), spec.Name)
+	logging.LogSystemAction(fmt.Sprintf(
+		"Listener %s now listening on %s %s",
+		spec.Name, spec.Protocol, bl.Addr().String(),
+	))
 
+	if !exists {
+		go s.acceptLoop(slot)
+	}
 	if old != nil {
 		str.SprintfLn("Closing listener on %s", old.Addr().String())
-		_ = old.Close() // will cause a benign net.ErrClosed in Run()
+		old.retire() // Accept on old errors, the loop moves to the new listener.
 	}
-
 	return nil
 }
 
-// HandleConnection manages incoming data stream.
-func (s *Server) HandleConnection(conn net.Conn) {
-	logging.LogSystemAction(
-		fmt.Sprintf("Client connected: %s\n", conn.RemoteAddr().String()),
-	)
+// unbind closes the named listener, draining its connections.
+func (s *Server) unbind(name string) {
+	s.mutex.Lock()
+	slot := s.listeners[name]
+	delete(s.listeners, name)
+	s.mutex.Unlock()
+
+	if slot == nil {
+		return
+	}
+	if bl := slot.swap(nil); bl != nil {
+		logging.LogSystemAction(fmt.Sprintf("Closing listener %s", name))
+		bl.retire()
+	}
+}
+
+// acceptLoop accepts connections on whatever listener the slot holds, handing
+// each admitted one to its own reader. Returns once the slot is emptied.
+func (s *Server) acceptLoop(slot *listenerSlot) {
+	for !globals.PerformShutdown.Load() {
+		bl := slot.get()
+		if bl == nil {
+			return
+		}
+
+		c, err := bl.Accept()
+		if err != nil {
+			if bl.draining() || globals.PerformShutdown.Load() {
+				continue // Rebound or shutting down, follow the slot.
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logging.LogSystemError(fmt.Sprintf(
+				"Accept on %s failed: %s", bl.spec.Name, err,
+			))
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		if !s.admission.admit(c) {
+			_ = c.Close()
+			continue
+		}
+
+		bl.track(c)
+		go func() {
+			defer s.admission.release(c)
+			defer bl.untrack(c)
+			s.handleConnection(c, bl)
+		}()
+	}
+}
+
+// -------Connections-----------------------------------------------------------
+
+// handleConnection reads the connection's frames and queues each one on the
+// worker pool, waiting for it to be handled before reading the next.
+// Connections idle for longer than globals.IdleTimeout, or slower than
+// globals.ReadTimeout to finish a frame, are closed, as are connections whose
+// listener was retired once their current object is handled.
+func (s *Server) handleConnection(conn net.Conn, bl *boundListener) {
+	defer func() { _ = conn.Close() }()
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := handshake(tc); err != nil {
+			logging.LogSystemWarning(fmt.Sprintf(
+				"TLS handshake with %s failed: %s", conn.RemoteAddr(), err,
+			))
+			return
+		}
+	}
+
+	identity := ""
+	if id := comm.PeerIdentity(conn); id != "" {
+		identity = fmt.Sprintf(" as %s", id)
+	}
+	logging.LogSystemAction(fmt.Sprintf(
+		"Client connected: %s on %s%s\n",
+		conn.RemoteAddr().String(), bl.spec.Name, identity,
+	))
 
 	resp := rhizome.NewConnResponder(conn)
+	s.Broker.BeginSession(resp, bl.spec.Name, bl.spec.Auth)
+	defer s.Broker.EndSession(resp)
 
-	for {
-		frame, err := comm.ReadFrameU32(conn)
+	done := make(chan struct{}, 1)
+	for !bl.draining() {
+		frame, err := comm.ReadFrameU32Deadline(
+			conn, globals.IdleTimeout, globals.ReadTimeout,
+		)
 		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				logging.LogSystemAction(fmt.Sprintf(
+					"Closing timed out connection from %s", conn.RemoteAddr(),
+				))
+			}
 			return
 		}
 		if len(frame) == 0 {
 			continue
 		}
 
-		s.Broker.HandleBytes(frame, resp)
+		s.jobs <- job{frame: frame, resp: resp, done: done}
+		<-done
+	}
+}
+
+// handshake completes the TLS handshake up front so a client that never
+// finishes it cannot hold a worker, and so the peer identity is known before
+// the first object is handled.
+func handshake(tc *tls.Conn) error {
+	_ = tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
 	}
+	return tc.SetDeadline(time.Time{})
 }
@@ -0,0 +1,52 @@
+package source
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"mycelia/globals"
+)
+
+// CheckpointDirectory is where sources store their progress by default.
+var CheckpointDirectory = filepath.Join(globals.ExeDir, "checkpoints")
+
+// checkpoint is the persisted progress of a source.
+// File sources use Offset, directory sources use Processed.
+type checkpoint struct {
+	Offset    int64            `json:"offset,omitempty"`
+	Processed map[string]int64 `json:"processed,omitempty"` // name -> mod time
+}
+
+// loadCheckpoint reads the checkpoint at path. A missing file is an empty
+// checkpoint rather than an error.
+func loadCheckpoint(path string) (checkpoint, error) {
+	var cp checkpoint
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	err = json.Unmarshal(data, &cp)
+	return cp, err
+}
+
+// saveCheckpoint atomically replaces the checkpoint at path.
+func saveCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
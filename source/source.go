@@ -0,0 +1,167 @@
+package source
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"mycelia/errgo"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/system"
+
+	"github.com/google/uuid"
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the source connectors, components that get data into the broker
+// without a client. Each source is defined in the Mycelia_Config.json file
+// "sources" field and publishes onto a route as if a client had sent a
+// delivery.
+//
+// Sources checkpoint their progress to disk so a restart picks up where the
+// last run left off instead of republishing everything. Delivery is
+// at-least-once: anything published after the last checkpoint write may be
+// published again after a crash.
+// -----------------------------------------------------------------------------
+
+const (
+	typeFile      = "file"
+	typeDirectory = "directory"
+)
+
+const defaultPoll = time.Second
+
+// This is here so sources can feed the broker without importing routing.
+type handler interface {
+	HandleObject(obj *rhizome.Object) error
+}
+
+// A source is a running connector that publishes to a broker.
+type source struct {
+	name       string
+	path       string
+	route      string
+	channel    string
+	poll       time.Duration
+	checkpoint string
+	broker     handler
+}
+
+// Start launches a goroutine for each configured source. Sources that are
+// misconfigured are logged and skipped.
+// Sources stop on their own once globals.PerformShutdown is set.
+func Start(b handler, sources []system.SourceData) {
+	for i, sd := range sources {
+		src, kind, err := newSource(b, sd)
+		if err != nil {
+			wMsg := fmt.Sprintf("Skipping source %d: %s", i, err)
+			_ = errgo.NewError(wMsg, globals.VerbWrn)
+			continue
+		}
+
+		switch kind {
+		case typeFile:
+			t := &tailer{source: src}
+			go t.run()
+		case typeDirectory:
+			sp := &spool{source: src, pattern: "*", delete: false}
+			if sd.Pattern != nil && *sd.Pattern != "" {
+				sp.pattern = *sd.Pattern
+			}
+			if sd.Delete != nil {
+				sp.delete = *sd.Delete
+			}
+			go sp.run()
+		}
+
+		logging.LogSystemAction(
+			fmt.Sprintf("Started %s source %s on %s", kind, src.name, src.path),
+		)
+	}
+}
+
+// Validate reports what is wrong with a source's config, if anything.
+func Validate(sd system.SourceData) error {
+	_, _, err := newSource(nil, sd)
+	return err
+}
+
+func newSource(b handler, sd system.SourceData) (*source, string, error) {
+	if sd.Type == nil {
+		return nil, "", fmt.Errorf("missing type")
+	}
+	kind := *sd.Type
+	if kind != typeFile && kind != typeDirectory {
+		return nil, "", fmt.Errorf("unknown type %q", kind)
+	}
+	if sd.Path == nil || *sd.Path == "" {
+		return nil, "", fmt.Errorf("missing path")
+	}
+	if sd.Route == nil || *sd.Route == "" {
+		return nil, "", fmt.Errorf("missing route")
+	}
+
+	path := *sd.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(globals.ExeDir, path)
+	}
+
+	src := &source{
+		path:   filepath.Clean(path),
+		route:  *sd.Route,
+		poll:   defaultPoll,
+		broker: b,
+	}
+
+	if sd.Channel != nil {
+		src.channel = *sd.Channel
+	}
+	if sd.Poll != nil {
+		d, err := time.ParseDuration(*sd.Poll)
+		if err != nil || d <= 0 {
+			return nil, "", fmt.Errorf("invalid poll interval %q", *sd.Poll)
+		}
+		src.poll = d
+	}
+
+	// Unnamed sources are keyed by their path so their checkpoint survives
+	// restarts as long as the config does not change.
+	src.name = kind + "-" + shortHash(src.path)
+	if sd.Name != nil && *sd.Name != "" {
+		src.name = *sd.Name
+	}
+
+	src.checkpoint = filepath.Join(CheckpointDirectory, src.name+".json")
+	if sd.Checkpoint != nil && *sd.Checkpoint != "" {
+		src.checkpoint = *sd.Checkpoint
+	}
+
+	return src, kind, nil
+}
+
+// publish sends the payload to the source's route as a delivery.
+// Arg3 is the source name so a source's deliveries share a partition and
+// keep their order.
+func (s *source) publish(payload []byte) error {
+	obj := rhizome.NewObject(
+		globals.ObjDelivery,
+		globals.CmdSend,
+		globals.AckPlcyNoreply,
+		uuid.New().String(),
+		s.route,
+		s.channel,
+		s.name,
+		"",
+		payload,
+	)
+	return s.broker.HandleObject(obj)
+}
+
+func shortHash(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,143 @@
+package source
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+)
+
+// A spool watches a directory, publishing each matching file as a single
+// delivery. Published files are deleted or recorded in the checkpoint so they
+// are not published again.
+type spool struct {
+	*source
+	pattern   string
+	delete    bool
+	processed map[string]int64
+}
+
+func (sp *spool) run() {
+	cp, err := loadCheckpoint(sp.checkpoint)
+	if err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Could not load checkpoint for %s, starting over: %s",
+				sp.name, err),
+		)
+	}
+	sp.processed = cp.Processed
+	if sp.processed == nil {
+		sp.processed = map[string]int64{}
+	}
+
+	for !globals.PerformShutdown.Load() {
+		if err := sp.scan(); err != nil {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Source %s could not scan %s: %s", sp.name, sp.path, err),
+			)
+		}
+		time.Sleep(sp.poll)
+	}
+}
+
+// scan publishes every matching file that has not been published yet, in name
+// order.
+func (sp *spool) scan() error {
+	matches, err := filepath.Glob(filepath.Join(sp.path, sp.pattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(matches)
+
+	seen := map[string]bool{}
+	changed := false
+
+	for _, path := range matches {
+		if globals.PerformShutdown.Load() {
+			break
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.Base(path)
+		seen[name] = true
+
+		modTime := info.ModTime().UnixNano()
+		if sp.processed[name] == modTime {
+			continue
+		}
+		// Let writers finish before picking the file up.
+		if time.Since(info.ModTime()) < sp.poll {
+			continue
+		}
+
+		if sp.publishFile(path, info) {
+			sp.processed[name] = modTime
+			if sp.delete {
+				sp.remove(path)
+			}
+			sp.save()
+		}
+	}
+
+	// Forget files that are gone so the checkpoint does not grow forever.
+	for name := range sp.processed {
+		if !seen[name] {
+			delete(sp.processed, name)
+			changed = true
+		}
+	}
+	if changed {
+		sp.save()
+	}
+
+	return nil
+}
+
+// publishFile publishes the file's contents. Returns false if the file should
+// be retried on the next scan.
+func (sp *spool) publishFile(path string, info os.FileInfo) bool {
+	if info.Size() > globals.BytesInMegabyte {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Source %s skipped %s, %d bytes is over the limit",
+				sp.name, path, info.Size()),
+		)
+		return true
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Source %s could not read %s: %s", sp.name, path, err),
+		)
+		return false
+	}
+
+	if err := sp.publish(data); err != nil {
+		return false
+	}
+	return true
+}
+
+func (sp *spool) remove(path string) {
+	if err := os.Remove(path); err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Source %s could not delete %s: %s", sp.name, path, err),
+		)
+	}
+}
+
+func (sp *spool) save() {
+	err := saveCheckpoint(sp.checkpoint, checkpoint{Processed: sp.processed})
+	if err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Could not save checkpoint for %s: %s", sp.name, err),
+		)
+	}
+}
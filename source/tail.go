@@ -0,0 +1,119 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+)
+
+// A tailer follows a file, publishing each complete line as a delivery.
+// Partial trailing lines are held back until their newline is written.
+type tailer struct {
+	*source
+	offset int64
+	last   os.FileInfo // Used to notice the file being replaced.
+}
+
+func (t *tailer) run() {
+	cp, err := loadCheckpoint(t.checkpoint)
+	if err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Could not load checkpoint for %s, starting over: %s",
+				t.name, err),
+		)
+	}
+	t.offset = cp.Offset
+
+	for !globals.PerformShutdown.Load() {
+		before := t.offset
+		if err := t.readNew(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Source %s could not read %s: %s", t.name, t.path, err),
+			)
+		}
+		if t.offset != before {
+			t.save()
+		}
+		time.Sleep(t.poll)
+	}
+}
+
+// readNew publishes every complete line written since the last offset.
+func (t *tailer) readNew() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if t.last != nil && !os.SameFile(t.last, info) {
+		logging.LogSystemAction(
+			fmt.Sprintf("Source %s: %s was replaced, reading from start",
+				t.name, t.path),
+		)
+		t.offset = 0
+	}
+	if info.Size() < t.offset {
+		logging.LogSystemAction(
+			fmt.Sprintf("Source %s: %s was truncated, reading from start",
+				t.name, t.path),
+		)
+		t.offset = 0
+	}
+	t.last = info
+
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for !globals.PerformShutdown.Load() {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil // Partial line, wait for the rest.
+		}
+		if err != nil {
+			return err
+		}
+
+		next := t.offset + int64(len(line))
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case len(line) == 0:
+		case len(line) > globals.BytesInMegabyte:
+			logging.LogSystemWarning(
+				fmt.Sprintf("Source %s skipped %d byte line at offset %d",
+					t.name, len(line), t.offset),
+			)
+		default:
+			if err := t.publish(line); err != nil {
+				return err
+			}
+		}
+
+		t.offset = next
+	}
+
+	return nil
+}
+
+func (t *tailer) save() {
+	err := saveCheckpoint(t.checkpoint, checkpoint{Offset: t.offset})
+	if err != nil {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Could not save checkpoint for %s: %s", t.name, err),
+		)
+	}
+}
@@ -0,0 +1,243 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"mycelia/comm"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the strict decoding of Mycelia_Config.json documents.
+//
+// A document is checked against SystemData before it is decoded, so a field
+// SystemData does not have or a value of the wrong type is an error instead of
+// being dropped. Every error in the document is reported, each with the JSON
+// path of the value it is about, such as routes[0].channels[1].strategy.
+// -----------------------------------------------------------------------------
+
+// ConfigError is a problem with a value of a config document.
+type ConfigError struct {
+	File string // The file the value is in, if known.
+	Path string // The value's JSON path, empty for the document as a whole.
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	msg := e.Msg
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	if e.File != "" {
+		msg = e.File + ": " + msg
+	}
+	return msg
+}
+
+// ConfigErrors collects the errors found in a config document.
+type ConfigErrors []ConfigError
+
+// Addf adds an error about the value at path.
+func (errs *ConfigErrors) Addf(path, format string, args ...any) {
+	*errs = append(*errs, ConfigError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// JoinPath returns the path of field in the value at path.
+func JoinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// IndexPath returns the path of the i'th element of the list at path.
+func IndexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// DecodeConfig decodes a config document, or returns every error in its
+// syntax, fields, and value types.
+func DecodeConfig(data []byte) (*SystemData, ConfigErrors) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, ConfigErrors{syntaxError(data, dec, err)}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ConfigErrors{{
+			Msg: position(data, dec.InputOffset()) + ": data after the document",
+		}}
+	}
+
+	var errs ConfigErrors
+	checkValue(doc, reflect.TypeFor[SystemData](), "", &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	var sd SystemData
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return nil, ConfigErrors{{Msg: err.Error()}}
+	}
+	return &sd, nil
+}
+
+// syntaxError describes where the document stopped being valid JSON.
+func syntaxError(data []byte, dec *json.Decoder, err error) ConfigError {
+	var se *json.SyntaxError
+	switch {
+	case errors.Is(err, io.EOF):
+		return ConfigError{Msg: "document is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ConfigError{
+			Msg: position(data, int64(len(data))) + ": unexpected end of document",
+		}
+	case errors.As(err, &se):
+		msg := strings.TrimPrefix(se.Error(), "json: ")
+		// The offset is just past the character that is wrong.
+		return ConfigError{Msg: position(data, se.Offset-1) + ": " + msg}
+	}
+	return ConfigError{Msg: position(data, dec.InputOffset()) + ": " + err.Error()}
+}
+
+// position returns the line and column of the byte offset in data.
+func position(data []byte, offset int64) string {
+	offset = min(offset, int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
+
+// checkValue adds an error for each field of v that type t does not have and
+// each value in v that does not decode into its field's type.
+// A null leaves the field unset and is never an error.
+func checkValue(v any, t reflect.Type, path string, errs *ConfigErrors) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if v == nil {
+		return
+	}
+
+	// An endpoint's "tls" is either true or false, or an object of settings.
+	if t == reflect.TypeFor[EndpointTLS]() {
+		if _, ok := v.(bool); ok {
+			return
+		}
+		if _, ok := v.(map[string]any); !ok {
+			errs.Addf(path, "expected true, false, or an object, found %s", kindOf(v))
+			return
+		}
+		t = reflect.TypeFor[comm.DialTLS]()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			errs.Addf(path, "expected an object, found %s", kindOf(v))
+			return
+		}
+		fields := jsonFields(t)
+		for _, key := range slices.Sorted(maps.Keys(obj)) {
+			field, ok := fields[key]
+			if !ok {
+				errs.Addf(JoinPath(path, key), "unknown field")
+				continue
+			}
+			checkValue(obj[key], field, JoinPath(path, key), errs)
+		}
+
+	case reflect.Slice:
+		list, ok := v.([]any)
+		if !ok {
+			errs.Addf(path, "expected a list, found %s", kindOf(v))
+			return
+		}
+		for i, item := range list {
+			checkValue(item, t.Elem(), IndexPath(path, i), errs)
+		}
+
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			errs.Addf(path, "expected a string, found %s", kindOf(v))
+		}
+
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			errs.Addf(path, "expected true or false, found %s", kindOf(v))
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(json.Number)
+		if !ok {
+			errs.Addf(path, "expected an integer, found %s", kindOf(v))
+			return
+		}
+		i, err := n.Int64()
+		if err != nil {
+			errs.Addf(path, "expected an integer, found %s", n)
+			return
+		}
+		if reflect.New(t).Elem().OverflowInt(i) {
+			errs.Addf(path, "%s is out of range", n)
+		}
+
+	case reflect.Float32, reflect.Float64:
+		n, ok := v.(json.Number)
+		if !ok {
+			errs.Addf(path, "expected a number, found %s", kindOf(v))
+			return
+		}
+		if _, err := n.Float64(); err != nil {
+			errs.Addf(path, "%s is out of range", n)
+		}
+	}
+}
+
+// jsonFields returns the struct's fields by their JSON names, with the fields
+// of embedded structs promoted.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-" || !f.IsExported():
+		case f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct:
+			maps.Copy(fields, jsonFields(f.Type))
+		case name == "":
+			fields[f.Name] = f.Type
+		default:
+			fields[name] = f.Type
+		}
+	}
+	return fields
+}
+
+// kindOf names the JSON kind of a decoded value.
+func kindOf(v any) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case json.Number:
+		return "number " + v.String()
+	case bool:
+		return fmt.Sprintf("%t", v)
+	case []any:
+		return "a list"
+	case map[string]any:
+		return "an object"
+	}
+	return "null"
+}
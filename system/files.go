@@ -0,0 +1,38 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the helpers for the files the broker keeps about itself, such as
+// the shutdown report and the state file.
+// -----------------------------------------------------------------------------
+
+// WriteFileAtomic replaces the file at path with data. The data is written and
+// synced beside the file, then renamed over it, so a crash mid-write leaves the
+// old file intact.
+func WriteFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,209 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the reading of config files, which may be JSON, YAML, or TOML.
+//
+// Whatever its format, a file is read into the same decoded JSON document, in
+// two steps:
+//
+//  1. It is parsed by its extension: .yaml and .yml are YAML, .toml is TOML,
+//     and anything else is JSON.
+//  2. References in its string values are interpolated:
+//     ${NAME}          the environment variable NAME, which must be set
+//     ${NAME:-value}   NAME, or value if NAME is unset or empty
+//     ${file:path}     the file's contents without trailing newlines, relative
+//                      paths resolving against the config file's directory
+//     $${              a literal ${
+// -----------------------------------------------------------------------------
+
+// ConfigNames are the config file names looked for beside the executable, in
+// order, when no config file is given.
+var ConfigNames = []string{
+	"Mycelia_Config.json",
+	"Mycelia_Config.yaml",
+	"Mycelia_Config.yml",
+	"Mycelia_Config.toml",
+}
+
+// configExtensions are the extensions of the files read as config files.
+var configExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// parseFile decodes the config file at path, whose contents are data, into the
+// values encoding/json decodes JSON into with UseNumber, and interpolates its
+// references.
+func parseFile(path string, data []byte) (any, ConfigErrors) {
+	var doc any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			msg := strings.TrimPrefix(err.Error(), "yaml: ")
+			return nil, ConfigErrors{{Msg: msg}}
+		}
+		doc = normalizeYAML(doc)
+
+	case ".toml":
+		var table map[string]any
+		if err := toml.Unmarshal(data, &table); err != nil {
+			var pe toml.ParseError
+			if errors.As(err, &pe) {
+				return nil, ConfigErrors{{Msg: fmt.Sprintf(
+					"line %d, column %d: %s",
+					pe.Position.Line, pe.Position.Col, pe.Message,
+				)}}
+			}
+			return nil, ConfigErrors{{Msg: err.Error()}}
+		}
+		doc = table
+
+	default:
+		return decodeJSON(path, data)
+	}
+
+	// Round tripped so every format decodes to the same values as JSON.
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, ConfigErrors{{Msg: err.Error()}}
+	}
+	return decodeJSON(path, out)
+}
+
+// decodeJSON decodes a JSON config file and interpolates its references.
+func decodeJSON(path string, data []byte) (any, ConfigErrors) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, ConfigErrors{syntaxError(data, dec, err)}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ConfigErrors{{
+			Msg: position(data, dec.InputOffset()) + ": data after the document",
+		}}
+	}
+
+	var errs ConfigErrors
+	doc = interpolate(doc, "", filepath.Dir(path), &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return doc, nil
+}
+
+// normalizeYAML makes the document YAML decoded into encodable by JSON, whose
+// objects only have string keys.
+func normalizeYAML(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			v[k] = normalizeYAML(item)
+		}
+	case map[any]any:
+		obj := make(map[string]any, len(v))
+		for k, item := range v {
+			obj[fmt.Sprint(k)] = normalizeYAML(item)
+		}
+		return obj
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+	}
+	return v
+}
+
+// -------Interpolation---------------------------------------------------------
+
+// interpolate expands the references in the string values of v, adding an
+// error for each one that cannot be.
+func interpolate(v any, path, dir string, errs *ConfigErrors) any {
+	switch v := v.(type) {
+	case string:
+		s, err := expand(v, dir)
+		if err != nil {
+			errs.Addf(path, "%s", err)
+		}
+		return s
+	case map[string]any:
+		for k, item := range v {
+			v[k] = interpolate(item, JoinPath(path, k), dir, errs)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = interpolate(item, IndexPath(path, i), dir, errs)
+		}
+	}
+	return v
+}
+
+// expand replaces the ${...} references in s.
+func expand(s, dir string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference in %q", s)
+		}
+
+		value, err := resolve(s[i+2:i+end], dir)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s[:i] + value)
+		s = s[i+end+1:]
+	}
+}
+
+// resolve returns the value of a reference's expression.
+func resolve(expr, dir string) (string, error) {
+	if path, ok := strings.CutPrefix(expr, "file:"); ok {
+		if path == "" {
+			return "", errors.New("${file:} without a path")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	name, fallback, hasFallback := strings.Cut(expr, ":-")
+	if name == "" {
+		return "", fmt.Errorf("${%s} without a variable name", expr)
+	}
+	value, ok := os.LookupEnv(name)
+	switch {
+	case hasFallback && value == "":
+		return fallback, nil
+	case !ok:
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
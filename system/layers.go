@@ -0,0 +1,332 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"mycelia/globals"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the layering of the config file and a directory of config
+// fragments, conf.d style, into the one config document the broker runs with.
+//
+// The config file is read first, then every .json, .yaml, .yml, and .toml file
+// in ConfigDir in name order. Fragments may only hold "parameters" and
+// "routes", and each is merged into what was read before it:
+//
+//   - A parameter may be set by more than one file, as long as they all set it
+//     to the same value.
+//   - Routes are merged by name, so a file can add channels to a route another
+//     file defines. A channel may be defined by more than one file as long as
+//     they all define it the same way, down to its transformers and
+//     subscribers.
+//
+// Conflicts are errors naming both files. Errors about the merged document are
+// pointed back at the file, and the path in it, of the value they are about.
+// -----------------------------------------------------------------------------
+
+// ConfigDir is the directory of config fragments.
+var ConfigDir = filepath.Join(globals.ExeDir, "Mycelia_Config.d")
+
+// ConfigDirEnv is the environment variable naming the config directory.
+const ConfigDirEnv = EnvPrefix + "CONFIG_DIR"
+
+// Whether ConfigFile and ConfigDir were given, in which case they have to
+// exist.
+var (
+	ConfigFileRequired bool
+	ConfigDirRequired  bool
+)
+
+// Config is the config document the broker runs with, and where it came from.
+type Config struct {
+	Doc   []byte   // The merged document, nil if there was nothing to merge.
+	Files []string // The files merged, in order.
+
+	read    []byte                 // The names and contents of the files read.
+	origins map[string]ConfigError // Where merged values came from, by path.
+}
+
+// ReadConfig reads the config file and the fragments in ConfigDir and merges
+// them, with ConfigOverrides applied. The Config is returned even when there
+// are errors, so a reload can tell whether the files changed.
+func ReadConfig() (*Config, ConfigErrors) {
+	c := &Config{origins: map[string]ConfigError{}}
+	m := merger{doc: map[string]any{}, origins: c.origins}
+
+	files, errs := configFiles()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		c.read = append(c.read, file+"\x00"...)
+		c.read = append(c.read, data...)
+		c.read = append(c.read, 0)
+		if err != nil {
+			errs = append(errs, ConfigError{File: file, Msg: err.Error()})
+			continue
+		}
+		c.Files = append(c.Files, file)
+
+		doc, fileErrs := parseFile(file, data)
+		if len(fileErrs) == 0 {
+			fileErrs = checkLayer(doc, file != ConfigFile)
+		}
+		if len(fileErrs) == 0 {
+			obj, _ := doc.(map[string]any)
+			fileErrs = m.merge(file, obj)
+		}
+		for _, e := range fileErrs {
+			if e.File == "" {
+				e.File = file
+			}
+			errs = append(errs, e)
+		}
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	if len(c.Files) == 0 && len(ConfigOverrides) == 0 {
+		return c, nil
+	}
+
+	applyOverrides(m.doc, c.origins)
+	doc, err := json.Marshal(m.doc)
+	if err != nil {
+		return c, ConfigErrors{{Msg: err.Error()}}
+	}
+	c.Doc = doc
+	return c, nil
+}
+
+// Same reports whether the config was read from the same files with the same
+// contents as other.
+func (c *Config) Same(other *Config) bool {
+	return other != nil && bytes.Equal(c.read, other.read)
+}
+
+// Attribute points errors about the merged document at the file, and the path
+// in it, of the value each is about, or at the environment variable or CLI arg
+// that set it.
+func (c *Config) Attribute(errs ConfigErrors) ConfigErrors {
+	for i, e := range errs {
+		if e.File != "" {
+			continue
+		}
+		for path := e.Path; path != ""; path = parentPath(path) {
+			if origin, ok := c.origins[path]; ok {
+				errs[i].File = origin.File
+				errs[i].Path = origin.Path + e.Path[len(path):]
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// parentPath returns the path of the object or list holding the value at path.
+func parentPath(path string) string {
+	return path[:max(strings.LastIndexAny(path, ".["), 0)]
+}
+
+// configFiles returns the config file, if there is one, followed by the
+// fragments in ConfigDir in name order.
+func configFiles() ([]string, ConfigErrors) {
+	var files []string
+	var errs ConfigErrors
+
+	_, err := os.Stat(ConfigFile)
+	if err == nil || ConfigFileRequired || !errors.Is(err, os.ErrNotExist) {
+		files = append(files, ConfigFile)
+	}
+
+	entries, err := os.ReadDir(ConfigDir)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !ConfigDirRequired:
+	case err != nil:
+		errs = append(errs, ConfigError{File: ConfigDir, Msg: err.Error()})
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		file := filepath.Join(ConfigDir, name)
+		if entry.IsDir() || strings.HasPrefix(name, ".") ||
+			!slices.Contains(configExtensions, ext) || file == ConfigFile {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, errs
+}
+
+// checkLayer checks a file's document against SystemData, and that fragments
+// only hold parameters and routes.
+func checkLayer(doc any, fragment bool) ConfigErrors {
+	var errs ConfigErrors
+	checkValue(doc, reflect.TypeFor[SystemData](), "", &errs)
+	if !fragment {
+		return errs
+	}
+
+	obj, _ := doc.(map[string]any)
+	fields := jsonFields(reflect.TypeFor[SystemData]())
+	for _, key := range slices.Sorted(maps.Keys(obj)) {
+		if _, ok := fields[key]; ok && key != "parameters" && key != "routes" {
+			errs.Addf(key, "fragments may only hold parameters and routes")
+		}
+	}
+	return errs
+}
+
+// -------Merging---------------------------------------------------------------
+
+// merger merges the files' documents into one.
+type merger struct {
+	doc     map[string]any
+	origins map[string]ConfigError
+}
+
+// merge merges a file's document into the merged document, returning the
+// conflicts with the files merged before it.
+func (m *merger) merge(file string, doc map[string]any) ConfigErrors {
+	var errs ConfigErrors
+	for _, key := range slices.Sorted(maps.Keys(doc)) {
+		switch key {
+		case "parameters":
+			params, _ := doc[key].(map[string]any)
+			errs = append(errs, m.mergeParameters(file, params)...)
+		case "routes":
+			routes, _ := doc[key].([]any)
+			errs = append(errs, m.mergeRoutes(file, routes)...)
+		default: // Only the config file has the others.
+			m.doc[key] = doc[key]
+			m.origins[key] = ConfigError{File: file, Path: key}
+		}
+	}
+	return errs
+}
+
+func (m *merger) mergeParameters(
+	file string, params map[string]any,
+) ConfigErrors {
+	var errs ConfigErrors
+	merged, _ := m.doc["parameters"].(map[string]any)
+	if merged == nil {
+		merged = map[string]any{}
+		m.doc["parameters"] = merged
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		path := JoinPath("parameters", name)
+		prev, ok := m.origins[path]
+		switch {
+		case !ok:
+			merged[name] = params[name]
+			m.origins[path] = ConfigError{File: file, Path: path}
+		case !reflect.DeepEqual(merged[name], params[name]):
+			errs = append(errs, ConfigError{
+				File: file,
+				Path: path,
+				Msg:  fmt.Sprintf("conflicts with the value set in %s", prev.File),
+			})
+		}
+	}
+	return errs
+}
+
+func (m *merger) mergeRoutes(file string, routes []any) ConfigErrors {
+	var errs ConfigErrors
+	merged, _ := m.doc["routes"].([]any)
+
+	seen := map[string]bool{}
+	for i, r := range routes {
+		route, _ := r.(map[string]any)
+		name, _ := route["name"].(string)
+		path := IndexPath("routes", i)
+
+		// Routes the file lists twice are kept apart, for validation to report.
+		at := -1
+		if name != "" && !seen[name] {
+			at = indexByName(merged, name)
+		}
+		seen[name] = true
+		if at < 0 {
+			into := maps.Clone(route)
+			if into == nil {
+				into = map[string]any{}
+			}
+			into["channels"] = []any{}
+			merged = append(merged, into)
+			at = len(merged) - 1
+			m.origins[IndexPath("routes", at)] = ConfigError{File: file, Path: path}
+		}
+
+		channels, _ := route["channels"].([]any)
+		errs = append(errs,
+			m.mergeChannels(file, at, merged[at], channels, path)...,
+		)
+	}
+
+	m.doc["routes"] = merged
+	return errs
+}
+
+func (m *merger) mergeChannels(
+	file string, at int, into any, channels []any, path string,
+) ConfigErrors {
+	var errs ConfigErrors
+	route := into.(map[string]any)
+	routeName, _ := route["name"].(string)
+	merged, _ := route["channels"].([]any)
+	routePath := IndexPath("routes", at) + ".channels"
+
+	seen := map[string]bool{}
+	for j, c := range channels {
+		channel, _ := c.(map[string]any)
+		name, _ := channel["name"].(string)
+		channelPath := IndexPath(path+".channels", j)
+
+		k := -1
+		if name != "" && !seen[name] {
+			k = indexByName(merged, name)
+		}
+		seen[name] = true
+		if k >= 0 {
+			prev := m.origins[IndexPath(routePath, k)]
+			if !reflect.DeepEqual(merged[k], c) {
+				errs = append(errs, ConfigError{
+					File: file,
+					Path: channelPath,
+					Msg: fmt.Sprintf(
+						"channel %q of route %q is defined differently in %s",
+						name, routeName, prev.File,
+					),
+				})
+			}
+			continue
+		}
+
+		merged = append(merged, c)
+		m.origins[IndexPath(routePath, len(merged)-1)] = ConfigError{
+			File: file, Path: channelPath,
+		}
+	}
+
+	route["channels"] = merged
+	return errs
+}
+
+// indexByName returns the index of the object named name in list, or -1.
+func indexByName(list []any, name string) int {
+	return slices.IndexFunc(list, func(v any) bool {
+		obj, _ := v.(map[string]any)
+		return obj["name"] == name
+	})
+}
@@ -0,0 +1,281 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// useConfig writes the config file and the fragments, by name, to a temporary
+// directory and points ReadConfig at them with no overrides. An empty file
+// is not written.
+func useConfig(t *testing.T, file string, fragments map[string]string) string {
+	t.Helper()
+	prevFile, prevDir := ConfigFile, ConfigDir
+	prevFileReq, prevDirReq := ConfigFileRequired, ConfigDirRequired
+	prevOverrides := ConfigOverrides
+	t.Cleanup(func() {
+		ConfigFile, ConfigDir = prevFile, prevDir
+		ConfigFileRequired, ConfigDirRequired = prevFileReq, prevDirReq
+		ConfigOverrides = prevOverrides
+	})
+
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "Mycelia_Config.json")
+	ConfigDir = filepath.Join(dir, "Mycelia_Config.d")
+	ConfigFileRequired, ConfigDirRequired = false, false
+	ConfigOverrides = map[string]Override{}
+
+	if file != "" {
+		writeFile(t, ConfigFile, file)
+	}
+	for name, data := range fragments {
+		writeFile(t, filepath.Join(ConfigDir, name), data)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readConfig reads and decodes the config, failing on any error.
+func readConfig(t *testing.T) (*Config, *SystemData) {
+	t.Helper()
+	cfg, errs := ReadConfig()
+	if len(errs) > 0 {
+		t.Fatalf("ReadConfig: %v", errs)
+	}
+	sd, errs := DecodeConfig(cfg.Doc)
+	if len(errs) > 0 {
+		t.Fatalf("DecodeConfig: %v", errs)
+	}
+	return cfg, sd
+}
+
+// channelNames returns the route:channel names of the routes, in order.
+func channelNames(routes *[]RouteData) []string {
+	var names []string
+	if routes == nil {
+		return names
+	}
+	for _, rd := range *routes {
+		for _, cd := range rd.Channels {
+			names = append(names, rd.Name+":"+cd.Name)
+		}
+	}
+	return names
+}
+
+func TestReadConfigFragmentOrder(t *testing.T) {
+	dir := useConfig(t, `{"routes": [
+		{"name": "orders", "channels": [{"name": "intake"}]}
+	]}`, map[string]string{
+		"20-billing.json": `{"routes": [
+			{"name": "orders", "channels": [{"name": "billing"}]}
+		]}`,
+		"10-audit.yaml": "routes:\n" +
+			"  - name: orders\n" +
+			"    channels:\n" +
+			"      - name: audit\n" +
+			"  - name: returns\n" +
+			"    channels:\n" +
+			"      - name: intake\n",
+		"30-fraud.toml": "[[routes]]\n" +
+			"name = \"orders\"\n" +
+			"[[routes.channels]]\n" +
+			"name = \"fraud\"\n",
+		".hidden.json": `{"routes": [{"name": "hidden"}]}`,
+		"notes.txt":    `not a config file`,
+		"sub/40.json":  `{"routes": [{"name": "nested"}]}`,
+	})
+
+	cfg, sd := readConfig(t)
+
+	wantFiles := []string{
+		filepath.Join(dir, "Mycelia_Config.json"),
+		filepath.Join(dir, "Mycelia_Config.d", "10-audit.yaml"),
+		filepath.Join(dir, "Mycelia_Config.d", "20-billing.json"),
+		filepath.Join(dir, "Mycelia_Config.d", "30-fraud.toml"),
+	}
+	if !slices.Equal(cfg.Files, wantFiles) {
+		t.Errorf("Files = %v, want %v", cfg.Files, wantFiles)
+	}
+
+	want := []string{
+		"orders:intake", "orders:audit", "orders:billing", "orders:fraud",
+		"returns:intake",
+	}
+	if got := channelNames(sd.Routes); !slices.Equal(got, want) {
+		t.Errorf("channels = %v, want %v", got, want)
+	}
+}
+
+func TestReadConfigConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		fragments map[string]string
+		wantFile  string // The file the error is attributed to.
+		wantPath  string
+		wantMsg   string
+	}{
+		{
+			name: "parameter",
+			file: `{"parameters": {"verbosity": 1}}`,
+			fragments: map[string]string{
+				"10-a.json": `{"parameters": {"verbosity": 1}}`,
+				"20-b.json": `{"parameters": {"verbosity": 2}}`,
+			},
+			wantFile: "20-b.json",
+			wantPath: "parameters.verbosity",
+			wantMsg:  "Mycelia_Config.json",
+		},
+		{
+			name: "channel",
+			fragments: map[string]string{
+				"10-a.json": `{"routes": [{"name": "orders", "channels": [
+					{"name": "audit", "strategy": "pub-sub"}
+				]}]}`,
+				"20-b.json": `{"routes": [
+					{"name": "returns"},
+					{"name": "orders", "channels": [
+						{"name": "intake"},
+						{"name": "audit", "strategy": "round-robin"}
+					]}
+				]}`,
+			},
+			wantFile: "20-b.json",
+			wantPath: "routes[1].channels[1]",
+			wantMsg:  "10-a.json",
+		},
+		{
+			name: "channel subscribers",
+			file: `{"routes": [{"name": "orders", "channels": [
+				{"name": "audit", "subscribers": [{"address": "127.0.0.1:9001"}]}
+			]}]}`,
+			fragments: map[string]string{
+				"10-a.yaml": "routes:\n" +
+					"  - name: orders\n" +
+					"    channels:\n" +
+					"      - name: audit\n",
+			},
+			wantFile: "10-a.yaml",
+			wantPath: "routes[0].channels[0]",
+			wantMsg:  "Mycelia_Config.json",
+		},
+		{
+			name: "fragment section",
+			fragments: map[string]string{
+				"10-a.json": `{"parameters": {"verbosity": 1}}`,
+				"20-b.json": `{"roles": []}`,
+			},
+			wantFile: "20-b.json",
+			wantPath: "roles",
+			wantMsg:  "fragments may only hold parameters and routes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, tt.file, tt.fragments)
+			_, errs := ReadConfig()
+			if len(errs) != 1 {
+				t.Fatalf("ReadConfig errors = %v, want one", errs)
+			}
+			e := errs[0]
+			if filepath.Base(e.File) != tt.wantFile || e.Path != tt.wantPath ||
+				!strings.Contains(e.Msg, tt.wantMsg) {
+				t.Errorf("error = %q, want %s: %s: ...%s...",
+					e, tt.wantFile, tt.wantPath, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestConfigAttribute(t *testing.T) {
+	useConfig(t, `{"parameters": {"verbosity": 1}, "routes": [
+		{"name": "orders", "channels": [{"name": "intake"}]}
+	]}`, map[string]string{
+		"10-a.json": `{"routes": [
+			{"name": "returns", "channels": [{"name": "intake"}]},
+			{"name": "orders", "channels": [
+				{"name": "intake"},
+				{"name": "audit", "strategy": "pubsub"}
+			]}
+		]}`,
+	})
+	cfg, _ := readConfig(t)
+
+	// Errors about the merged document, as validation reports them.
+	errs := cfg.Attribute(ConfigErrors{
+		{Path: "parameters.verbosity", Msg: "bad"},
+		{Path: "routes[0].channels[1].strategy", Msg: "bad"},
+		{Path: "routes[1].name", Msg: "bad"},
+	})
+	want := []string{
+		"Mycelia_Config.json: parameters.verbosity: bad",
+		"10-a.json: routes[1].channels[1].strategy: bad",
+		"10-a.json: routes[0].name: bad",
+	}
+	for i, e := range errs {
+		got := filepath.Base(e.File) + ": " + e.Path + ": " + e.Msg
+		if got != want[i] {
+			t.Errorf("error %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestReadConfigOverrides(t *testing.T) {
+	useConfig(t, `{"parameters": {"verbosity": 1, "http-port": 8080}}`,
+		map[string]string{
+			"10-a.json": `{"parameters": {"resp-port": 6379}}`,
+			"20-b.json": `{"parameters": {"mqtt-port": 1883}}`,
+		},
+	)
+	t.Setenv(EnvName("resp-port"), "7000")
+	t.Setenv(EnvName("verbosity"), "2")
+
+	// As on startup, the environment only sets what the CLI did not.
+	ConfigOverrides["verbosity"] = Override{Value: 3, Source: "-verbosity"}
+	env, _ := EnvOverrides()
+	for name, o := range env {
+		if _, set := ConfigOverrides[name]; !set {
+			ConfigOverrides[name] = o
+		}
+	}
+
+	cfg, sd := readConfig(t)
+	p := sd.Parameters
+	got := []int{int(*p.Verbosity), *p.HTTPPort, *p.RESPPort, *p.MQTTPort}
+	if want := []int{3, 8080, 7000, 1883}; !slices.Equal(got, want) {
+		t.Errorf("verbosity, http, resp, mqtt ports = %v, want %v", got, want)
+	}
+
+	// Errors about overridden values point at the override.
+	errs := cfg.Attribute(ConfigErrors{
+		{Path: "parameters.verbosity", Msg: "bad"},
+		{Path: "parameters.resp-port", Msg: "bad"},
+		{Path: "parameters.mqtt-port", Msg: "bad"},
+	})
+	want := []string{
+		"-verbosity: bad",
+		"MYCELIA_RESP_PORT: bad",
+		"20-b.json: parameters.mqtt-port: bad",
+	}
+	for i, e := range errs {
+		if e.File != "" {
+			e.File = filepath.Base(e.File)
+		}
+		if got := e.Error(); got != want[i] {
+			t.Errorf("error %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
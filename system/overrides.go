@@ -0,0 +1,148 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the parameters set outside the config file, by MYCELIA_*
+// environment variables and CLI args.
+//
+// Parameters are taken from, lowest precedence first:
+//
+//	1. The built in defaults.
+//	2. The config file's "parameters" field.
+//	3. The environment, each parameter by MYCELIA_ and its name in upper case
+//	   with dashes as underscores, e.g. MYCELIA_HTTP_PORT for "http-port".
+//	4. CLI args given on the command line.
+//
+// The overrides are applied to the config each time it is read, so they still
+// win when it is reloaded.
+// -----------------------------------------------------------------------------
+
+// EnvPrefix starts the name of every environment variable the broker reads.
+const EnvPrefix = "MYCELIA_"
+
+// ConfigEnv is the environment variable naming the config file.
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// Override is a parameter value set outside the config file.
+type Override struct {
+	Value  any    // The value as it would appear in the config file.
+	Source string // The environment variable or CLI arg that set it.
+}
+
+// ConfigOverrides are the parameters set by the environment and the CLI, by
+// their name in the "parameters" field.
+var ConfigOverrides = map[string]Override{}
+
+// ParameterNames returns the names of the fields of the "parameters" field.
+func ParameterNames() []string {
+	names := slices.Collect(maps.Keys(jsonFields(reflect.TypeFor[ParamData]())))
+	slices.Sort(names)
+	return names
+}
+
+// EnvName returns the environment variable that overrides the parameter.
+func EnvName(param string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(param, "-", "_"))
+}
+
+// EnvOverrides returns the parameters set in the environment, and the names of
+// MYCELIA_ variables that are not a parameter.
+//
+// Values are read as the parameter's type: lists of strings are comma
+// separated and listeners are JSON. Values that do not parse are kept as
+// strings, for the config's validation to report.
+func EnvOverrides() (map[string]Override, []string) {
+	fields := jsonFields(reflect.TypeFor[ParamData]())
+	known := map[string]string{ConfigEnv: "", ConfigDirEnv: ""}
+	for name := range fields {
+		known[EnvName(name)] = name
+	}
+
+	overrides := map[string]Override{}
+	var unknown []string
+	for _, kv := range os.Environ() {
+		env, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(env, EnvPrefix) {
+			continue
+		}
+		name, ok := known[env]
+		switch {
+		case !ok:
+			unknown = append(unknown, env)
+			continue
+		case name == "":
+			continue
+		}
+		overrides[name] = Override{
+			Value:  envValue(value, fields[name]),
+			Source: env,
+		}
+	}
+	slices.Sort(unknown)
+	return overrides, unknown
+}
+
+// envValue reads an environment variable's value as type t.
+func envValue(s string, t reflect.Type) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			list := []any{}
+			for item := range strings.SplitSeq(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			return list
+		}
+		dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err == nil {
+			return v
+		}
+	}
+	return s
+}
+
+// applyOverrides replaces the document's parameters with ConfigOverrides,
+// recording where each came from in origins.
+func applyOverrides(doc map[string]any, origins map[string]ConfigError) {
+	if len(ConfigOverrides) == 0 {
+		return
+	}
+	if doc["parameters"] == nil {
+		doc["parameters"] = map[string]any{}
+	}
+	params, ok := doc["parameters"].(map[string]any)
+	if !ok {
+		return
+	}
+	for name, o := range ConfigOverrides {
+		params[name] = o.Value
+		origins[JoinPath("parameters", name)] = ConfigError{Path: o.Source}
+	}
+}
@@ -0,0 +1,202 @@
+package reload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
+	"mycelia/system"
+	"mycelia/system/validate"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the hot reload of the config into the running broker.
+//
+// The config is reloaded on SIGHUP, and whenever one of its files changes
+// while globals.ConfigWatch is set. A reload applies the config as a config
+// apply made by the broker itself: runtime parameters are updated as by a
+// globals update, and its routes are diffed against the live topology. Routes,
+// channels, and components the previous load listed and the config no longer
+// does are removed, ones added at runtime are kept.
+//
+// The config is read as on startup, the config file and the fragments in the
+// config directory merged, with their references interpolated and the
+// environment and CLI overrides applied, so parameters set by those are not
+// changed by a reload. A change to any of the files reloads them all.
+//
+// Files that do not parse or validate, as on startup, are rejected whole with
+// the errors in the log, and the broker is left as it was. Parameters that
+// cannot change at runtime, security tokens, sources, and access control need
+// a restart.
+// -----------------------------------------------------------------------------
+
+// reloader holds what the config was when it was last loaded.
+type reloader struct {
+	broker *routing.Broker
+
+	seen     *system.Config     // The config read at the last check.
+	routes   []system.RouteData // The routes of the last file loaded.
+	sections map[string]string  // The restart only sections at startup.
+}
+
+// Watch reloads the config into the broker on SIGHUP, and on changes
+// every globals.ConfigWatch.
+func Watch(b *routing.Broker) {
+	r := &reloader{broker: b}
+	r.seen, _ = system.ReadConfig()
+	r.routes, _ = parseRoutes(r.seen.Doc)
+	r.sections = restartSections(r.seen.Doc)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if globals.ConfigWatch > 0 {
+		tick = time.NewTicker(globals.ConfigWatch).C
+	}
+
+	go func() {
+		for {
+			select {
+			case <-sighup:
+				logging.LogSystemAction("Received SIGHUP, reloading config file")
+				r.reload(true)
+			case <-tick:
+				r.reload(false)
+			}
+		}
+	}()
+}
+
+// reload applies the config if any of its files changed since the last
+// check, or regardless when forced.
+func (r *reloader) reload(force bool) {
+	cfg, errs := system.ReadConfig()
+	if !force && cfg.Same(r.seen) {
+		return
+	}
+	r.seen = cfg
+	if len(errs) == 0 && len(cfg.Files) == 0 {
+		if force {
+			logging.LogSystemWarning(
+				fmt.Sprintf("No config file at %s", system.ConfigFile),
+			)
+		}
+		return
+	}
+
+	var sd *system.SystemData
+	if len(errs) == 0 {
+		sd, errs = validate.Config(cfg)
+	} else {
+		errs = cfg.Attribute(errs)
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			logging.LogSystemError(fmt.Sprintf("Rejected config: %s", e))
+		}
+		return
+	}
+	var routes []system.RouteData
+	if sd.Routes != nil {
+		routes = *sd.Routes
+	}
+
+	report, err := r.broker.ReloadConfig(cfg.Doc, r.routes)
+	switch {
+	case errors.Is(err, routing.ErrShuttingDown):
+		return
+	case errors.Is(err, routing.ErrInvalidConfig):
+		for _, msg := range report.Errors {
+			logging.LogSystemError(fmt.Sprintf("Rejected config: %s", msg))
+		}
+		return
+	case err != nil:
+		logging.LogSystemError(fmt.Sprintf("Config reload incomplete: %s", err))
+		if report != nil {
+			for _, msg := range report.Errors {
+				logging.LogSystemError(fmt.Sprintf("Config reload: %s", msg))
+			}
+		}
+	}
+
+	r.routes = routes
+	for _, c := range report.RestartRequired {
+		logging.LogSystemWarning(fmt.Sprintf(
+			"Config file changed %s, it needs a restart to apply", c.Field,
+		))
+	}
+	for _, name := range changedSections(r.sections, restartSections(cfg.Doc)) {
+		logging.LogSystemWarning(fmt.Sprintf(
+			"Config file changed %s, it needs a restart to apply", name,
+		))
+	}
+
+	logging.LogSystemAction(fmt.Sprintf(
+		"Reloaded config from %s, %d changes",
+		strings.Join(cfg.Files, ", "), len(report.Changes),
+	))
+}
+
+// parseRoutes returns the routes of a config file's document.
+func parseRoutes(data []byte) ([]system.RouteData, system.ConfigErrors) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	sd, errs := system.DecodeConfig(data)
+	if len(errs) > 0 || sd.Routes == nil {
+		return nil, errs
+	}
+	return *sd.Routes, nil
+}
+
+// restartSections returns the compacted sections of a config file's document
+// that a reload does not apply, by name.
+func restartSections(data []byte) map[string]string {
+	var doc, params map[string]json.RawMessage
+	_ = json.Unmarshal(data, &doc)
+	_ = json.Unmarshal(doc["parameters"], &params)
+
+	raw := map[string]json.RawMessage{
+		"security-tokens": params["security-tokens"],
+		"sources":         doc["sources"],
+		"roles":           doc["roles"],
+		"principals":      doc["principals"],
+		"tokens":          doc["tokens"],
+	}
+	sections := map[string]string{}
+	for name, v := range raw {
+		var buf bytes.Buffer
+		if len(v) > 0 && json.Compact(&buf, v) == nil {
+			sections[name] = buf.String()
+		}
+	}
+	return sections
+}
+
+// changedSections returns the names of the sections that differ.
+func changedSections(before, after map[string]string) []string {
+	names := slices.Concat(
+		slices.Collect(maps.Keys(before)), slices.Collect(maps.Keys(after)),
+	)
+	slices.Sort(names)
+
+	var changed []string
+	for _, name := range slices.Compact(names) {
+		if before[name] != after[name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
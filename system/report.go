@@ -0,0 +1,37 @@
+package system
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is how the shutdown report is read and written.
+// -----------------------------------------------------------------------------
+
+// ReadShutdownReport reads the report at ShutdownReportFile. Returns nil and
+// no error if there is none.
+func ReadShutdownReport() (*ShutdownReport, error) {
+	data, err := os.ReadFile(ShutdownReportFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var report ShutdownReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// WriteShutdownReport replaces the report at ShutdownReportFile.
+func WriteShutdownReport(report *ShutdownReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(ShutdownReportFile, append(data, '\n'))
+}
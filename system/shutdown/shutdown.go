@@ -1,13 +1,113 @@
 package shutdown
 
 import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"mycelia/gateway"
+	"mycelia/globals"
 	"mycelia/logging"
+	"mycelia/routing"
+	"mycelia/system"
 
 	"github.com/signal-weave/siglog"
 )
 
-func Shutdown() {
+// -----------------------------------------------------------------------------
+// Herein is the shutdown process, the bottom of the stack startup begins.
+//
+// SIGINT and SIGTERM stop the server the same way a sigterm command does. A
+// second signal exits immediately, leaving the running marker in place so the
+// next start knows this run did not shut down.
+// -----------------------------------------------------------------------------
+
+// stopper is the server being shut down.
+type stopper interface {
+	Shutdown()
+}
+
+// received is the signal that stopped the server, if one did.
+var received atomic.Value // os.Signal
+
+// HandleSignals shuts the server down on SIGINT or SIGTERM.
+func HandleSignals(s stopper) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		received.Store(sig)
+		logging.LogSystemAction(fmt.Sprintf("Received %s, shutting down", sig))
+		fmt.Printf("\nReceived %s, shutting down. Signal again to exit now.\n", sig)
+		s.Shutdown()
+
+		sig = <-sigs
+		logging.LogSystemWarning(fmt.Sprintf("Received %s, exiting now", sig))
+		siglog.Shutdown()
+		os.Exit(1)
+	}()
+}
+
+// Shutdown stops the gateways and drains the broker within
+// globals.ShutdownTimeout, then writes the shutdown report. cause is the error
+// that stopped the server, if any.
+func Shutdown(b *routing.Broker, cause error) {
 	logging.LogSystemAction("Starting shutdown Process!")
 
+	deadline := time.Now().Add(globals.ShutdownTimeout)
+	gateway.Stop(deadline)
+	undelivered, err := b.Close(deadline)
+	if err != nil {
+		logging.LogSystemError(fmt.Sprintf("Shutdown lost deliveries: %s", err))
+	}
+	if undelivered > 0 {
+		logging.LogSystemWarning(fmt.Sprintf(
+			"Wrote %d undelivered deliveries to %s",
+			undelivered, routing.UndeliveredLogPath(),
+		))
+	}
+
+	if err := system.WriteShutdownReport(report(cause, undelivered, err)); err != nil {
+		logging.LogSystemError(
+			fmt.Sprintf("Could not write shutdown report: %s", err),
+		)
+	}
+
+	logging.LogSystemAction("Ending shutdown Process!")
 	siglog.Shutdown()
 }
+
+// report builds the shutdown report. The shutdown was graceful if every
+// delivery still queued was either delivered or written to the undelivered
+// log.
+func report(cause error, undelivered int, closeErr error) *system.ShutdownReport {
+	graceful := closeErr == nil
+	stopped := time.Now().UTC()
+
+	reason := "shutdown command"
+	if sig, ok := received.Load().(os.Signal); ok {
+		reason = fmt.Sprintf("signal: %s", sig)
+	}
+	if cause != nil {
+		reason = cause.Error()
+	}
+
+	r := &system.ShutdownReport{
+		GracefulShutdown: &graceful,
+		Stopped:          &stopped,
+		Reason:           &reason,
+	}
+	if marker, _ := system.ReadShutdownReport(); marker != nil {
+		r.Started = marker.Started
+	}
+	if undelivered > 0 {
+		path := routing.UndeliveredLogPath()
+		r.Undelivered = &undelivered
+		r.UndeliveredLog = &path
+	}
+	return r
+}
@@ -1,15 +1,19 @@
 package startup
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"net/netip"
 	"os"
-	"regexp"
+	"slices"
 	"strings"
 
+	"mycelia/comm"
 	"mycelia/globals"
+	"mycelia/system"
+	"mycelia/system/validate"
 
 	"github.com/signal-weave/siglog"
 )
@@ -37,23 +41,153 @@ func parseRuntimeArgs(argv []string) error {
 		xformTimeoutHelp,
 	)
 
-	workersHelp := "The number of server workers to allocate to the listener"
+	workersHelp := "The number of workers handling objects from client connections"
 	fs.IntVar(&globals.WorkerCount, "workers", globals.WorkerCount, workersHelp)
 
+	fs.DurationVar(
+		&globals.IdleTimeout, "idle-timeout", globals.IdleTimeout,
+		"Close client connections idle this long (e.g. 5m), 0 disables",
+	)
+	fs.DurationVar(
+		&globals.ReadTimeout, "read-timeout", globals.ReadTimeout,
+		"Max time a client may take to finish sending a frame, 0 disables",
+	)
+	fs.DurationVar(
+		&globals.DrainTimeout, "drain-timeout", globals.DrainTimeout,
+		"How long connections on a replaced listener get to finish",
+	)
+	fs.DurationVar(
+		&globals.ShutdownTimeout, "shutdown-timeout", globals.ShutdownTimeout,
+		"How long queued deliveries get to reach subscribers on shutdown",
+	)
+	fs.DurationVar(
+		&globals.ConfigWatch, "config-watch", globals.ConfigWatch,
+		"How often the config file is checked for changes, 0 disables",
+	)
+
 	cleanHelp := "Whether to auto-consolidate router shape on component removal"
 	fs.BoolVar(
 		&globals.AutoConsolidate, "consolidate", globals.AutoConsolidate,
 		cleanHelp,
 	)
 
+	authHelp := "Require every connection to authenticate before any command"
+	fs.BoolVar(&globals.RequireAuth, "require-auth", globals.RequireAuth, authHelp)
+
+	auditHelp := "Audit log file, defaults to audit.jsonl in the log directory"
+	fs.StringVar(&globals.AuditLogFile, "audit-log", globals.AuditLogFile, auditHelp)
+
+	fs.StringVar(
+		&globals.FileSinkDir, "sink-dir", globals.FileSinkDir,
+		"Directory file: subscribers write under, empty disables them",
+	)
+	fs.StringVar(
+		&globals.ExportDir, "export-dir", globals.ExportDir,
+		"Directory config exports and apply reports are written under",
+	)
+	fs.StringVar(
+		&globals.StateFile, "state-file", globals.StateFile,
+		"File the live topology is persisted to, empty disables it",
+	)
+	fs.DurationVar(
+		&globals.StateInterval, "state-interval", globals.StateInterval,
+		"How often the state file is written, 0 writes on every change",
+	)
+	fs.StringVar(
+		&globals.StateRestore, "state-restore", globals.StateRestore,
+		"How the state file is restored: merge, replace, or off",
+	)
+
+	var allowCIDRs, denyCIDRs string
+	fs.StringVar(
+		&allowCIDRs, "allow-cidrs", strings.Join(globals.AllowCIDRs, ","),
+		"Comma separated CIDRs clients may connect from",
+	)
+	fs.StringVar(
+		&denyCIDRs, "deny-cidrs", strings.Join(globals.DenyCIDRs, ","),
+		"Comma separated CIDRs clients may not connect from",
+	)
+	fs.IntVar(
+		&globals.MaxConnections, "max-conns", globals.MaxConnections,
+		"Max concurrent client connections, 0 is unlimited",
+	)
+	fs.IntVar(
+		&globals.MaxConnectionsPerIP, "max-conns-per-ip", globals.MaxConnectionsPerIP,
+		"Max concurrent client connections per address, 0 is unlimited",
+	)
+	fs.Float64Var(
+		&globals.ConnectionRate, "conn-rate", globals.ConnectionRate,
+		"New connections per second allowed per address, 0 is unlimited",
+	)
+	fs.IntVar(
+		&globals.ConnectionBurst, "conn-burst", globals.ConnectionBurst,
+		"New connections per address allowed at once before -conn-rate applies",
+	)
+
+	httpHelp := "HTTP gateway port (1-65535), 0 disables the gateway"
+	fs.IntVar(&globals.HTTPPort, "http-port", globals.HTTPPort, httpHelp)
+
+	mqttHelp := "MQTT gateway port (1-65535), 0 disables the gateway"
+	fs.IntVar(&globals.MQTTPort, "mqtt-port", globals.MQTTPort, mqttHelp)
+
+	respHelp := "Redis pub/sub gateway port (1-65535), 0 disables the gateway"
+	fs.IntVar(&globals.RESPPort, "resp-port", globals.RESPPort, respHelp)
+
+	stompHelp := "STOMP gateway port (1-65535), 0 disables the gateway"
+	fs.IntVar(&globals.STOMPPort, "stomp-port", globals.STOMPPort, stompHelp)
+
+	fs.StringVar(
+		&globals.TLSCertFile, "tls-cert", globals.TLSCertFile,
+		"PEM certificate for the client listener, enables TLS",
+	)
+	fs.StringVar(
+		&globals.TLSKeyFile, "tls-key", globals.TLSKeyFile,
+		"PEM private key for -tls-cert",
+	)
+	fs.StringVar(
+		&globals.TLSMinVersion, "tls-min-version", globals.TLSMinVersion,
+		"Lowest accepted TLS version (1.0, 1.1, 1.2, 1.3)",
+	)
+	fs.StringVar(
+		&globals.TLSClientCAFile, "tls-client-ca", globals.TLSClientCAFile,
+		"PEM CA bundle client certificates must be signed by, enables mTLS",
+	)
+
+	fs.StringVar(
+		&configFileArg, "config", "",
+		"Config file (.json, .yaml, .yml, or .toml), overrides MYCELIA_CONFIG",
+	)
+	fs.StringVar(
+		&configDirArg, "config-dir", "",
+		"Directory of config fragments, overrides MYCELIA_CONFIG_DIR",
+	)
+	fs.BoolVar(
+		&checkConfigArg, "check-config", false,
+		"Validate the config, print any errors, and exit",
+	)
+
+	fs.StringVar(
+		&hashTokenArg, "hash-token", "",
+		"Print the sha256: form of a security token and exit",
+	)
+	fs.StringVar(
+		&issueTokenArg, "issue-token", "",
+		"Print a signed token for the given subject and exit",
+	)
+	fs.StringVar(
+		&tokenScopesArg, "token-scopes", "",
+		"Comma separated scopes for -issue-token, e.g. publish:orders-*,subscribe",
+	)
+	fs.DurationVar(
+		&tokenTTLArg, "token-ttl", tokenTTLArg, "Lifetime of -issue-token tokens",
+	)
+
 	verbosityHelp := `0 - None
     1 - Errors
     2 - Warnings + Errors
     3 - Errors + Warnings + Actions`
 	var temp int
 	fs.IntVar(&temp, "verbosity", int(globals.Verbosity), verbosityHelp)
-	globals.Verbosity = siglog.LogLevel(temp)
-	globals.UpdateVerbosityEnvironVar()
 
 	logOutputHelp := `0 - .log file
 	1 - console
@@ -66,11 +200,45 @@ func parseRuntimeArgs(argv []string) error {
 
   -address string      Bind address (IP or hostname)
   -port int            Bind port (1-65535)
-  -workers int		   The server listener worker count (1-1024)
+  -workers int		   Workers handling client objects (1-1024)
   -verbosity int       0, 1, 2, or 3
   -log-output int	   0, 1, or 2
   -print-tree          Print router tree at startup
   -xform-timeout dur   Transformer timeout
+  -idle-timeout dur    Close client connections idle this long, 0 disables
+  -read-timeout dur    Max time to finish sending a frame (default 30s)
+  -drain-timeout dur   Time old connections get after a rebind (default 30s)
+  -shutdown-timeout dur
+                       Time queued deliveries get on shutdown (default 30s)
+  -config-watch dur    How often to check the config file for changes (default 2s)
+  -require-auth        Require connections to authenticate
+  -audit-log path      Audit log file (default logs/audit.jsonl)
+  -sink-dir path       Directory file: subscribers write under, unset disables
+  -export-dir path     Directory exports and apply reports go under, unset disables
+  -state-file path     Live topology file, empty disables (default Mycelia_State.json)
+  -state-interval dur  How often to write the state file, 0 on every change
+  -state-restore mode  merge, replace, or off (default merge)
+  -allow-cidrs list    Comma separated CIDRs clients may connect from
+  -deny-cidrs list     Comma separated CIDRs clients may not connect from
+  -max-conns int       Max concurrent connections, 0 is unlimited (default 4096)
+  -max-conns-per-ip n  Max concurrent connections per address (default 0)
+  -conn-rate float     New connections per second per address (default 0)
+  -conn-burst int      Connection burst per address before -conn-rate applies
+  -http-port int       HTTP gateway port, 0 disables (default 0)
+  -mqtt-port int       MQTT gateway port, 0 disables (default 0)
+  -resp-port int       Redis pub/sub gateway port, 0 disables (default 0)
+  -stomp-port int      STOMP gateway port, 0 disables (default 0)
+  -tls-cert path       PEM certificate, enables TLS on the listener
+  -tls-key path        PEM private key for -tls-cert
+  -tls-min-version v   Lowest accepted TLS version (default 1.2)
+  -tls-client-ca path  PEM CA bundle to verify client certificates against
+  -config path         Config file, JSON, YAML, or TOML (default Mycelia_Config.json)
+  -config-dir path     Directory of config fragments (default Mycelia_Config.d)
+  -check-config        Validate the config, print any errors, and exit
+  -hash-token string   Print the sha256: form of a security token and exit
+  -issue-token string  Print a signed token for the subject and exit
+  -token-scopes list   Comma separated scopes for -issue-token
+  -token-ttl dur       Lifetime of -issue-token tokens (default 24h)
 
 Examples:
   mycelia -addr 0.0.0.0 -port 8080 -verbosity 2 -print-tree -xform-timeout 45s
@@ -80,59 +248,124 @@ Examples:
 	if err := fs.Parse(argv); err != nil {
 		return err
 	}
+	globals.Verbosity = siglog.LogLevel(temp)
+	globals.UpdateVerbosityEnvironVar()
+	globals.AllowCIDRs = splitList(allowCIDRs)
+	globals.DenyCIDRs = splitList(denyCIDRs)
 
 	if err := validateRuntimeConfig(); err != nil {
 		return err
 	}
 
+	cliOverrides(fs)
 	return nil
 }
 
+// cliOverrides records the parameters given on the command line in
+// system.ConfigOverrides, so they take precedence over the config file and
+// the environment.
+func cliOverrides(fs *flag.FlagSet) {
+	params := system.NewParamData()
+	params.LogOutput = &globals.LogOutput
+	data, _ := json.Marshal(params)
+
+	var values map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	_ = dec.Decode(&values)
+
+	names := system.ParameterNames()
+	fs.Visit(func(f *flag.Flag) {
+		if slices.Contains(names, f.Name) {
+			system.ConfigOverrides[f.Name] = system.Override{
+				Value:  values[f.Name],
+				Source: "-" + f.Name,
+			}
+		}
+	})
+}
+
 func validateRuntimeConfig() error {
 	if globals.Port < 1 || globals.Port > 65535 {
 		return fmt.Errorf("invalid port %d (expected 1-65535)", globals.Port)
 	}
 	// Allow hostnames; validate if it looks like an IP.
-	if !isIPLiteral(globals.Address) && !isValidHostname(globals.Address) {
+	if !validate.Host(globals.Address) {
 		return fmt.Errorf("invalid IP address %q", globals.Address)
 	}
 	if globals.TransformTimeout <= 0 {
 		return errors.New("xform-timeout must be > 0")
 	}
+	if globals.IdleTimeout < 0 || globals.ReadTimeout < 0 {
+		return errors.New("idle-timeout and read-timeout must be >= 0")
+	}
+	if globals.DrainTimeout < 0 {
+		return errors.New("drain-timeout must be >= 0")
+	}
+	if globals.ShutdownTimeout < 0 {
+		return errors.New("shutdown-timeout must be >= 0")
+	}
+	if globals.ConfigWatch < 0 {
+		return errors.New("config-watch must be >= 0")
+	}
+	if globals.StateInterval < 0 {
+		return errors.New("state-interval must be >= 0")
+	}
+	if !validate.StateRestore(globals.StateRestore) {
+		return fmt.Errorf("invalid state-restore %q", globals.StateRestore)
+	}
 	if globals.WorkerCount <= 0 || globals.WorkerCount > 1024 {
 		return fmt.Errorf("invalid worker count %d", globals.WorkerCount)
 	}
+	if globals.HTTPPort < 0 || globals.HTTPPort > 65535 {
+		return fmt.Errorf("invalid http port %d (expected 0-65535)", globals.HTTPPort)
+	}
+	if globals.MQTTPort < 0 || globals.MQTTPort > 65535 {
+		return fmt.Errorf("invalid mqtt port %d (expected 0-65535)", globals.MQTTPort)
+	}
+	if globals.RESPPort < 0 || globals.RESPPort > 65535 {
+		return fmt.Errorf("invalid resp port %d (expected 0-65535)", globals.RESPPort)
+	}
+	if globals.STOMPPort < 0 || globals.STOMPPort > 65535 {
+		return fmt.Errorf("invalid stomp port %d (expected 0-65535)", globals.STOMPPort)
+	}
+	if (globals.TLSCertFile == "") != (globals.TLSKeyFile == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if globals.TLSClientCAFile != "" && globals.TLSCertFile == "" {
+		return errors.New("tls-client-ca requires tls-cert and tls-key")
+	}
+	if _, ok := comm.TLSVersions[globals.TLSMinVersion]; !ok {
+		return fmt.Errorf("invalid tls min version %q", globals.TLSMinVersion)
+	}
+	if _, err := comm.ParsePrefixes(globals.AllowCIDRs); err != nil {
+		return fmt.Errorf("allow-cidrs: %w", err)
+	}
+	if _, err := comm.ParsePrefixes(globals.DenyCIDRs); err != nil {
+		return fmt.Errorf("deny-cidrs: %w", err)
+	}
+	if globals.MaxConnections < 0 || globals.MaxConnectionsPerIP < 0 {
+		return errors.New("connection limits must be >= 0")
+	}
+	if globals.ConnectionRate < 0 || globals.ConnectionBurst < 0 {
+		return errors.New("conn-rate and conn-burst must be >= 0")
+	}
+	if tokenTTLArg <= 0 {
+		return errors.New("token-ttl must be > 0")
+	}
 	if globals.LogOutput < 0 || globals.LogOutput > 2 {
 		return fmt.Errorf("invalid log output value %d", globals.LogOutput)
 	}
 	return nil
 }
 
-func isIPLiteral(s string) bool {
-	_, err := netip.ParseAddr(s)
-	return err == nil
-}
-
-// isValidHostname does a syntax-only RFC-1123 style check (no DNS lookups).
-// - total length <= 253
-// - labels are 1..63 chars, [A-Za-z0-9-], no leading/trailing '-'
-var hostnameLabelRE = regexp.MustCompile(
-	`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`,
-)
-
-func isValidHostname(s string) bool {
-	if len(s) == 0 || len(s) > 253 {
-		return false
-	}
-	// Special-case: common localhost
-	if s == "localhost" {
-		return true
-	}
-	labels := strings.Split(s, ".")
-	for _, lbl := range labels {
-		if !hostnameLabelRE.MatchString(lbl) {
-			return false
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
 	}
-	return true
+	return list
 }
@@ -1,53 +1,120 @@
 package startup
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	"mycelia/globals"
 	"mycelia/logging"
 	"mycelia/system"
+	"mycelia/system/validate"
 
 	"github.com/google/uuid"
 	"github.com/signal-weave/rhizome"
+	"github.com/signal-weave/siglog"
 )
 
 // -----------------------------------------------------------------------------
 // Mycelia will check for a Mycelia_Config.json file in the same directory as
-// the .exe file.
+// the .exe file, or a .yaml, .yml, or .toml one if there is no .json file.
+// -config or MYCELIA_CONFIG give another path instead.
 
-// The Mycelia_Config.json file acts as an alternative or addition to providing
-// values on startup.
+// Fragments of config in the Mycelia_Config.d directory beside it, or the one
+// given by -config-dir or MYCELIA_CONFIG_DIR, are merged into the file's
+// parameters and routes, see system/layers.go.
 
-// It will overwrite any matching CLI values.
+// The config file acts as an alternative or addition to providing values on
+// startup.
+
+// Its parameters are overwritten by any MYCELIA_* environment variables, which
+// are in turn overwritten by any CLI values given, see system/overrides.go.
 
 // Any CLI value can be placed under the "parameters" field in the json as well
 // as any pre-defined routes/channels/transformers/subscribers (provided they
 // specify their parent object) that the router should start up with.
+
+// The broker will not start if the config has any errors, see validate.go.
 // -----------------------------------------------------------------------------
 
-func getConfigData() {
-	_, err := os.Stat(system.ConfigFile)
-	if err != nil {
-		logging.LogSystemAction(
-			"No Mycelia_Config.json found, skipping pre-init process.",
+// configFileArg is set by -config, configDirArg by -config-dir.
+var configFileArg, configDirArg string
+
+// locateConfig sets system.ConfigFile to the file named by -config or
+// MYCELIA_CONFIG, or else the first of system.ConfigNames found beside the
+// executable, and system.ConfigDir to the directory named by -config-dir or
+// MYCELIA_CONFIG_DIR. Files and directories named have to exist.
+func locateConfig() {
+	dir := configDirArg
+	if dir == "" {
+		dir = os.Getenv(system.ConfigDirEnv)
+	}
+	if dir != "" {
+		system.ConfigDirRequired = true
+		system.ConfigDir = absPath(dir)
+	}
+
+	file := configFileArg
+	if file == "" {
+		file = os.Getenv(system.ConfigEnv)
+	}
+	if file != "" {
+		system.ConfigFileRequired = true
+		system.ConfigFile = absPath(file)
+		return
+	}
+	for _, name := range system.ConfigNames {
+		file := filepath.Join(globals.ExeDir, name)
+		if _, err := os.Stat(file); err == nil {
+			system.ConfigFile = file
+			return
+		}
+	}
+}
+
+// absPath returns path made absolute, or as is if it cannot be.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// loadEnvOverrides adds the parameters set by MYCELIA_* environment variables
+// to system.ConfigOverrides, below those given on the CLI.
+func loadEnvOverrides() {
+	overrides, unknown := system.EnvOverrides()
+	for _, env := range unknown {
+		logging.LogSystemWarning(
+			fmt.Sprintf("Ignoring unknown environment variable %s", env),
 		)
 	}
-	data, err := os.ReadFile(system.ConfigFile)
-	if err != nil {
-		logging.LogSystemError(
-			"Could not import PreInit JSON data - Skipping Pre-Init.",
+	for name, o := range overrides {
+		if _, set := system.ConfigOverrides[name]; !set {
+			system.ConfigOverrides[name] = o
+		}
+	}
+}
+
+// getConfigData loads the config, refusing to start the broker if it cannot
+// be read or is invalid.
+func getConfigData() {
+	cfg, errs := system.ReadConfig()
+	if len(errs) > 0 {
+		refuseConfig(errs)
+	}
+	if cfg.Doc == nil {
+		logging.LogSystemAction(
+			"No config file found, skipping pre-init process.",
 		)
 		return
 	}
 
-	var bd system.SystemData
-	err = json.Unmarshal(data, &bd)
-	if err != nil {
-		logging.LogSystemError(fmt.Sprintf("Cannot unmarshal config file: %s", err))
+	bd, errs := validate.Config(cfg)
+	if len(errs) > 0 {
+		refuseConfig(errs)
 	}
 
 	if bd.Parameters != nil {
@@ -56,12 +123,37 @@ func getConfigData() {
 	if bd.Routes != nil {
 		parseRouteObjects(*bd.Routes)
 	}
+	if bd.Sources != nil {
+		system.SourceList = append(system.SourceList, *bd.Sources...)
+	}
+	if bd.Roles != nil {
+		globals.Roles = append(globals.Roles, *bd.Roles...)
+	}
+	if bd.Principals != nil {
+		globals.Principals = append(globals.Principals, *bd.Principals...)
+	}
+	if bd.Tokens != nil {
+		parseTokenData(*bd.Tokens)
+	}
+}
+
+// refuseConfig reports the config's errors and exits.
+func refuseConfig(errs system.ConfigErrors) {
+	for _, e := range errs {
+		msg := fmt.Sprintf("Invalid config: %s", e)
+		logging.LogSystemError(msg)
+		_, _ = fmt.Fprintln(os.Stderr, msg)
+	}
+	_, _ = fmt.Fprintln(os.Stderr, "Refusing to start with an invalid config")
+	siglog.Shutdown()
+	os.Exit(2)
 }
 
-// Update globals from non-routing data.
+// Update globals from non-routing data, the parameters of the config file and
+// its fragments merged.
 func parseRuntimeConfigurable(pd system.ParamData) {
 	fmt.Println(
-		"PreInit runtime values found - these will overwrite any CLI values...",
+		"PreInit runtime values found - applying them under any CLI values...",
 	)
 
 	if pd.Address != nil {
@@ -81,9 +173,7 @@ func parseRuntimeConfigurable(pd system.ParamData) {
 		globals.PrintTree = *pd.PrintTree
 	}
 	if pd.TransformTimeout != nil {
-		if d, err := time.ParseDuration(*pd.TransformTimeout); err == nil {
-			globals.TransformTimeout = d
-		}
+		globals.TransformTimeout = parseDuration(*pd.TransformTimeout)
 	}
 	if pd.AutoConsolidate != nil {
 		globals.AutoConsolidate = *pd.AutoConsolidate
@@ -91,6 +181,106 @@ func parseRuntimeConfigurable(pd system.ParamData) {
 	if pd.SecurityToken != nil {
 		globals.SecurityTokens = *pd.SecurityToken
 	}
+	if pd.RequireAuth != nil {
+		globals.RequireAuth = *pd.RequireAuth
+	}
+	if pd.AuditLogFile != nil {
+		globals.AuditLogFile = *pd.AuditLogFile
+	}
+	if pd.FileSinkDir != nil {
+		globals.FileSinkDir = *pd.FileSinkDir
+	}
+	if pd.ExportDir != nil {
+		globals.ExportDir = *pd.ExportDir
+	}
+	if pd.StateFile != nil {
+		globals.StateFile = *pd.StateFile
+	}
+	if pd.StateInterval != nil {
+		globals.StateInterval = parseDuration(*pd.StateInterval)
+	}
+	if pd.StateRestore != nil {
+		globals.StateRestore = *pd.StateRestore
+	}
+	if pd.Listeners != nil {
+		globals.Listeners = *pd.Listeners
+	}
+	if pd.AllowCIDRs != nil {
+		globals.AllowCIDRs = *pd.AllowCIDRs
+	}
+	if pd.DenyCIDRs != nil {
+		globals.DenyCIDRs = *pd.DenyCIDRs
+	}
+	if pd.MaxConns != nil {
+		globals.MaxConnections = *pd.MaxConns
+	}
+	if pd.MaxConnsPerIP != nil {
+		globals.MaxConnectionsPerIP = *pd.MaxConnsPerIP
+	}
+	if pd.ConnRate != nil {
+		globals.ConnectionRate = *pd.ConnRate
+	}
+	if pd.ConnBurst != nil {
+		globals.ConnectionBurst = *pd.ConnBurst
+	}
+	if pd.IdleTimeout != nil {
+		globals.IdleTimeout = parseDuration(*pd.IdleTimeout)
+	}
+	if pd.ReadTimeout != nil {
+		globals.ReadTimeout = parseDuration(*pd.ReadTimeout)
+	}
+	if pd.DrainTimeout != nil {
+		globals.DrainTimeout = parseDuration(*pd.DrainTimeout)
+	}
+	if pd.ShutdownTimeout != nil {
+		globals.ShutdownTimeout = parseDuration(*pd.ShutdownTimeout)
+	}
+	if pd.ConfigWatch != nil {
+		globals.ConfigWatch = parseDuration(*pd.ConfigWatch)
+	}
+	if pd.HTTPPort != nil {
+		globals.HTTPPort = *pd.HTTPPort
+	}
+	if pd.MQTTPort != nil {
+		globals.MQTTPort = *pd.MQTTPort
+	}
+	if pd.RESPPort != nil {
+		globals.RESPPort = *pd.RESPPort
+	}
+	if pd.RESPDelimiter != nil {
+		globals.RESPDelimiter = *pd.RESPDelimiter
+	}
+	if pd.STOMPPort != nil {
+		globals.STOMPPort = *pd.STOMPPort
+	}
+	if pd.TLSCertFile != nil {
+		globals.TLSCertFile = *pd.TLSCertFile
+	}
+	if pd.TLSKeyFile != nil {
+		globals.TLSKeyFile = *pd.TLSKeyFile
+	}
+	if pd.TLSMinVersion != nil {
+		globals.TLSMinVersion = *pd.TLSMinVersion
+	}
+	if pd.TLSClientCAFile != nil {
+		globals.TLSClientCAFile = *pd.TLSClientCAFile
+	}
+}
+
+// parseTokenData loads the signed token keys and denylist.
+func parseTokenData(td system.TokenData) {
+	if td.Keys != nil {
+		globals.TokenKeys = append(globals.TokenKeys, *td.Keys...)
+	}
+	if td.SigningKey != nil {
+		globals.TokenSigningKey = *td.SigningKey
+	}
+	if td.Denylist != nil {
+		globals.TokenDenylist = *td.Denylist
+	}
+	if td.DenylistFile != nil {
+		globals.TokenDenylistFile = *td.DenylistFile
+	}
 }
 
 /* -----------------------------------------------------------------------------
@@ -108,8 +298,50 @@ the "routes" field, or children of it, could not exist.
 	"consolidate": true,
     "security-tokens": [
       "lockheed",
-      "martin"
-    ]
+      "sha256:6c1c3fa3e1f3e4ed1b1c8e6c5b5d6a8f4b9f0c2d3e4f5a6b7c8d9e0f1a2b3c4d"
+    ],
+    "require-auth": true,
+    "audit-log": "logs/audit.jsonl",
+    "sink-dir": "sinks",
+    "export-dir": "exports",
+    "state-file": "Mycelia_State.json",
+    "state-interval": "0s",
+    "state-restore": "merge",
+    "listeners": [
+      {
+        "name": "sidecars",
+        "protocol": "unix",
+        "address": "/run/mycelia/mycelia.sock",
+        "mode": "0660",
+        "auth": "trusted"
+      },
+      {
+        "name": "remote",
+        "protocol": "tls",
+        "address": "0.0.0.0:8443",
+        "auth": "required"
+      }
+    ],
+    "allow-cidrs": ["10.0.0.0/8", "127.0.0.1"],
+    "deny-cidrs": ["10.13.0.0/16"],
+    "max-conns": 10000,
+    "max-conns-per-ip": 64,
+    "conn-rate": 10,
+    "conn-burst": 20,
+    "idle-timeout": "10m",
+    "read-timeout": "30s",
+    "drain-timeout": "30s",
+    "shutdown-timeout": "30s",
+    "config-watch": "2s",
+    "http-port": 8081,
+    "mqtt-port": 1883,
+    "resp-port": 6379,
+    "resp-delimiter": ":",
+    "stomp-port": 61613,
+    "tls-cert": "certs/server.pem",
+    "tls-key": "certs/server-key.pem",
+    "tls-min-version": "1.2",
+    "tls-client-ca": "certs/clients-ca.pem"
   },
   "routes": [
     {
@@ -124,41 +356,82 @@ the "routes" field, or children of it, could not exist.
           ],
           "subscribers": [
             { "address": "127.0.0.1:1234" },
-            { "address": "16.70.18.1:9999" }
+            { "address": "16.70.18.1:9999" },
+            {
+              "address": "orders.internal:9443",
+              "tls": {
+                "ca": "certs/internal-ca.pem",
+                "cert": "certs/mycelia.pem",
+                "key": "certs/mycelia-key.pem",
+                "server-name": "orders.internal"
+              }
+            }
           ]
         }
       ]
     }
-  ]
+  ],
+  "sources": [
+    {
+      "name": "app-log",
+      "type": "file",
+      "path": "/var/log/app/events.log",
+      "route": "default"
+    },
+    {
+      "name": "orders-spool",
+      "type": "directory",
+      "path": "/var/spool/orders",
+      "pattern": "*.json",
+      "route": "default",
+      "poll": "2s",
+      "delete": true
+    }
+  ],
+  "roles": [
+    {
+      "name": "orders-writer",
+      "permissions": ["publish"],
+      "routes": ["orders-*"]
+    },
+    {
+      "name": "operator",
+      "permissions": [
+        "publish", "subscribe", "manage-topology", "manage-globals", "shutdown"
+      ]
+    }
+  ],
+  "principals": [
+    { "name": "checkout", "tokens": ["c4f3-b4b3"], "roles": ["orders-writer"] },
+    { "name": "ops", "identities": ["ops.example.com"], "roles": ["operator"] }
+  ],
+  "tokens": {
+    "keys": [
+      { "id": "2025-06", "file": "keys/2025-06.key" },
+      { "id": "2025-01", "secret": "base64:c2VjcmV0LXNpZ25pbmcta2V5LWJ5dGVz" }
+    ],
+    "signing-key": "2025-06",
+    "denylist": ["9f2c4e1a7b3d5f6e8a0c1b2d3e4f5a6b"],
+    "denylist-file": "revoked-tokens.txt"
+  }
 }
 ----------------------------------------------------------------------------- */
 
-func parseRouteObjects(routeData []map[string]any) {
+// parseRouteObjects queues the commands that build the routes onto
+// system.ObjectList. Routes from fragments arrive merged by name, each channel
+// once, however many files define it.
+func parseRouteObjects(routeData []system.RouteData) {
 	for _, route := range routeData {
-		routeName, _ := route["name"].(string)
-
-		rawChannels, exists := route["channels"].([]any)
-		if !exists {
-			continue
-		}
-
-		for _, ch := range rawChannels {
-			channel, ok := ch.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			parseChannels(channel, routeName)
-			parseTransformers(channel, routeName)
-			parseSubscribers(channel, routeName)
+		for _, channel := range route.Channels {
+			parseChannels(channel, route.Name)
+			parseTransformers(channel, route.Name)
+			parseSubscribers(channel, route.Name)
 		}
 	}
 }
 
-func parseChannels(channelData map[string]any, routeName string) {
-	channelName, _ := channelData["name"].(string)
-	strategyName, _ := channelData["strategy"].(string)
-	strategy := strconv.Itoa(int(globals.StrategyValue[strategyName]))
+func parseChannels(channelData system.ChannelData, routeName string) {
+	strategy := strconv.Itoa(int(channelData.SelectionStrategy()))
 	id := uuid.New().String()
 
 	obj := rhizome.NewObject(
@@ -167,7 +440,7 @@ func parseChannels(channelData map[string]any, routeName string) {
 		globals.AckPlcyNoreply,
 		id,
 		routeName,
-		channelName,
+		channelData.Name,
 		strategy,
 		"",
 		[]byte{},
@@ -176,24 +449,17 @@ func parseChannels(channelData map[string]any, routeName string) {
 	system.ObjectList = append(system.ObjectList, obj)
 }
 
-func parseTransformers(channelData map[string]any, routeName string) {
-	channelName, _ := channelData["name"].(string)
-	rawTransformers, _ := channelData["transformers"].([]any)
-	for _, t := range rawTransformers {
-		transformer, ok := t.(map[string]any)
-		if !ok {
-			continue
-		}
+func parseTransformers(channelData system.ChannelData, routeName string) {
+	for _, transformer := range channelData.Transformers {
 		id := uuid.New().String()
-		addr := transformer["address"].(string)
 		obj := rhizome.NewObject(
 			globals.ObjTransformer,
 			globals.CmdAdd,
 			globals.AckPlcyNoreply,
 			id,
 			routeName,
-			channelName,
-			addr,
+			channelData.Name,
+			transformer.DialAddress(),
 			"",
 			[]byte{},
 		)
@@ -201,27 +467,26 @@ func parseTransformers(channelData map[string]any, routeName string) {
 	}
 }
 
-func parseSubscribers(channelData map[string]any, routeName string) {
-	channelName, _ := channelData["name"].(string)
-	rawSubscribers, _ := channelData["subscribers"].([]any)
-	for _, s := range rawSubscribers {
-		subscriber, ok := s.(map[string]any)
-		if !ok {
-			continue
-		}
+func parseSubscribers(channelData system.ChannelData, routeName string) {
+	for _, subscriber := range channelData.Subscribers {
 		id := uuid.New().String()
-		addr := subscriber["address"].(string)
 		obj := rhizome.NewObject(
 			globals.ObjSubscriber,
 			globals.CmdAdd,
 			globals.AckPlcyNoreply,
 			id,
 			routeName,
-			channelName,
-			addr,
+			channelData.Name,
+			subscriber.DialAddress(),
 			"",
 			[]byte{},
 		)
 		system.ObjectList = append(system.ObjectList, obj)
 	}
 }
+
+// parseDuration parses a duration the config file was validated to hold.
+func parseDuration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
@@ -0,0 +1,61 @@
+package startup
+
+import (
+	"fmt"
+	"time"
+
+	"mycelia/logging"
+	"mycelia/system"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the recovery side of startup, reading how the last run shut down
+// and leaving the marker that lets the next run know how this one did.
+// -----------------------------------------------------------------------------
+
+// checkLastShutdown loads the previous run's shutdown report into
+// system.LastShutdown, warning if that run did not shut down gracefully, and
+// replaces it with a report marking this run as running.
+func checkLastShutdown() {
+	report, err := system.ReadShutdownReport()
+	if err != nil {
+		logging.LogSystemError(
+			fmt.Sprintf("Could not read last shutdown report: %s", err),
+		)
+	}
+	system.LastShutdown = report
+
+	switch {
+	case report == nil:
+	case report.GracefulShutdown == nil || !*report.GracefulShutdown:
+		wMsg := "Last run did not shut down gracefully"
+		if report.Stopped == nil {
+			wMsg += ", it stopped without writing a shutdown report"
+			if report.Started != nil {
+				wMsg += fmt.Sprintf(" (started %s)", report.Started.Format(time.RFC3339))
+			}
+		} else if report.Reason != nil {
+			wMsg += fmt.Sprintf(": %s", *report.Reason)
+		}
+		wMsg += ". Deliveries in flight at the time may have been lost."
+		fmt.Println(wMsg)
+		logging.LogSystemWarning(wMsg)
+	case report.Undelivered != nil && *report.Undelivered > 0:
+		logging.LogSystemAction(fmt.Sprintf(
+			"Last run left %d undelivered deliveries, replaying them",
+			*report.Undelivered,
+		))
+	}
+
+	running := false
+	started := time.Now().UTC()
+	marker := &system.ShutdownReport{
+		GracefulShutdown: &running,
+		Started:          &started,
+	}
+	if err := system.WriteShutdownReport(marker); err != nil {
+		logging.LogSystemError(
+			fmt.Sprintf("Could not write shutdown report: %s", err),
+		)
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"mycelia/globals"
 	"mycelia/logging"
+	"mycelia/routing"
 	"mycelia/system"
 
 	"github.com/signal-weave/siglog"
@@ -25,11 +26,30 @@ func Startup(argv []string) {
 
 	str.PrintStartupText(system.BuildMetadata.String())
 	parseCli(argv)
+	locateConfig()
+	loadEnvOverrides()
+	runConfigCheck()
 	parseConfigFile()
+	loadStateFile()
+	runTokenCommands()
+	checkLastShutdown()
+	warnOpenAccess()
 
 	logging.LogSystemAction("Ending startup Process!")
 }
 
+// warnOpenAccess warns when the broker runs fully open, with nothing for
+// connections to authenticate with and anonymous ones let in.
+func warnOpenAccess() {
+	if globals.RequireAuth || routing.AccessConfigured() {
+		return
+	}
+	msg := "No security tokens, principals, or token keys are configured, " +
+		"anonymous connections may publish and change the topology"
+	logging.LogSystemWarning(msg)
+	fmt.Println(msg)
+}
+
 // initializeLogger sets all the logging values including log level, output
 // directory, and batch mode.
 func initializeLogger() {
@@ -66,11 +86,8 @@ func parseCli(argv []string) {
 	}
 }
 
-// Check for a Mycelia_Config.json file in the .exe directory.
-// If found -> load values.
+// Check for a config file, -config or one in the .exe directory.
+// If found -> load values, with the environment and CLI overrides.
 func parseConfigFile() {
-	_, err := os.Stat(system.ConfigFile)
-	if err == nil {
-		getConfigData()
-	}
+	getConfigData()
 }
@@ -0,0 +1,86 @@
+package startup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+	"mycelia/routing"
+	"mycelia/system"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the restore of the state file, the live topology the last run
+// persisted.
+//
+// Precedence against the config file's routes follows globals.StateRestore:
+//
+//	merge   - The config file's routes are loaded first and the state file's
+//	          are added to them. Anything added at runtime comes back, but
+//	          config routes removed at runtime are recreated.
+//	replace - The state file's routes are loaded instead of the config file's,
+//	          so the broker comes back exactly as it was. The config file's
+//	          routes are only used when there is no state file.
+//	off     - The state file is written but never restored.
+//
+// Parameters, sources, and access control always come from the CLI and the
+// config file, the state file only holds routes.
+// -----------------------------------------------------------------------------
+
+// loadStateFile queues the state file's routes onto system.ObjectList.
+func loadStateFile() {
+	if globals.StateFile == "" || globals.StateRestore == globals.StateRestoreOff {
+		return
+	}
+
+	path := comm.ResolvePath(globals.StateFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		logging.LogSystemError(fmt.Sprintf("Could not read state file: %s", err))
+		return
+	}
+
+	var sd system.StateData
+	if err := json.Unmarshal(data, &sd); err != nil {
+		logging.LogSystemError(
+			fmt.Sprintf("Cannot unmarshal state file %s: %s", path, err),
+		)
+		return
+	}
+	if errs := routing.ValidateRoutes(sd.Routes); len(errs) > 0 {
+		for _, e := range errs {
+			logging.LogSystemError(
+				fmt.Sprintf("Invalid state file %s: %s", path, e),
+			)
+		}
+		logging.LogSystemError("Skipping state restore")
+		return
+	}
+
+	if globals.StateRestore == globals.StateRestoreReplace {
+		system.ObjectList = slices.DeleteFunc(system.ObjectList, isTopology)
+	}
+	parseRouteObjects(sd.Routes)
+	logging.LogSystemAction(fmt.Sprintf(
+		"Restoring state from %s (%s)", path, globals.StateRestore,
+	))
+}
+
+// isTopology reports whether the object adds to the routing topology.
+func isTopology(obj *rhizome.Object) bool {
+	switch obj.ObjType {
+	case globals.ObjChannel, globals.ObjTransformer, globals.ObjSubscriber:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package startup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"mycelia/tokens"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are the one-shot token commands. They run after the config file is
+// read, so the token keys are loaded, print their result, and exit.
+// -----------------------------------------------------------------------------
+
+// Token command flags, set by parseRuntimeArgs.
+var (
+	hashTokenArg   string
+	issueTokenArg  string
+	tokenScopesArg string
+	tokenTTLArg    = 24 * time.Hour
+)
+
+// runTokenCommands runs the token command given on the CLI, if any, and exits.
+func runTokenCommands() {
+	switch {
+	case hashTokenArg != "":
+		fmt.Println(tokens.Hash(hashTokenArg))
+		os.Exit(0)
+
+	case issueTokenArg != "":
+		var scopes []string
+		for _, s := range strings.Split(tokenScopesArg, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				scopes = append(scopes, s)
+			}
+		}
+
+		token, claims, err := tokens.Issue(issueTokenArg, scopes, tokenTTLArg)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Could not issue token: %s\n", err)
+			os.Exit(2)
+		}
+		_, _ = fmt.Fprintf(
+			os.Stderr, "Token %s for %s, key %s, expires %s\n",
+			claims.ID, claims.Subject, claims.KeyID,
+			claims.ExpiresAt().UTC().Format(time.RFC3339),
+		)
+		fmt.Println(token)
+		os.Exit(0)
+	}
+}
@@ -0,0 +1,44 @@
+package startup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"mycelia/system"
+	"mycelia/system/validate"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is -check-config, which reports what is wrong with the config, as
+// validated by the validate package, without starting the broker.
+// -----------------------------------------------------------------------------
+
+// checkConfigArg is set by -check-config.
+var checkConfigArg bool
+
+// runConfigCheck validates the config and exits if -check-config was given, 0
+// if the config is valid and 1 if it is not.
+func runConfigCheck() {
+	if !checkConfigArg {
+		return
+	}
+
+	cfg, errs := system.ReadConfig()
+	if len(errs) == 0 && cfg.Doc == nil {
+		fmt.Fprintf(os.Stderr, "No config file at %s\n", system.ConfigFile)
+		os.Exit(1)
+	}
+	if len(errs) == 0 {
+		_, errs = validate.Config(cfg)
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		fmt.Fprintln(os.Stderr, "Config is invalid")
+		os.Exit(1)
+	}
+	fmt.Printf("Config is valid: %s\n", strings.Join(cfg.Files, ", "))
+	os.Exit(0)
+}
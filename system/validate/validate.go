@@ -0,0 +1,330 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/routing"
+	"mycelia/source"
+	"mycelia/system"
+	"mycelia/tokens"
+)
+
+// -----------------------------------------------------------------------------
+// Herein is the validation of the config, shared by startup and reload.
+//
+// The merged config is decoded strictly into system.SystemData and every value
+// is then checked the way the CLI checks its flags. Every error is reported
+// with the file and JSON path of the value it is about. The broker does not
+// start with a config that has any, and a reload rejects it whole, before any
+// of it is applied.
+// -----------------------------------------------------------------------------
+
+// Config decodes and validates the merged config document, pointing the errors
+// at the files the values came from.
+func Config(cfg *system.Config) (*system.SystemData, system.ConfigErrors) {
+	sd, errs := system.DecodeConfig(cfg.Doc)
+	if len(errs) > 0 {
+		return nil, cfg.Attribute(errs)
+	}
+
+	if sd.Parameters != nil {
+		errs = append(errs, Parameters(*sd.Parameters)...)
+	}
+	if sd.Routes != nil {
+		errs = append(errs, routing.ValidateRoutes(*sd.Routes)...)
+	}
+	if sd.Sources != nil {
+		for i, src := range *sd.Sources {
+			if err := source.Validate(src); err != nil {
+				errs.Addf(system.IndexPath("sources", i), "%s", err)
+			}
+		}
+	}
+	errs = append(errs, AccessControl(sd.Roles, sd.Principals)...)
+	if sd.Tokens != nil {
+		errs = append(errs, TokenData(*sd.Tokens)...)
+	}
+
+	if len(errs) > 0 {
+		return nil, cfg.Attribute(errs)
+	}
+	return sd, nil
+}
+
+// Parameters checks the "parameters" field. tls-cert and tls-key are checked
+// together with the values they overwrite.
+func Parameters(pd system.ParamData) system.ConfigErrors {
+	var errs system.ConfigErrors
+	const root = "parameters"
+	at := func(field string) string { return system.JoinPath(root, field) }
+
+	if pd.Address != nil && !Host(*pd.Address) {
+		errs.Addf(at("address"), "invalid IP address %q", *pd.Address)
+	}
+	if pd.Port != nil && (*pd.Port < 1 || *pd.Port > 65535) {
+		errs.Addf(at("port"), "invalid port %d (expected 1-65535)", *pd.Port)
+	}
+	if pd.Verbosity != nil && (*pd.Verbosity < 0 || *pd.Verbosity > 3) {
+		errs.Addf(at("verbosity"),
+			"invalid verbosity %d (expected 0-3)", *pd.Verbosity,
+		)
+	}
+	if pd.LogOutput != nil && (*pd.LogOutput < 0 || *pd.LogOutput > 2) {
+		errs.Addf(at("log-output"),
+			"invalid log output %d (expected 0-2)", *pd.LogOutput,
+		)
+	}
+
+	checkDuration(&errs, at("xform-timeout"), pd.TransformTimeout, false)
+	checkDuration(&errs, at("state-interval"), pd.StateInterval, true)
+	checkDuration(&errs, at("idle-timeout"), pd.IdleTimeout, true)
+	checkDuration(&errs, at("read-timeout"), pd.ReadTimeout, true)
+	checkDuration(&errs, at("drain-timeout"), pd.DrainTimeout, true)
+	checkDuration(&errs, at("shutdown-timeout"), pd.ShutdownTimeout, true)
+	checkDuration(&errs, at("config-watch"), pd.ConfigWatch, true)
+
+	if pd.StateRestore != nil && !StateRestore(*pd.StateRestore) {
+		errs.Addf(at("state-restore"),
+			"invalid state-restore %q (expected merge, replace, or off)",
+			*pd.StateRestore,
+		)
+	}
+
+	checkCIDRs(&errs, at("allow-cidrs"), pd.AllowCIDRs)
+	checkCIDRs(&errs, at("deny-cidrs"), pd.DenyCIDRs)
+
+	if pd.MaxConns != nil && *pd.MaxConns < 0 {
+		errs.Addf(at("max-conns"), "must be >= 0")
+	}
+	if pd.MaxConnsPerIP != nil && *pd.MaxConnsPerIP < 0 {
+		errs.Addf(at("max-conns-per-ip"), "must be >= 0")
+	}
+	if pd.ConnRate != nil && *pd.ConnRate < 0 {
+		errs.Addf(at("conn-rate"), "must be >= 0")
+	}
+	if pd.ConnBurst != nil && *pd.ConnBurst < 0 {
+		errs.Addf(at("conn-burst"), "must be >= 0")
+	}
+
+	checkGatewayPort(&errs, at("http-port"), pd.HTTPPort)
+	checkGatewayPort(&errs, at("mqtt-port"), pd.MQTTPort)
+	checkGatewayPort(&errs, at("resp-port"), pd.RESPPort)
+	checkGatewayPort(&errs, at("stomp-port"), pd.STOMPPort)
+	if pd.RESPDelimiter != nil && *pd.RESPDelimiter == "" {
+		errs.Addf(at("resp-delimiter"), "must not be empty")
+	}
+
+	cert, key := globals.TLSCertFile, globals.TLSKeyFile
+	clientCA := globals.TLSClientCAFile
+	if pd.TLSCertFile != nil {
+		cert = *pd.TLSCertFile
+	}
+	if pd.TLSKeyFile != nil {
+		key = *pd.TLSKeyFile
+	}
+	if pd.TLSClientCAFile != nil {
+		clientCA = *pd.TLSClientCAFile
+	}
+	tlsSet := pd.TLSCertFile != nil || pd.TLSKeyFile != nil
+	if tlsSet && (cert == "") != (key == "") {
+		field := "tls-key"
+		if cert == "" {
+			field = "tls-cert"
+		}
+		errs.Addf(at(field), "tls-cert and tls-key must be set together")
+	}
+	if pd.TLSClientCAFile != nil && clientCA != "" && cert == "" {
+		errs.Addf(at("tls-client-ca"), "requires tls-cert and tls-key")
+	}
+	if pd.TLSMinVersion != nil {
+		if _, ok := comm.TLSVersions[*pd.TLSMinVersion]; !ok {
+			errs.Addf(at("tls-min-version"),
+				"invalid tls min version %q", *pd.TLSMinVersion,
+			)
+		}
+	}
+
+	if pd.Listeners != nil {
+		names := map[string]bool{}
+		for i, l := range *pd.Listeners {
+			path := system.IndexPath(at("listeners"), i)
+			err := comm.ValidateListenerTLS(l, cert != "" || key != "")
+			if err != nil {
+				errs.Addf(path, "%s", err)
+			} else if names[l.Name] {
+				errs.Addf(path+".name", "duplicate listener name %q", l.Name)
+			}
+			names[l.Name] = true
+		}
+	}
+	return errs
+}
+
+// checkDuration adds an error if the value at path is set and is not a
+// duration above 0, or at or above 0 if zero is allowed.
+func checkDuration(errs *system.ConfigErrors, path string, v *string, zero bool) {
+	if v == nil {
+		return
+	}
+	d, err := time.ParseDuration(*v)
+	switch {
+	case err != nil:
+		errs.Addf(path, "invalid duration %q (e.g. 500ms, 30s, 2m)", *v)
+	case zero && d < 0:
+		errs.Addf(path, "must be >= 0")
+	case !zero && d <= 0:
+		errs.Addf(path, "must be > 0")
+	}
+}
+
+// checkCIDRs adds an error for each entry of the list at path that is not a
+// CIDR or address.
+func checkCIDRs(errs *system.ConfigErrors, path string, cidrs *[]string) {
+	if cidrs == nil {
+		return
+	}
+	for i, cidr := range *cidrs {
+		if _, err := comm.ParsePrefixes([]string{cidr}); err != nil {
+			errs.Addf(system.IndexPath(path, i), "%s", err)
+		}
+	}
+}
+
+// checkGatewayPort adds an error if the port at path is set and out of range,
+// 0 disabling the gateway.
+func checkGatewayPort(errs *system.ConfigErrors, path string, port *int) {
+	if port != nil && (*port < 0 || *port > 65535) {
+		errs.Addf(path, "invalid port %d (expected 0-65535)", *port)
+	}
+}
+
+// AccessControl checks the "roles" and "principals" fields.
+func AccessControl(
+	roles *[]globals.Role, principals *[]globals.Principal,
+) system.ConfigErrors {
+	var errs system.ConfigErrors
+
+	known := map[string]bool{}
+	if roles != nil {
+		for i, role := range *roles {
+			if err := validateRole(role, known); err != nil {
+				errs.Addf(system.IndexPath("roles", i), "%s", err)
+			}
+			known[role.Name] = true
+		}
+	}
+
+	if principals == nil {
+		return errs
+	}
+	for i, p := range *principals {
+		path := system.IndexPath("principals", i)
+		if p.Name == "" {
+			errs.Addf(path+".name", "principal has no name")
+		}
+		for j, r := range p.Roles {
+			if !known[r] {
+				errs.Addf(system.IndexPath(path+".roles", j), "unknown role %q", r)
+			}
+		}
+	}
+	return errs
+}
+
+// validateRole checks a role, known holding the names of the roles before it.
+func validateRole(role globals.Role, known map[string]bool) error {
+	if role.Name == "" {
+		return errors.New("role without a name")
+	}
+	if known[role.Name] {
+		return fmt.Errorf("duplicate role %q", role.Name)
+	}
+	for _, perm := range role.Permissions {
+		if !slices.Contains(globals.Permissions, perm) {
+			return fmt.Errorf("role %q: unknown permission %q", role.Name, perm)
+		}
+	}
+	for _, pattern := range role.Routes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("role %q: bad route pattern %q", role.Name, pattern)
+		}
+	}
+	return nil
+}
+
+// TokenData checks the "tokens" field.
+func TokenData(td system.TokenData) system.ConfigErrors {
+	var errs system.ConfigErrors
+
+	ids := map[string]bool{}
+	if td.Keys != nil {
+		for i, k := range *td.Keys {
+			path := system.IndexPath("tokens.keys", i)
+			if err := tokens.ValidateKey(k); err != nil {
+				errs.Addf(path, "%s", err)
+			} else if ids[k.ID] {
+				errs.Addf(path+".id", "duplicate token key %q", k.ID)
+			}
+			ids[k.ID] = true
+		}
+	}
+	if td.SigningKey != nil && *td.SigningKey != "" && !ids[*td.SigningKey] {
+		errs.Addf("tokens.signing-key", "unknown token key %q", *td.SigningKey)
+	}
+	return errs
+}
+
+// -------Values----------------------------------------------------------------
+
+// Host reports whether s is an IP address or a syntactically valid hostname.
+func Host(s string) bool {
+	return isIPLiteral(s) || isValidHostname(s)
+}
+
+func isIPLiteral(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+// isValidHostname does a syntax-only RFC-1123 style check (no DNS lookups).
+// - total length <= 253
+// - labels are 1..63 chars, [A-Za-z0-9-], no leading/trailing '-'
+var hostnameLabelRE = regexp.MustCompile(
+	`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`,
+)
+
+func isValidHostname(s string) bool {
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	// Special-case: common localhost
+	if s == "localhost" {
+		return true
+	}
+	labels := strings.Split(s, ".")
+	for _, lbl := range labels {
+		if !hostnameLabelRE.MatchString(lbl) {
+			return false
+		}
+	}
+	return true
+}
+
+// StateRestore reports whether mode is one of the StateRestore modes.
+func StateRestore(mode string) bool {
+	switch mode {
+	case globals.StateRestoreMerge, globals.StateRestoreReplace,
+		globals.StateRestoreOff:
+		return true
+	}
+	return false
+}
@@ -1,8 +1,12 @@
 package system
 
 import (
+	"encoding/json"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"mycelia/comm"
 	"mycelia/globals"
 
 	"github.com/signal-weave/rhizome"
@@ -15,10 +19,20 @@ import (
 
 var ConfigFile = filepath.Join(globals.ExeDir, "Mycelia_Config.json")
 
+// ShutdownReportFile is where the broker records how it last shut down.
+var ShutdownReportFile = filepath.Join(globals.ExeDir, "Mycelia_Shutdown.json")
+
+// LastShutdown is the report the previous run left behind, nil on first run.
+var LastShutdown *ShutdownReport
+
 // ObjectList is a list of commands used for booting up and pre-configuring the broker
 // based on the Mycelia_Config.json file.
 var ObjectList []*rhizome.Object
 
+// SourceList is the list of source connectors defined in the
+// Mycelia_Config.json file that the broker should start feeding from.
+var SourceList []SourceData
+
 // -------System Runtime Data Structures----------------------------------------
 
 // ParamData Proxy struct for unmarshalling the Mycelia_Config.json runtime data into
@@ -26,18 +40,52 @@ var ObjectList []*rhizome.Object
 // This handles type conversion - Go marshals json integers to float64 by
 // default for whatever fucking reason.
 type ParamData struct {
-	Address          *string          `json:"address"`
-	Port             *int             `json:"port"`
-	Verbosity        *siglog.LogLevel `json:"verbosity"`
-	LogOutput        *int             `json:"log-output"`
-	PrintTree        *bool            `json:"print-tree"`
-	TransformTimeout *string          `json:"xform-timeout"`
-	AutoConsolidate  *bool            `json:"consolidate"`
-	SecurityToken    *[]string        `json:"security-tokens"`
+	Address          *string             `json:"address"`
+	Port             *int                `json:"port"`
+	Verbosity        *siglog.LogLevel    `json:"verbosity"`
+	LogOutput        *int                `json:"log-output"`
+	PrintTree        *bool               `json:"print-tree"`
+	TransformTimeout *string             `json:"xform-timeout"`
+	AutoConsolidate  *bool               `json:"consolidate"`
+	SecurityToken    *[]string           `json:"security-tokens,omitempty"`
+	RequireAuth      *bool               `json:"require-auth"`
+	AuditLogFile     *string             `json:"audit-log"`
+	FileSinkDir      *string             `json:"sink-dir"`
+	ExportDir        *string             `json:"export-dir"`
+	StateFile        *string             `json:"state-file"`
+	StateInterval    *string             `json:"state-interval"`
+	StateRestore     *string             `json:"state-restore"`
+	Listeners        *[]globals.Listener `json:"listeners"`
+	AllowCIDRs       *[]string           `json:"allow-cidrs"`
+	DenyCIDRs        *[]string           `json:"deny-cidrs"`
+	MaxConns         *int                `json:"max-conns"`
+	MaxConnsPerIP    *int                `json:"max-conns-per-ip"`
+	ConnRate         *float64            `json:"conn-rate"`
+	ConnBurst        *int                `json:"conn-burst"`
+	IdleTimeout      *string             `json:"idle-timeout"`
+	ReadTimeout      *string             `json:"read-timeout"`
+	DrainTimeout     *string             `json:"drain-timeout"`
+	ShutdownTimeout  *string             `json:"shutdown-timeout"`
+	ConfigWatch      *string             `json:"config-watch"`
+	HTTPPort         *int                `json:"http-port"`
+	MQTTPort         *int                `json:"mqtt-port"`
+	RESPPort         *int                `json:"resp-port"`
+	RESPDelimiter    *string             `json:"resp-delimiter"`
+	STOMPPort        *int                `json:"stomp-port"`
+	TLSCertFile      *string             `json:"tls-cert"`
+	TLSKeyFile       *string             `json:"tls-key"`
+	TLSMinVersion    *string             `json:"tls-min-version"`
+	TLSClientCAFile  *string             `json:"tls-client-ca"`
 }
 
 func NewParamData() *ParamData {
 	timeoutStr := globals.TransformTimeout.String()
+	idleStr := globals.IdleTimeout.String()
+	readStr := globals.ReadTimeout.String()
+	drainStr := globals.DrainTimeout.String()
+	shutdownStr := globals.ShutdownTimeout.String()
+	configWatchStr := globals.ConfigWatch.String()
+	stateIntervalStr := globals.StateInterval.String()
 
 	return &ParamData{
 		Address:          &globals.Address,
@@ -47,31 +95,166 @@ func NewParamData() *ParamData {
 		TransformTimeout: &timeoutStr,
 		AutoConsolidate:  &globals.AutoConsolidate,
 		SecurityToken:    &globals.SecurityTokens,
+		RequireAuth:      &globals.RequireAuth,
+		AuditLogFile:     &globals.AuditLogFile,
+		FileSinkDir:      &globals.FileSinkDir,
+		ExportDir:        &globals.ExportDir,
+		StateFile:        &globals.StateFile,
+		StateInterval:    &stateIntervalStr,
+		StateRestore:     &globals.StateRestore,
+		Listeners:        &globals.Listeners,
+		AllowCIDRs:       &globals.AllowCIDRs,
+		DenyCIDRs:        &globals.DenyCIDRs,
+		MaxConns:         &globals.MaxConnections,
+		MaxConnsPerIP:    &globals.MaxConnectionsPerIP,
+		ConnRate:         &globals.ConnectionRate,
+		ConnBurst:        &globals.ConnectionBurst,
+		IdleTimeout:      &idleStr,
+		ReadTimeout:      &readStr,
+		DrainTimeout:     &drainStr,
+		ShutdownTimeout:  &shutdownStr,
+		ConfigWatch:      &configWatchStr,
+		HTTPPort:         &globals.HTTPPort,
+		MQTTPort:         &globals.MQTTPort,
+		RESPPort:         &globals.RESPPort,
+		RESPDelimiter:    &globals.RESPDelimiter,
+		STOMPPort:        &globals.STOMPPort,
+		TLSCertFile:      &globals.TLSCertFile,
+		TLSKeyFile:       &globals.TLSKeyFile,
+		TLSMinVersion:    &globals.TLSMinVersion,
+		TLSClientCAFile:  &globals.TLSClientCAFile,
 	}
 }
 
 // ShutdownReport details how the broker shutdown last.
+//
+// A report with graceful-shutdown false and no stopped time is the marker a
+// running broker leaves, so finding one on startup means the last run died
+// without shutting down.
 type ShutdownReport struct {
-	GracefulShutdown *bool `json:"graceful-shutdown"`
+	GracefulShutdown *bool      `json:"graceful-shutdown"`
+	Started          *time.Time `json:"started,omitempty"`
+	Stopped          *time.Time `json:"stopped,omitempty"`
+	Reason           *string    `json:"reason,omitempty"`
+	Undelivered      *int       `json:"undelivered,omitempty"`
+	UndeliveredLog   *string    `json:"undelivered-log,omitempty"`
+}
+
+// SourceData describes a source connector that publishes local data onto a
+// route without a client.
+//
+// Type is either "file", which tails a file and publishes each line, or
+// "directory", which watches a spool directory and publishes each file.
+type SourceData struct {
+	Name       *string `json:"name"`
+	Type       *string `json:"type"`
+	Path       *string `json:"path"`
+	Route      *string `json:"route"`
+	Channel    *string `json:"channel"`
+	Pattern    *string `json:"pattern"`
+	Poll       *string `json:"poll"`
+	Delete     *bool   `json:"delete"`
+	Checkpoint *string `json:"checkpoint"`
+}
+
+// RouteData is a route as it appears in the "routes" field.
+type RouteData struct {
+	Name     string        `json:"name"`
+	Channels []ChannelData `json:"channels"`
+}
+
+// ChannelData is a channel of a RouteData, in route order.
+type ChannelData struct {
+	Name         string         `json:"name"`
+	Strategy     string         `json:"strategy"`
+	Transformers []EndpointData `json:"transformers,omitempty"`
+	Subscribers  []EndpointData `json:"subscribers,omitempty"`
+}
+
+// SelectionStrategy returns the channel's strategy, globals.DefaultStrategy if
+// it has none.
+func (cd ChannelData) SelectionStrategy() globals.SelectionStrategy {
+	if cd.Strategy == "" {
+		return globals.DefaultStrategy
+	}
+	return globals.StrategyValue[cd.Strategy]
+}
+
+// EndpointData is a transformer or subscriber of a ChannelData.
+type EndpointData struct {
+	Address string       `json:"address"`
+	TLS     *EndpointTLS `json:"tls,omitempty"`
+}
+
+// DialAddress returns the endpoint's address, in its tls:// form if the
+// endpoint has TLS enabled.
+func (e EndpointData) DialAddress() string {
+	if e.TLS == nil || !e.TLS.Enabled ||
+		strings.HasPrefix(e.Address, comm.TLSScheme) {
+		return e.Address
+	}
+	return e.TLS.Address(e.Address)
+}
+
+// EndpointTLS is an endpoint's "tls" field, either true to dial with the
+// system roots or an object of comm.DialTLS settings.
+type EndpointTLS struct {
+	Enabled bool
+	comm.DialTLS
+}
+
+func (t *EndpointTLS) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &t.Enabled); err == nil {
+		return nil
+	}
+	t.Enabled = true
+	return json.Unmarshal(data, &t.DialTLS)
+}
+
+func (t EndpointTLS) MarshalJSON() ([]byte, error) {
+	if !t.Enabled || t.DialTLS == (comm.DialTLS{}) {
+		return json.Marshal(t.Enabled)
+	}
+	return json.Marshal(t.DialTLS)
+}
+
+// StateData is the state file, the broker's live topology in the same shape
+// as the config file's "routes" field.
+type StateData struct {
+	Routes []RouteData `json:"routes"`
+}
+
+// TokenData configures signed tokens.
+type TokenData struct {
+	Keys         *[]globals.TokenKey `json:"keys"`
+	SigningKey   *string             `json:"signing-key"`
+	Denylist     *[]string           `json:"denylist"`
+	DenylistFile *string             `json:"denylist-file"`
 }
 
 // SystemData represents global dynamic values, shutdown details, or pre-defined
 // routes.
 type SystemData struct {
-	ShutdownReport *ShutdownReport   `json:"shutdown-report"`
-	Parameters     *ParamData        `json:"parameters"`
-	Routes         *[]map[string]any `json:"routes"`
+	ShutdownReport *ShutdownReport      `json:"shutdown-report,omitempty"`
+	Parameters     *ParamData           `json:"parameters,omitempty"`
+	Routes         *[]RouteData         `json:"routes,omitempty"`
+	Sources        *[]SourceData        `json:"sources,omitempty"`
+	Roles          *[]globals.Role      `json:"roles,omitempty"`
+	Principals     *[]globals.Principal `json:"principals,omitempty"`
+	Tokens         *TokenData           `json:"tokens,omitempty"`
 }
 
 func NewSystemData() *SystemData {
 	shutdownStatus := false
 	report := &ShutdownReport{GracefulShutdown: &shutdownStatus}
 
-	var routes []map[string]any
+	var routes []RouteData
+	var sources []SourceData
 
 	return &SystemData{
 		ShutdownReport: report,
 		Parameters:     NewParamData(),
 		Routes:         &routes,
+		Sources:        &sources,
 	}
 }
@@ -0,0 +1,161 @@
+package tokens
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"mycelia/comm"
+	"mycelia/globals"
+	"mycelia/logging"
+)
+
+// -------Keys------------------------------------------------------------------
+
+func findKey(id string) (globals.TokenKey, bool) {
+	for _, k := range globals.TokenKeys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return globals.TokenKey{}, false
+}
+
+// signingKey is globals.TokenSigningKey, or the first key if it is unset.
+func signingKey() (globals.TokenKey, error) {
+	if len(globals.TokenKeys) == 0 {
+		return globals.TokenKey{}, errors.New("no token keys configured")
+	}
+	if globals.TokenSigningKey == "" {
+		return globals.TokenKeys[0], nil
+	}
+	k, ok := findKey(globals.TokenSigningKey)
+	if !ok {
+		return k, fmt.Errorf("unknown signing key %q", globals.TokenSigningKey)
+	}
+	return k, nil
+}
+
+// keyMaterial returns the key's secret bytes. Key files are read on every call
+// so a replaced file takes effect without a restart.
+func keyMaterial(k globals.TokenKey) ([]byte, error) {
+	var secret []byte
+	switch {
+	case k.File != "":
+		data, err := os.ReadFile(comm.ResolvePath(k.File))
+		if err != nil {
+			return nil, fmt.Errorf("could not read token key %s: %w", k.ID, err)
+		}
+		secret = []byte(strings.TrimSpace(string(data)))
+	case strings.HasPrefix(k.Secret, "base64:"):
+		b, err := base64.StdEncoding.DecodeString(k.Secret[len("base64:"):])
+		if err != nil {
+			return nil, fmt.Errorf("token key %s is not valid base64", k.ID)
+		}
+		secret = b
+	default:
+		secret = []byte(k.Secret)
+	}
+
+	if len(secret) < minKeyLength {
+		return nil, fmt.Errorf(
+			"token key %s is shorter than %d bytes", k.ID, minKeyLength,
+		)
+	}
+	return secret, nil
+}
+
+// ValidateKey checks the key has an ID and loadable key material.
+func ValidateKey(k globals.TokenKey) error {
+	if k.ID == "" {
+		return errors.New("token key without an id")
+	}
+	if k.Secret != "" && k.File != "" {
+		return fmt.Errorf("token key %s sets both secret and file", k.ID)
+	}
+	_, err := keyMaterial(k)
+	return err
+}
+
+// -------Denylist--------------------------------------------------------------
+
+// denylistCheckInterval bounds how often the denylist file is stat'ed.
+const denylistCheckInterval = time.Second
+
+var denylist struct {
+	mutex   sync.Mutex
+	file    string
+	modTime time.Time
+	checked time.Time
+	ids     map[string]bool
+}
+
+// Revoked reports whether the token ID is on globals.TokenDenylist or in
+// globals.TokenDenylistFile.
+func Revoked(id string) bool {
+	if id == "" {
+		return false
+	}
+	if slices.Contains(globals.TokenDenylist, id) {
+		return true
+	}
+	if globals.TokenDenylistFile == "" {
+		return false
+	}
+
+	denylist.mutex.Lock()
+	defer denylist.mutex.Unlock()
+	refreshDenylist()
+	return denylist.ids[id]
+}
+
+// refreshDenylist re-reads the denylist file if it changed. Must hold the
+// denylist mutex.
+func refreshDenylist() {
+	file := comm.ResolvePath(globals.TokenDenylistFile)
+	if file == denylist.file && time.Since(denylist.checked) < denylistCheckInterval {
+		return
+	}
+	denylist.checked = time.Now()
+
+	info, err := os.Stat(file)
+	if err != nil {
+		if file != denylist.file || denylist.ids != nil {
+			logging.LogSystemWarning(
+				fmt.Sprintf("Could not read token denylist: %s", err),
+			)
+		}
+		denylist.file, denylist.ids = file, nil
+		return
+	}
+	if file == denylist.file && info.ModTime().Equal(denylist.modTime) {
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		logging.LogSystemWarning(fmt.Sprintf("Could not read token denylist: %s", err))
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	ids := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			ids[line] = true
+		}
+	}
+
+	denylist.file, denylist.modTime, denylist.ids = file, info.ModTime(), ids
+	logging.LogSystemAction(
+		fmt.Sprintf("Loaded %d revoked token IDs from %s", len(ids), file),
+	)
+}
@@ -0,0 +1,217 @@
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"mycelia/globals"
+)
+
+// -----------------------------------------------------------------------------
+// Herein are signed, expiring tokens and hashed static tokens.
+//
+// A signed token is
+//
+//	myc1.<base64url claims JSON>.<base64url HMAC-SHA256>
+//
+// where the HMAC is over "myc1.<claims>" with the key named by the claims'
+// kid. Tokens are verified locally against globals.TokenKeys, so any of the
+// active keys may have signed it, and rejected once expired or once their ID
+// is on the denylist.
+//
+// Static tokens may be stored as "sha256:<hex>" so the config file does not
+// hold the secret itself.
+// -----------------------------------------------------------------------------
+
+const (
+	// Prefix starts every signed token.
+	Prefix = "myc1."
+
+	// HashPrefix starts a static token stored as its SHA-256.
+	HashPrefix = "sha256:"
+
+	minKeyLength = 16
+)
+
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrSignature  = errors.New("invalid token signature")
+	ErrUnknownKey = errors.New("unknown token key")
+	ErrExpired    = errors.New("token expired")
+	ErrRevoked    = errors.New("token revoked")
+)
+
+// Claims is the signed body of a token.
+//
+// Scopes are "permission" or "permission:route-pattern" grants, or
+// "role:<name>" to grant a configured role.
+type Claims struct {
+	KeyID    string   `json:"kid"`
+	Subject  string   `json:"sub"`
+	Scopes   []string `json:"scopes,omitempty"`
+	IssuedAt int64    `json:"iat"`
+	Expires  int64    `json:"exp"`
+	ID       string   `json:"jti"`
+}
+
+// ExpiresAt is when the token stops being valid.
+func (c *Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expires, 0)
+}
+
+// IsSigned reports whether token is a signed token rather than a static one.
+func IsSigned(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// Issue signs a token for subject with the signing key.
+func Issue(subject string, scopes []string, ttl time.Duration) (string, *Claims, error) {
+	if subject == "" {
+		return "", nil, errors.New("token subject is required")
+	}
+	if ttl <= 0 {
+		return "", nil, errors.New("token ttl must be > 0")
+	}
+	for _, scope := range scopes {
+		if err := ValidateScope(scope); err != nil {
+			return "", nil, err
+		}
+	}
+
+	key, err := signingKey()
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := keyMaterial(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	claims := &Claims{
+		KeyID:    key.ID,
+		Subject:  subject,
+		Scopes:   scopes,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+		ID:       hex.EncodeToString(id),
+	}
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	signed := Prefix + base64.RawURLEncoding.EncodeToString(body)
+	return signed + "." + sign(secret, signed), claims, nil
+}
+
+// Verify checks the token's signature, expiry, and revocation, returning its
+// claims.
+func Verify(token string) (*Claims, error) {
+	if !IsSigned(token) {
+		return nil, ErrMalformed
+	}
+	dot := strings.LastIndexByte(token, '.')
+	if dot <= len(Prefix) {
+		return nil, ErrMalformed
+	}
+	signed, sig := token[:dot], token[dot+1:]
+
+	body, err := base64.RawURLEncoding.DecodeString(signed[len(Prefix):])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	key, ok := findKey(claims.KeyID)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	secret, err := keyMaterial(key)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(sign(secret, signed)), []byte(sig)) {
+		return nil, ErrSignature
+	}
+
+	if !time.Now().Before(claims.ExpiresAt()) {
+		return nil, ErrExpired
+	}
+	if Revoked(claims.ID) {
+		return nil, ErrRevoked
+	}
+	return &claims, nil
+}
+
+func sign(secret []byte, signed string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateScope checks a scope is a known permission, optionally with a valid
+// route pattern, or a role grant.
+func ValidateScope(scope string) error {
+	if name, ok := strings.CutPrefix(scope, "role:"); ok {
+		if name == "" {
+			return fmt.Errorf("scope %q names no role", scope)
+		}
+		return nil
+	}
+
+	perm, pattern, _ := strings.Cut(scope, ":")
+	p := globals.Permission(perm)
+	if !slices.Contains(globals.Permissions, p) {
+		return fmt.Errorf("scope %q: unknown permission %q", scope, perm)
+	}
+	if pattern == "" {
+		return nil
+	}
+	if !p.RouteScoped() {
+		return fmt.Errorf("scope %q: %s is not route scoped", scope, perm)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("scope %q: bad route pattern", scope)
+	}
+	return nil
+}
+
+// -------Static Tokens---------------------------------------------------------
+
+// Hash returns the at-rest form of a static token.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return HashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Match reports whether the presented token matches a stored static token,
+// which may be in plain or hashed form. Compares in constant time.
+func Match(stored, presented string) bool {
+	if stored == "" || presented == "" {
+		return false
+	}
+	if strings.HasPrefix(stored, HashPrefix) {
+		presented = Hash(presented)
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(presented)) == 1
+}
@@ -0,0 +1,258 @@
+package tokens
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mycelia/globals"
+)
+
+// useKeys sets the token keys, signing key, and denylists for the test.
+func useKeys(t *testing.T, signing string, keys ...globals.TokenKey) {
+	t.Helper()
+	prevKeys, prevSigning := globals.TokenKeys, globals.TokenSigningKey
+	prevDeny, prevDenyFile := globals.TokenDenylist, globals.TokenDenylistFile
+	t.Cleanup(func() {
+		globals.TokenKeys, globals.TokenSigningKey = prevKeys, prevSigning
+		globals.TokenDenylist, globals.TokenDenylistFile = prevDeny, prevDenyFile
+	})
+	globals.TokenKeys, globals.TokenSigningKey = keys, signing
+	globals.TokenDenylist, globals.TokenDenylistFile = nil, ""
+}
+
+// signClaims signs claims as Issue would, so tests can sign claims Issue
+// refuses to, such as expired ones.
+func signClaims(t *testing.T, secret string, claims Claims) string {
+	t.Helper()
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := Prefix + base64.RawURLEncoding.EncodeToString(body)
+	return signed + "." + sign([]byte(secret), signed)
+}
+
+var (
+	keyA = globals.TokenKey{ID: "a", Secret: "0123456789abcdef-a"}
+	keyB = globals.TokenKey{ID: "b", Secret: "0123456789abcdef-b"}
+)
+
+func TestIssueVerify(t *testing.T) {
+	useKeys(t, "a", keyA, keyB)
+
+	scopes := []string{"publish:orders-*"}
+	token, issued, err := Issue("checkout", scopes, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if !IsSigned(token) {
+		t.Fatalf("Issue returned %q, want the %s prefix", token, Prefix)
+	}
+
+	claims, err := Verify(token)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.Subject != "checkout" || claims.KeyID != "a" ||
+		claims.ID != issued.ID || len(claims.Scopes) != 1 {
+		t.Errorf("Verify = %+v, want the issued claims %+v", claims, issued)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	useKeys(t, "a", keyA, keyB)
+
+	valid, _, err := Issue("checkout", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	dot := strings.LastIndexByte(valid, '.')
+	body, sig := valid[:dot], valid[dot+1:]
+
+	now := time.Now()
+	claims := func(kid string, exp time.Time) Claims {
+		return Claims{
+			KeyID: kid, Subject: "checkout", IssuedAt: now.Unix(),
+			Expires: exp.Unix(), ID: "0f0f",
+		}
+	}
+
+	// A body claiming another subject under the original signature.
+	forged := claims("a", now.Add(time.Hour))
+	forged.Subject = "admin"
+	forgedBody := signClaims(t, keyA.Secret, forged)
+	forgedBody = forgedBody[:strings.LastIndexByte(forgedBody, '.')]
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"not signed", "lockheed", ErrMalformed},
+		{"no signature", body, ErrMalformed},
+		{"bad base64", Prefix + "!!!." + sig, ErrMalformed},
+		{"tampered signature",
+			body + "." + strings.Repeat("A", len(sig)), ErrSignature},
+		{"truncated signature", body + "." + sig[:len(sig)-2], ErrSignature},
+		{"tampered claims", forgedBody + "." + sig, ErrSignature},
+		{"signed with the wrong key", signClaims(
+			t, keyB.Secret, claims("a", now.Add(time.Hour)),
+		), ErrSignature},
+		{"unknown key", signClaims(
+			t, keyA.Secret, claims("retired", now.Add(time.Hour)),
+		), ErrUnknownKey},
+		{"expired", signClaims(
+			t, keyA.Secret, claims("a", now.Add(-time.Second)),
+		), ErrExpired},
+		{"expires now", signClaims(
+			t, keyA.Secret, claims("a", now),
+		), ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify(tt.token); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyOtherActiveKey(t *testing.T) {
+	useKeys(t, "b", keyA, keyB)
+	token, _, err := Issue("checkout", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	// Rotating the signing key back keeps tokens of the other key valid.
+	globals.TokenSigningKey = "a"
+	if _, err := Verify(token); err != nil {
+		t.Errorf("Verify with key b still active = %v, want nil", err)
+	}
+
+	globals.TokenKeys = []globals.TokenKey{keyA}
+	if _, err := Verify(token); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Verify with key b removed = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestVerifyDenylist(t *testing.T) {
+	useKeys(t, "a", keyA)
+	token, claims, err := Issue("checkout", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	other, _, err := Issue("checkout", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "revoked.txt")
+	data := "# revoked\n\n" + claims.ID + "\n"
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		denylist []string
+		file     string
+	}{
+		{"denylist", []string{"ffff", claims.ID}, ""},
+		{"denylist file", nil, file},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			globals.TokenDenylist, globals.TokenDenylistFile = tt.denylist, tt.file
+			if _, err := Verify(token); !errors.Is(err, ErrRevoked) {
+				t.Errorf("Verify revoked token = %v, want %v", err, ErrRevoked)
+			}
+			if _, err := Verify(other); err != nil {
+				t.Errorf("Verify other token = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestIssueRejects(t *testing.T) {
+	useKeys(t, "a", keyA)
+
+	tests := []struct {
+		name    string
+		subject string
+		scopes  []string
+		ttl     time.Duration
+	}{
+		{"no subject", "", nil, time.Hour},
+		{"no ttl", "checkout", nil, 0},
+		{"unknown permission", "checkout", []string{"launch"}, time.Hour},
+		{"bad pattern", "checkout", []string{"publish:["}, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := Issue(tt.subject, tt.scopes, tt.ttl); err == nil {
+				t.Error("Issue = nil error, want an error")
+			}
+		})
+	}
+
+	globals.TokenKeys = []globals.TokenKey{{ID: "short", Secret: "too-short"}}
+	globals.TokenSigningKey = ""
+	if _, _, err := Issue("checkout", nil, time.Hour); err == nil {
+		t.Error("Issue with a short key = nil error, want an error")
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		ok    bool
+	}{
+		{"publish", true},
+		{"publish:orders-*", true},
+		{"subscribe:orders-?", true},
+		{"manage-topology:[a-c]*", true},
+		{"role:operator", true},
+		{"role:", false},
+		{"launch", false},
+		{"publish:[", false},
+		{"shutdown:orders", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			if err := ValidateScope(tt.scope); (err == nil) != tt.ok {
+				t.Errorf("ValidateScope(%q) = %v, want ok %t", tt.scope, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    string
+		presented string
+		want      bool
+	}{
+		{"plain", "lockheed", "lockheed", true},
+		{"plain mismatch", "lockheed", "martin", false},
+		{"hashed", Hash("lockheed"), "lockheed", true},
+		{"hashed mismatch", Hash("lockheed"), "martin", false},
+		{"hash presented as is", Hash("lockheed"), Hash("lockheed"), false},
+		{"empty presented", "lockheed", "", false},
+		{"empty stored", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.stored, tt.presented); got != tt.want {
+				t.Errorf("Match = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}